@@ -22,11 +22,20 @@ func main() {
 	}
 
 	// Create() method documentation at: https://msdn.microsoft.com/en-us/library/hh872254(v=vs.85).aspx
-	_, err = netip.Get("Create", nil, "Ethernet1", "10.10.10.11", 2, 24)
+	out, err := netip.Call("Create", map[string]interface{}{
+		"InterfaceAlias": "Ethernet1",
+		"IPAddress":      "10.10.10.11",
+		"AddressFamily":  uint16(2),
+		"PrefixLength":   uint8(24),
+	})
 	if err != nil {
 		fmt.Printf("Error running Create: %v", err)
 		os.Exit(1)
 	}
+	if err := out.Wait(); err != nil {
+		fmt.Printf("Create failed: %v", err)
+		os.Exit(1)
+	}
 	fmt.Println("Success!")
 	return
 }
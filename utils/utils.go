@@ -5,7 +5,6 @@ import (
 	"fmt"
 
 	"github.com/gabriel-samfira/go-wmi/wmi"
-	"github.com/go-ole/go-ole"
 	"github.com/pkg/errors"
 )
 
@@ -58,45 +57,38 @@ func GetElementsAssociatedClass(conn *wmi.WMI, className, instanceID string, ext
 
 // RemoveResourceSettings removes a list of resource settings
 func RemoveResourceSettings(svc *wmi.Result, resources []string) error {
-	// RemoveResourceSettings
-	jobPath := ole.VARIANT{}
-	jobState, err := svc.Get("RemoveResourceSettings", resources, &jobPath)
+	out, err := svc.Call("RemoveResourceSettings", map[string]interface{}{
+		"ResourceSettings": resources,
+	})
 	if err != nil {
-		return errors.Wrap(err, "calling ModifyResourceSettings")
+		return errors.Wrap(err, "calling RemoveResourceSettings")
 	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return errors.Wrap(err, "waiting for job")
-		}
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "RemoveResourceSettings")
 	}
 	return nil
 }
 
 // AddResourceSetting adds the resource settings to the specified VM
 func AddResourceSetting(svc *wmi.Result, settingsData []string, vmPath string) ([]string, error) {
-	jobPath := ole.VARIANT{}
-	resultingSystem := ole.VARIANT{}
-	jobState, err := svc.Get("AddResourceSettings", vmPath, settingsData, &resultingSystem, &jobPath)
+	out, err := svc.Call("AddResourceSettings", map[string]interface{}{
+		"AffectedConfiguration": vmPath,
+		"ResourceSettings":      settingsData,
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "calling ModifyResourceSettings")
+		return nil, errors.Wrap(err, "calling AddResourceSettings")
+	}
+	if err := out.Wait(); err != nil {
+		return nil, errors.Wrap(err, "AddResourceSettings")
 	}
 
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return nil, errors.Wrap(err, "waiting for job")
-		}
+	resultingSystems, err := out.Strings("ResultingResourceSettings")
+	if err != nil {
+		return nil, errors.Wrap(err, "ResultingResourceSettings")
 	}
-	safeArrayConversion := resultingSystem.ToArray()
-	valArray := safeArrayConversion.ToValueArray()
-	if len(valArray) == 0 {
+	if len(resultingSystems) == 0 {
 		return nil, fmt.Errorf("no resource in resultingSystem value")
 	}
-	resultingSystems := make([]string, len(valArray))
-	for idx, val := range valArray {
-		resultingSystems[idx] = val.(string)
-	}
 	return resultingSystems, nil
 }
 
@@ -5,7 +5,6 @@ import (
 
 	"github.com/gabriel-samfira/go-wmi/utils"
 	"github.com/gabriel-samfira/go-wmi/wmi"
-	"github.com/go-ole/go-ole"
 	"github.com/pkg/errors"
 )
 
@@ -49,6 +48,13 @@ func (m *Manager) Release() {
 	m.stdCimV2Con.Close()
 }
 
+// SetRetryPolicy sets the retry policy of the connections used by this
+// manager. Use nil to disable retries.
+func (m *Manager) SetRetryPolicy(p *wmi.RetryPolicy) {
+	m.con.SetRetryPolicy(p)
+	m.stdCimV2Con.SetRetryPolicy(p)
+}
+
 func (m *Manager) getVMSwitchFromResult(sw *wmi.Result) (VirtualSwitch, error) {
 	switchSettingsResult, err := sw.Get("associators_", nil, VMSwitchSettings)
 	if err != nil {
@@ -164,14 +170,9 @@ func (m *Manager) ListVMSwitches() ([]VirtualSwitch, error) {
 // external VM switch with management OS, inheriting the IP settings of the external
 // net adapter attached to the switch.
 func (m *Manager) CreateVMSwitch(name string) (VirtualSwitch, error) {
-	data, err := m.con.Get(VMSwitchSettings)
+	swInstance, err := m.con.SpawnInstance(VMSwitchSettings)
 	if err != nil {
-		return VirtualSwitch{}, errors.Wrap(err, "get VMSwitchSettings")
-	}
-
-	swInstance, err := data.Get("SpawnInstance_")
-	if err != nil {
-		return VirtualSwitch{}, errors.Wrap(err, "SpawnInstance_")
+		return VirtualSwitch{}, errors.Wrap(err, "SpawnInstance")
 	}
 
 	if err := swInstance.Set("ElementName", name); err != nil {
@@ -182,28 +183,29 @@ func (m *Manager) CreateVMSwitch(name string) (VirtualSwitch, error) {
 		return VirtualSwitch{}, errors.Wrap(err, "GetText")
 	}
 
-	jobPath := ole.VARIANT{}
-	resultingSystem := ole.VARIANT{}
-	jobState, err := m.svc.Get("DefineSystem", switchText, nil, nil, &resultingSystem, &jobPath)
+	out, err := m.svc.Call("DefineSystem", map[string]interface{}{
+		"SystemSettings": switchText,
+	})
 	if err != nil {
 		return VirtualSwitch{}, errors.Wrap(err, "DefineSystem")
 	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return VirtualSwitch{}, errors.Wrap(err, "WaitForJob")
-		}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return VirtualSwitch{}, errors.Wrap(err, "WaitForJob")
 	}
 
 	// The resultingSystem value for DefineSystem is always a string containing the
 	// location of the newly created resource
-	locationURI := resultingSystem.Value().(string)
+	locationURI, err := out.String("ResultingSystem")
+	if err != nil {
+		return VirtualSwitch{}, errors.Wrap(err, "ResultingSystem")
+	}
 	loc, err := wmi.NewLocation(locationURI)
 	if err != nil {
 		return VirtualSwitch{}, errors.Wrap(err, "getting location")
 	}
 
-	result, err := loc.GetResult()
+	result, err := loc.GetResultFrom(m.con)
 	if err != nil {
 		return VirtualSwitch{}, errors.Wrap(err, "getting result")
 	}
@@ -229,16 +231,15 @@ func (m *Manager) RemoveVMSwitch(switchID string) error {
 	if err != nil {
 		return errors.Wrap(err, "get path_")
 	}
-	jobPath := ole.VARIANT{}
-	jobState, err := m.svc.Get("DestroySystem", swPapth, &jobPath)
+	out, err := m.svc.Call("DestroySystem", map[string]interface{}{
+		"AffectedSystem": swPapth,
+	})
 	if err != nil {
 		return fmt.Errorf("Failed to call DestroySystem: %v", err)
 	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return errors.Wrap(err, "WaitForJob")
-		}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "WaitForJob")
 	}
 	return nil
 }
@@ -258,22 +259,16 @@ func (v VirtualSwitch) Path() (string, error) {
 }
 
 func (v VirtualSwitch) getHostResourceLocation(res *wmi.Result) (*wmi.Location, error) {
-	hostResource, err := res.GetProperty("HostResource")
-	if err != nil {
+	settings := struct {
+		HostResource []*wmi.Location
+	}{}
+	if err := wmi.PopulateStruct(res, &settings); err != nil {
 		return nil, errors.Wrap(err, "HostResource")
 	}
-
-	asArray := hostResource.ToArray()
-	valueArray := asArray.ToValueArray()
-	if len(valueArray) == 0 {
+	if len(settings.HostResource) == 0 {
 		return nil, wmi.ErrNotFound
 	}
-	valuePath := valueArray[0].(string)
-	location, err := wmi.NewLocation(valuePath)
-	if err != nil {
-		return nil, errors.Wrap(err, "NewLocation")
-	}
-	return location, nil
+	return settings.HostResource[0], nil
 }
 
 func (v VirtualSwitch) getSwitchPortAllocSettings() ([]switchPortAllocations, error) {
@@ -448,47 +443,41 @@ func (v VirtualSwitch) setSwitchResources(resources []string) error {
 	if err != nil {
 		return errors.Wrap(err, "Path_")
 	}
-	jobPath := ole.VARIANT{}
-	jobState, err := v.mgr.svc.Get("AddResourceSettings", switchPath, resources, nil, &jobPath)
+	out, err := v.mgr.svc.Call("AddResourceSettings", map[string]interface{}{
+		"AffectedConfiguration": switchPath,
+		"ResourceSettings":      resources,
+	})
 	if err != nil {
 		return fmt.Errorf("Failed to call AddResourceSettings: %v", err)
 	}
-
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	defer out.Release()
+	return out.Wait()
 }
 
 func (v VirtualSwitch) removeSwitchResources(resources []string) error {
-	jobPath := ole.VARIANT{}
-	jobState, err := v.mgr.svc.Get("RemoveResourceSettings", resources, &jobPath)
+	out, err := v.mgr.svc.Call("RemoveResourceSettings", map[string]interface{}{
+		"ResourceSettings": resources,
+	})
 	if err != nil {
 		return errors.Wrap(err, "RemoveResourceSettings")
 	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return errors.Wrap(err, "WaitForJob")
-		}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "WaitForJob")
 	}
 	return nil
 }
 
 func (v VirtualSwitch) modifySwitchSettings(settings string) error {
-	jobPath := ole.VARIANT{}
-	jobState, err := v.mgr.svc.Get("ModifySystemSettings", settings, &jobPath)
+	out, err := v.mgr.svc.Call("ModifySystemSettings", map[string]interface{}{
+		"SystemSettings": settings,
+	})
 	if err != nil {
 		return errors.Wrap(err, "ModifySystemSettings")
 	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return errors.Wrap(err, "WaitForJob")
-		}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "WaitForJob")
 	}
 	return nil
 }
@@ -579,18 +568,18 @@ func (v VirtualSwitch) SetInternalPort() error {
 		if err != nil {
 			return errors.Wrap(err, "NewLocation")
 		}
-		extAllocResult, err := extAllocSettingsLocation.GetResult()
+		extAllocResult, err := extAllocSettingsLocation.GetResultFrom(v.mgr.con)
 		if err != nil {
-			return errors.Wrap(err, "GetResult")
+			return errors.Wrap(err, "GetResultFrom")
 		}
 		extPortResult, err := v.getHostResourceLocation(extAllocResult)
 		if err != nil {
 			return errors.Wrap(err, "getHostResourceLocation")
 		}
 
-		extResult, err := extPortResult.GetResult()
+		extResult, err := extPortResult.GetResultFrom(v.mgr.con)
 		if err != nil {
-			return errors.Wrap(err, "GetResult")
+			return errors.Wrap(err, "GetResultFrom")
 		}
 
 		mac, err := extResult.GetProperty("PermanentAddress")
@@ -671,9 +660,9 @@ func (v VirtualSwitch) setInternalPortName(switchName string) error {
 		return errors.Wrap(err, "NewLocation")
 	}
 
-	res, err := loc.GetResult()
+	res, err := loc.GetResultFrom(v.mgr.con)
 	if err != nil {
-		return errors.Wrap(err, "GetResult")
+		return errors.Wrap(err, "GetResultFrom")
 	}
 
 	if err := res.Set("ElementName", switchName); err != nil {
@@ -685,17 +674,15 @@ func (v VirtualSwitch) setInternalPortName(switchName string) error {
 		return errors.Wrap(err, "GetText")
 	}
 
-	jobPath := ole.VARIANT{}
-	resultingSystem := ole.VARIANT{}
-	jobState, err := v.mgr.svc.Get("ModifyResourceSettings", []string{portText}, &resultingSystem, &jobPath)
+	out, err := v.mgr.svc.Call("ModifyResourceSettings", map[string]interface{}{
+		"ResourceSettings": []string{portText},
+	})
 	if err != nil {
 		return errors.Wrap(err, "ModifyResourceSettings")
 	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return errors.Wrap(err, "WaitForJob")
-		}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "WaitForJob")
 	}
 	return nil
 }
@@ -0,0 +1,38 @@
+package storage
+
+// Hyper-V image management constants
+const (
+	ImageManagementService          = "Msvm_ImageManagementService"
+	VirtualHardDiskSettingDataClass = "Msvm_VirtualHardDiskSettingData"
+	MountedStorageImageClass        = "Msvm_MountedStorageImage"
+)
+
+// DiskType is the type of a virtual hard disk
+type DiskType uint16
+
+// Virtual hard disk types
+// See: https://docs.microsoft.com/en-us/windows/win32/hyperv_v2/msvm-virtualharddisksettingdata
+var (
+	FixedDisk        DiskType = 2
+	DynamicDisk      DiskType = 3
+	DifferencingDisk DiskType = 4
+)
+
+// DiskFormat is the file format of a virtual hard disk
+type DiskFormat uint16
+
+// Virtual hard disk formats
+var (
+	FormatVHD  DiskFormat = 2
+	FormatVHDX DiskFormat = 3
+)
+
+// CompactMode selects how a virtual hard disk is compacted
+type CompactMode uint16
+
+// Compact modes
+// See: https://docs.microsoft.com/en-us/windows/win32/hyperv_v2/compactvirtualharddisk-msvm-imagemanagementservice
+var (
+	CompactFull  CompactMode = 0
+	CompactQuick CompactMode = 1
+)
@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-samfira/go-wmi/wmi"
+	"github.com/pkg/errors"
+)
+
+// NewImageManager returns a new Manager type
+func NewImageManager() (*Manager, error) {
+	w, err := wmi.NewConnection(".", wmi.VirtualizationV2Namespace)
+	if err != nil {
+		return nil, err
+	}
+	// Sizes are uint64 properties, which WMI only accepts as strings.
+	// Strict mode converts them, and checks the other values we set.
+	w.SetStrictWrites(true)
+
+	svc, err := w.GetOne(ImageManagementService, []string{}, []wmi.Query{})
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return &Manager{
+		con: w,
+		svc: svc,
+	}, nil
+}
+
+// Manager offers a root\virtualization\v2 instance connection
+// and an instance of Msvm_ImageManagementService
+type Manager struct {
+	con *wmi.WMI
+	svc *wmi.Result
+}
+
+// Release closes the WMI connection
+func (m *Manager) Release() {
+	m.con.Close()
+}
+
+// SetRetryPolicy sets the retry policy of the connection used by this
+// manager. Use nil to disable retries.
+func (m *Manager) SetRetryPolicy(p *wmi.RetryPolicy) {
+	m.con.SetRetryPolicy(p)
+}
+
+// DiskSettings holds the properties of a virtual hard disk, as found in
+// Msvm_VirtualHardDiskSettingData
+type DiskSettings struct {
+	Path string
+	// ParentPath is the parent of a differencing disk
+	ParentPath string
+	Type       DiskType
+	// Format is inferred from the extension of Path if not set
+	Format DiskFormat
+	// MaxInternalSize is the size of the disk as seen by the guest, in bytes
+	MaxInternalSize uint64
+	// BlockSize, LogicalSectorSize and PhysicalSectorSize are in bytes.
+	// Zero values leave the choice to Hyper-V.
+	BlockSize          uint32
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+	// VirtualDiskID is the unique ID of the disk. It is read only.
+	VirtualDiskID string
+}
+
+// DiskState holds the state of a virtual hard disk file, as found in
+// Msvm_VirtualHardDiskState
+type DiskState struct {
+	// FileSize is the size of the file, in bytes
+	FileSize uint64
+	// InUse is true if the disk is attached to a virtual machine or
+	// mounted on the host
+	InUse bool
+	// MinInternalSize is the size the disk can be shrunk to, in bytes
+	MinInternalSize         uint64
+	PhysicalSectorSize      uint32
+	Alignment               uint32
+	FragmentationPercentage uint32
+}
+
+// formatFromPath returns the disk format matching the extension of pth
+func formatFromPath(pth string) (DiskFormat, error) {
+	switch strings.ToLower(filepath.Ext(pth)) {
+	case ".vhd", ".avhd":
+		return FormatVHD, nil
+	case ".vhdx", ".avhdx":
+		return FormatVHDX, nil
+	}
+	return 0, fmt.Errorf("cannot infer disk format of %s", pth)
+}
+
+// settingData returns the embedded Msvm_VirtualHardDiskSettingData
+// instance described by settings
+func (m *Manager) settingData(settings DiskSettings) (string, error) {
+	if settings.Format == 0 {
+		format, err := formatFromPath(settings.Path)
+		if err != nil {
+			return "", err
+		}
+		settings.Format = format
+	}
+	data, err := m.con.SpawnInstance(VirtualHardDiskSettingDataClass)
+	if err != nil {
+		return "", errors.Wrap(err, "SpawnInstance")
+	}
+	defer data.Release()
+
+	values := []struct {
+		name  string
+		value interface{}
+		set   bool
+	}{
+		{"Path", settings.Path, true},
+		{"ParentPath", settings.ParentPath, settings.ParentPath != ""},
+		{"Type", uint16(settings.Type), true},
+		{"Format", uint16(settings.Format), true},
+		{"MaxInternalSize", settings.MaxInternalSize, settings.MaxInternalSize != 0},
+		{"BlockSize", settings.BlockSize, settings.BlockSize != 0},
+		{"LogicalSectorSize", settings.LogicalSectorSize, settings.LogicalSectorSize != 0},
+		{"PhysicalSectorSize", settings.PhysicalSectorSize, settings.PhysicalSectorSize != 0},
+	}
+	for _, val := range values {
+		if !val.set {
+			continue
+		}
+		if err := data.Set(val.name, val.value); err != nil {
+			return "", errors.Wrapf(err, "Set %s", val.name)
+		}
+	}
+	text, err := data.GetText(1)
+	if err != nil {
+		return "", errors.Wrap(err, "GetText")
+	}
+	return text, nil
+}
+
+// call calls method on the image management service, and waits for
+// the job it starts, if any.
+func (m *Manager) call(method string, params map[string]interface{}) (wmi.Outputs, error) {
+	out, err := m.svc.Call(method, params)
+	if err != nil {
+		return wmi.Outputs{}, errors.Wrapf(err, "calling %s", method)
+	}
+	if err := out.Wait(); err != nil {
+		out.Release()
+		return wmi.Outputs{}, errors.Wrap(err, method)
+	}
+	return out, nil
+}
+
+func (m *Manager) run(method string, params map[string]interface{}) error {
+	out, err := m.call(method, params)
+	if err != nil {
+		return err
+	}
+	out.Release()
+	return nil
+}
+
+// CreateDisk creates the virtual hard disk described by settings
+func (m *Manager) CreateDisk(settings DiskSettings) error {
+	if settings.Type == DifferencingDisk && settings.ParentPath == "" {
+		return fmt.Errorf("differencing disks require a parent")
+	}
+	data, err := m.settingData(settings)
+	if err != nil {
+		return err
+	}
+	return m.run("CreateVirtualHardDisk", map[string]interface{}{
+		"VirtualDiskSettingData": data,
+	})
+}
+
+// CreateFixedDisk creates a fixed size virtual hard disk of sizeBytes
+// at path. The format is inferred from the extension of path.
+func (m *Manager) CreateFixedDisk(path string, sizeBytes uint64) error {
+	return m.CreateDisk(DiskSettings{
+		Path:            path,
+		Type:            FixedDisk,
+		MaxInternalSize: sizeBytes,
+	})
+}
+
+// CreateDynamicDisk creates a dynamically expanding virtual hard disk of
+// sizeBytes at path. The format is inferred from the extension of path.
+func (m *Manager) CreateDynamicDisk(path string, sizeBytes uint64) error {
+	return m.CreateDisk(DiskSettings{
+		Path:            path,
+		Type:            DynamicDisk,
+		MaxInternalSize: sizeBytes,
+	})
+}
+
+// CreateDifferencingDisk creates a differencing virtual hard disk at
+// path, with parentPath as its parent.
+func (m *Manager) CreateDifferencingDisk(path, parentPath string) error {
+	return m.CreateDisk(DiskSettings{
+		Path:       path,
+		ParentPath: parentPath,
+		Type:       DifferencingDisk,
+	})
+}
+
+// ExpandDisk grows the virtual hard disk at path to sizeBytes
+func (m *Manager) ExpandDisk(path string, sizeBytes uint64) error {
+	return m.run("ResizeVirtualHardDisk", map[string]interface{}{
+		"Path":            path,
+		"MaxInternalSize": fmt.Sprintf("%d", sizeBytes),
+	})
+}
+
+// CompactDisk reclaims the unused space of the dynamic or differencing
+// virtual hard disk at path. The disk must not be in use, or must be
+// mounted read only.
+func (m *Manager) CompactDisk(path string, mode CompactMode) error {
+	return m.run("CompactVirtualHardDisk", map[string]interface{}{
+		"Path": path,
+		"Mode": uint16(mode),
+	})
+}
+
+// MergeDisk merges the differencing disk at sourcePath into its parent,
+// or into the ancestor at destinationPath.
+func (m *Manager) MergeDisk(sourcePath, destinationPath string) error {
+	return m.run("MergeVirtualHardDisk", map[string]interface{}{
+		"SourcePath":      sourcePath,
+		"DestinationPath": destinationPath,
+	})
+}
+
+// ConvertDisk writes a copy of the virtual hard disk at sourcePath to
+// destinationPath, converting it to diskType. The format of the copy is
+// inferred from the extension of destinationPath, so this converts
+// between VHD and VHDX as well.
+func (m *Manager) ConvertDisk(sourcePath, destinationPath string, diskType DiskType) error {
+	data, err := m.settingData(DiskSettings{
+		Path: destinationPath,
+		Type: diskType,
+	})
+	if err != nil {
+		return err
+	}
+	return m.run("ConvertVirtualHardDisk", map[string]interface{}{
+		"SourcePath":             sourcePath,
+		"VirtualDiskSettingData": data,
+	})
+}
+
+// MountDisk attaches the virtual hard disk at path to the host. Drive
+// letters are assigned to its volumes.
+func (m *Manager) MountDisk(path string, readOnly bool) error {
+	return m.run("AttachVirtualHardDisk", map[string]interface{}{
+		"Path":              path,
+		"AssignDriveLetter": true,
+		"ReadOnly":          readOnly,
+	})
+}
+
+// DismountDisk detaches the virtual hard disk at path from the host
+func (m *Manager) DismountDisk(path string) error {
+	qParams := []wmi.Query{
+		&wmi.AndQuery{
+			QueryFields: wmi.QueryFields{
+				Key:   "Name",
+				Value: strings.Replace(path, `\`, `\\`, -1),
+				Type:  wmi.Equals},
+		},
+	}
+	image, err := m.con.GetOne(MountedStorageImageClass, []string{}, qParams, wmi.Options{NoCache: true})
+	if err != nil {
+		return errors.Wrapf(err, "%s is not mounted", path)
+	}
+	defer image.Release()
+	out, err := image.Call("DetachVirtualHardDisk", nil)
+	if err != nil {
+		return errors.Wrap(err, "calling DetachVirtualHardDisk")
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "DetachVirtualHardDisk")
+	}
+	return nil
+}
+
+// embeddedOutput calls method with path, and returns the properties of
+// the embedded instance it returns in the out parameter param.
+func (m *Manager) embeddedOutput(method, param, path string) (map[string]interface{}, error) {
+	out, err := m.call(method, map[string]interface{}{
+		"Path": path,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Release()
+	obj, err := out.Result().Embedded(param)
+	if err != nil {
+		return nil, errors.Wrap(err, param)
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("%s returned no %s", method, param)
+	}
+	defer obj.Release()
+	return obj.ToMap()
+}
+
+// GetDiskSettings returns the settings of the virtual hard disk at path
+func (m *Manager) GetDiskSettings(path string) (DiskSettings, error) {
+	values, err := m.embeddedOutput("GetVirtualHardDiskSettingData", "SettingData", path)
+	if err != nil {
+		return DiskSettings{}, err
+	}
+	return DiskSettings{
+		Path:               stringValue(values["Path"]),
+		ParentPath:         stringValue(values["ParentPath"]),
+		Type:               DiskType(uintValue(values["Type"])),
+		Format:             DiskFormat(uintValue(values["Format"])),
+		MaxInternalSize:    uintValue(values["MaxInternalSize"]),
+		BlockSize:          uint32(uintValue(values["BlockSize"])),
+		LogicalSectorSize:  uint32(uintValue(values["LogicalSectorSize"])),
+		PhysicalSectorSize: uint32(uintValue(values["PhysicalSectorSize"])),
+		VirtualDiskID:      stringValue(values["VirtualDiskId"]),
+	}, nil
+}
+
+// GetDiskState returns the state of the virtual hard disk at path
+func (m *Manager) GetDiskState(path string) (DiskState, error) {
+	values, err := m.embeddedOutput("GetVirtualHardDiskState", "State", path)
+	if err != nil {
+		return DiskState{}, err
+	}
+	inUse, _ := values["InUse"].(bool)
+	return DiskState{
+		FileSize:                uintValue(values["FileSize"]),
+		InUse:                   inUse,
+		MinInternalSize:         uintValue(values["MinInternalSize"]),
+		PhysicalSectorSize:      uint32(uintValue(values["PhysicalSectorSize"])),
+		Alignment:               uint32(uintValue(values["Alignment"])),
+		FragmentationPercentage: uint32(uintValue(values["FragmentationPercentage"])),
+	}, nil
+}
+
+// stringValue and uintValue read values returned by ToMap. Null
+// properties read as zero values.
+func stringValue(val interface{}) string {
+	ret, _ := val.(string)
+	return ret
+}
+
+func uintValue(val interface{}) uint64 {
+	switch v := val.(type) {
+	case uint64:
+		return v
+	case int64:
+		return uint64(v)
+	}
+	return 0
+}
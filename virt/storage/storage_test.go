@@ -0,0 +1,477 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"unicode/utf16"
+)
+
+const mb = 1024 * 1024
+
+// Layout of the files built by writeTestVHDX
+const (
+	testLogOffset      = 1 * mb
+	testMetadataOffset = 2 * mb
+	testBATOffset      = 3 * mb
+	testDataOffset     = 4 * mb
+)
+
+// testChunkRatio is the number of 1MB blocks covered by a sector bitmap
+// with 512 byte sectors
+const testChunkRatio = vhdxSectorsPerBitmap * 512 / mb
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// testVHDX describes a dynamic or differencing VHDX file with 1MB blocks
+// and 512 byte sectors.
+type testVHDX struct {
+	size          int64
+	dataWriteGUID guid
+	// blocks holds the data of the blocks present in the file
+	blocks map[int64][]byte
+	// locator is the parent locator of a differencing disk
+	locator [][2]string
+	// partial holds the blocks of a differencing disk that are only
+	// present for the sectors in the first chunk that sectors selects
+	partial map[int64]bool
+	sectors func(int64) bool
+}
+
+// encodeChecked encodes data into a buffer of size bytes, with its
+// CRC-32C checksum at byte 4
+func encodeChecked(t *testing.T, data interface{}, size int) []byte {
+	w := new(bytes.Buffer)
+	if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, size)
+	copy(buf, w.Bytes())
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(buf, castagnoli))
+	return buf
+}
+
+func encode(t *testing.T, data interface{}) []byte {
+	w := new(bytes.Buffer)
+	if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+		t.Fatal(err)
+	}
+	return w.Bytes()
+}
+
+// encodeLocator encodes a parent locator holding entries
+func encodeLocator(t *testing.T, entries [][2]string) []byte {
+	table := encode(t, vhdxParentLocatorHeader{LocatorType: vhdxParentLocatorType, KeyValueCount: uint16(len(entries))})
+	strs := new(bytes.Buffer)
+	base := len(table) + 12*len(entries)
+	str := func(s string) (uint32, uint16) {
+		off := uint32(base + strs.Len())
+		units := utf16.Encode([]rune(s))
+		strs.Write(encode(t, units))
+		return off, uint16(2 * len(units))
+	}
+	for _, kv := range entries {
+		var entry vhdxParentLocatorEntry
+		entry.KeyOffset, entry.KeyLength = str(kv[0])
+		entry.ValueOffset, entry.ValueLength = str(kv[1])
+		table = append(table, encode(t, entry)...)
+	}
+	return append(table, strs.Bytes()...)
+}
+
+// writeTestVHDX writes the file d describes to path
+func writeTestVHDX(t *testing.T, path string, d testVHDX) {
+	hasParent := d.locator != nil
+	payloadBlocks := (d.size + mb - 1) / mb
+	batEntries := payloadBlocks + (payloadBlocks-1)/testChunkRatio
+	var flags uint32
+	if hasParent {
+		batEntries = (payloadBlocks + testChunkRatio - 1) / testChunkRatio * (testChunkRatio + 1)
+		flags |= vhdxHasParent
+	}
+	file := make([]byte, testDataOffset+int64(len(d.blocks)+1)*mb)
+	copy(file, vhdxSignature)
+
+	hdr := vhdxHeader{
+		SequenceNumber: 1,
+		DataWriteGUID:  d.dataWriteGUID,
+		Version:        1,
+		LogLength:      mb,
+		LogOffset:      testLogOffset,
+	}
+	copy(hdr.Signature[:], vhdxHeaderSignature)
+	for _, off := range vhdxHeaderOffsets {
+		copy(file[off:], encodeChecked(t, hdr, vhdxHeaderSize))
+	}
+
+	regions := struct {
+		Header  vhdxRegionTableHeader
+		Entries [2]vhdxRegionEntry
+	}{
+		Header: vhdxRegionTableHeader{EntryCount: 2},
+		Entries: [2]vhdxRegionEntry{
+			{GUID: vhdxBATRegion, FileOffset: testBATOffset, Length: mb, Required: 1},
+			{GUID: vhdxMetadataRegion, FileOffset: testMetadataOffset, Length: mb, Required: 1},
+		},
+	}
+	copy(regions.Header.Signature[:], vhdxRegionSignature)
+	for _, off := range vhdxRegionTableOffsets {
+		copy(file[off:], encodeChecked(t, regions, vhdxRegionTableSize))
+	}
+
+	items := []struct {
+		id   guid
+		data []byte
+	}{
+		{vhdxFileParameters, encode(t, [2]uint32{mb, flags})},
+		{vhdxVirtualDiskSize, encode(t, uint64(d.size))},
+		{vhdxLogicalSectorSize, encode(t, uint32(512))},
+		{vhdxPhysicalSectorSize, encode(t, uint32(4096))},
+	}
+	if hasParent {
+		items = append(items, struct {
+			id   guid
+			data []byte
+		}{vhdxParentLocator, encodeLocator(t, d.locator)})
+	}
+	metaHdr := vhdxMetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(metaHdr.Signature[:], vhdxMetadataSignature)
+	table := encode(t, metaHdr)
+	offset := uint32(vhdxMetadataTableSize)
+	for _, item := range items {
+		table = append(table, encode(t, vhdxMetadataEntry{
+			ItemID: item.id,
+			Offset: offset,
+			Length: uint32(len(item.data)),
+			Flags:  vhdxMetadataIsRequired,
+		})...)
+		copy(file[testMetadataOffset+int64(offset):], item.data)
+		offset += uint32(len(item.data))
+	}
+	copy(file[testMetadataOffset:], table)
+
+	// Blocks are stored in order after the BAT, followed by the sector
+	// bitmap of the first chunk
+	bat := make([]uint64, batEntries)
+	ids := []int64{}
+	for block := range d.blocks {
+		ids = append(ids, block)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	next := int64(testDataOffset)
+	for _, block := range ids {
+		copy(file[next:next+mb], d.blocks[block])
+		state := uint64(vhdxBlockFullyPresent)
+		if d.partial[block] {
+			state = vhdxBlockPartiallyPresent
+		}
+		bat[block+block/testChunkRatio] = uint64(next/vhdxFileOffsetUnit)<<20 | state
+		next += mb
+	}
+	if hasParent {
+		bitmap := file[next : next+mb]
+		for sector := int64(0); d.sectors != nil && sector < vhdxSectorsPerBitmap; sector++ {
+			if d.sectors(sector) {
+				bitmap[sector/8] |= 1 << uint(sector%8)
+			}
+		}
+		bat[testChunkRatio] = uint64(next/vhdxFileOffsetUnit)<<20 | vhdxBitmapPresent
+	}
+	for i, entry := range bat {
+		binary.LittleEndian.PutUint64(file[testBATOffset+8*i:], entry)
+	}
+
+	if err := ioutil.WriteFile(path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVHDXDifferencingRead(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	size := int64(4 * mb)
+
+	// The parent holds blocks 0 to 2, and block 3 reads as zeros
+	parentRaw := make([]byte, size)
+	for i := 0; i < 3*mb; i++ {
+		parentRaw[i] = byte(i*7 + i>>9 + 1)
+	}
+	parentGUID := guid{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	parentPath := filepath.Join(dir, "parent.vhdx")
+	writeTestVHDX(t, parentPath, testVHDX{
+		size:          size,
+		dataWriteGUID: parentGUID,
+		blocks: map[int64][]byte{
+			0: parentRaw[:mb],
+			1: parentRaw[mb : 2*mb],
+			2: parentRaw[2*mb : 3*mb],
+		},
+	})
+
+	// Block 0 is fully present in the child, block 2 holds some of its
+	// sectors, and blocks 1 and 3 come from the parent
+	childRaw := make([]byte, size)
+	for i := 0; i < mb; i++ {
+		childRaw[i] = byte(i%251 + 1)
+		childRaw[2*mb+i] = byte(i%241 + 1)
+	}
+	inChild := func(sector int64) bool {
+		// Sectors of the chunk, in which block 2 starts at sector 4096
+		return sector >= 4096 && sector < 4104 || sector >= 4196 && sector < 4297
+	}
+	want := append([]byte{}, parentRaw...)
+	copy(want[:mb], childRaw[:mb])
+	for sector := int64(4096); sector < 6144; sector++ {
+		if inChild(sector) {
+			off := 2*mb + (sector-4096)*512
+			copy(want[off:off+512], childRaw[off:off+512])
+		}
+	}
+
+	child := testVHDX{
+		size:          size,
+		dataWriteGUID: guid{16, 15, 14, 13},
+		blocks: map[int64][]byte{
+			0: childRaw[:mb],
+			2: childRaw[2*mb : 3*mb],
+		},
+		locator: [][2]string{
+			{"parent_linkage", "{" + parentGUID.String() + "}"},
+			{"relative_path", `.\parent.vhdx`},
+		},
+		partial: map[int64]bool{2: true},
+		sectors: inChild,
+	}
+	childPath := filepath.Join(dir, "child.vhdx")
+	writeTestVHDX(t, childPath, child)
+
+	v, err := OpenVHDX(childPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	settings := v.Settings()
+	if settings.Type != DifferencingDisk || settings.ParentPath != parentPath {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+	got := make([]byte, size)
+	if _, err := v.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("read data differs from the merged image")
+	}
+	// Unaligned read across runs of sectors from the child and the parent
+	part := make([]byte, 5000)
+	off := int64(2*mb + 3000)
+	if _, err := v.ReadAt(part, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(part, want[off:off+int64(len(part))]) {
+		t.Fatal("unaligned read differs from the merged image")
+	}
+
+	// A parent modified after the child was created is rejected
+	child.locator[0][1] = "{00000000-0000-0000-0000-000000000001}"
+	stalePath := filepath.Join(dir, "stale.vhdx")
+	writeTestVHDX(t, stalePath, child)
+	if stale, err := OpenVHDX(stalePath); err == nil {
+		stale.Close()
+		t.Fatal("opened a child whose parent linkage does not match")
+	}
+}
+
+// testImage returns a raw image of size bytes with data in its first
+// and last megabytes, and zeros in between.
+func testImage(size int) []byte {
+	raw := make([]byte, size)
+	for i := 0; i < mb; i++ {
+		raw[i] = byte(i*7 + i>>9)
+	}
+	for i := size - mb; i < size; i++ {
+		raw[i] = byte(i*13 + 1)
+	}
+	return raw
+}
+
+// writeImage writes raw to path with write
+func writeImage(t *testing.T, path string, raw []byte, opts ImageOptions, write func(*os.File, []byte, ImageOptions) error) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := write(f, raw, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeVHDXFile(f *os.File, raw []byte, opts ImageOptions) error {
+	return WriteVHDX(f, bytes.NewReader(raw), int64(len(raw)), opts)
+}
+
+func writeVHDFile(f *os.File, raw []byte, opts ImageOptions) error {
+	return WriteVHD(f, bytes.NewReader(raw), int64(len(raw)), opts)
+}
+
+func TestVHDXRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	raw := testImage(5*mb + 1536)
+	for _, diskType := range []DiskType{DynamicDisk, FixedDisk} {
+		for _, blockSize := range []uint32{1 * mb, 2 * mb} {
+			name := fmt.Sprintf("type%d-%dmb", diskType, blockSize/mb)
+			t.Run(name, func(t *testing.T) {
+				path := filepath.Join(dir, name+".vhdx")
+				writeImage(t, path, raw, ImageOptions{Type: diskType, BlockSize: blockSize}, writeVHDXFile)
+
+				v, err := OpenVHDX(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer v.Close()
+				if v.Size() != int64(len(raw)) {
+					t.Fatalf("got size %d, want %d", v.Size(), len(raw))
+				}
+				settings := v.Settings()
+				if settings.Type != diskType || settings.BlockSize != blockSize || settings.Format != FormatVHDX {
+					t.Fatalf("unexpected settings %+v", settings)
+				}
+				if settings.LogicalSectorSize != 512 || settings.PhysicalSectorSize != 4096 {
+					t.Fatalf("unexpected sector sizes %+v", settings)
+				}
+
+				got := make([]byte, len(raw))
+				if _, err := v.ReadAt(got, 0); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, raw) {
+					t.Fatal("read data differs from the written image")
+				}
+				// Unaligned read across a block boundary
+				part := make([]byte, 3000)
+				off := int64(blockSize) - 1000
+				if _, err := v.ReadAt(part, off); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(part, raw[off:off+int64(len(part))]) {
+					t.Fatal("unaligned read differs from the written image")
+				}
+			})
+		}
+	}
+}
+
+// checkVHDChecksum validates the checksum stored at checksumOffset of buf
+func checkVHDChecksum(t *testing.T, what string, buf []byte, checksumOffset int) {
+	t.Helper()
+	stored := binary.BigEndian.Uint32(buf[checksumOffset:])
+	copied := append([]byte{}, buf...)
+	binary.BigEndian.PutUint32(copied[checksumOffset:], 0)
+	if sum := vhdChecksum(copied); sum != stored {
+		t.Fatalf("%s checksum is %08x, want %08x", what, stored, sum)
+	}
+}
+
+func checkVHDFooter(t *testing.T, buf []byte, size int64, diskType uint32) {
+	t.Helper()
+	if string(buf[:8]) != vhdFooterCookie {
+		t.Fatalf("bad footer cookie %q", buf[:8])
+	}
+	checkVHDChecksum(t, "footer", buf, 64)
+	var footer vhdFooter
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &footer); err != nil {
+		t.Fatal(err)
+	}
+	if footer.CurrentSize != uint64(size) || footer.OriginalSize != uint64(size) {
+		t.Fatalf("footer holds size %d, want %d", footer.CurrentSize, size)
+	}
+	if footer.DiskType != diskType {
+		t.Fatalf("footer holds disk type %d, want %d", footer.DiskType, diskType)
+	}
+}
+
+func TestVHDChecksums(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	raw := testImage(5*mb + 1536)
+	size := int64(len(raw))
+
+	t.Run("fixed", func(t *testing.T) {
+		path := filepath.Join(dir, "fixed.vhd")
+		writeImage(t, path, raw, ImageOptions{Type: FixedDisk}, writeVHDFile)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != size+vhdFooterSize {
+			t.Fatalf("got file size %d, want %d", len(data), size+vhdFooterSize)
+		}
+		if !bytes.Equal(data[:size], raw) {
+			t.Fatal("fixed image data differs from the written image")
+		}
+		checkVHDFooter(t, data[size:], size, vhdFixedDisk)
+	})
+
+	t.Run("dynamic", func(t *testing.T) {
+		path := filepath.Join(dir, "dynamic.vhd")
+		writeImage(t, path, raw, ImageOptions{}, writeVHDFile)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkVHDFooter(t, data[:vhdFooterSize], size, vhdDynamicDisk)
+		if !bytes.Equal(data[:vhdFooterSize], data[len(data)-vhdFooterSize:]) {
+			t.Fatal("footer copies differ")
+		}
+
+		headerBuf := data[vhdFooterSize : vhdFooterSize+vhdHeaderSize]
+		if string(headerBuf[:8]) != vhdHeaderCookie {
+			t.Fatalf("bad dynamic header cookie %q", headerBuf[:8])
+		}
+		checkVHDChecksum(t, "dynamic header", headerBuf, 36)
+		var header vhdDynamicHeader
+		if err := binary.Read(bytes.NewReader(headerBuf), binary.BigEndian, &header); err != nil {
+			t.Fatal(err)
+		}
+		blockSize := int64(header.BlockSize)
+		if blockSize != DefaultVHDBlockSize {
+			t.Fatalf("got block size %d, want %d", blockSize, DefaultVHDBlockSize)
+		}
+
+		// Read the image back through the BAT
+		bitmapLength := roundUp(blockSize/vhdSectorSize/8, vhdSectorSize)
+		got := make([]byte, size)
+		for block := int64(0); block < int64(header.MaxTableEntries); block++ {
+			entry := binary.BigEndian.Uint32(data[int64(header.TableOffset)+block*4:])
+			if entry == vhdUnusedBlock {
+				continue
+			}
+			if block == 1 {
+				t.Fatal("block holding only zeros was allocated")
+			}
+			start := int64(entry)*vhdSectorSize + bitmapLength
+			end := block*blockSize + blockSize
+			if end > size {
+				end = size
+			}
+			copy(got[block*blockSize:end], data[start:])
+		}
+		if !bytes.Equal(got, raw) {
+			t.Fatal("dynamic image data differs from the written image")
+		}
+	})
+}
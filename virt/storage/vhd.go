@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// VHD layout, as described in the Virtual Hard Disk Image Format
+// Specification
+const (
+	vhdFooterCookie  = "conectix"
+	vhdHeaderCookie  = "cxsparse"
+	vhdSectorSize    = 512
+	vhdFooterSize    = 512
+	vhdHeaderSize    = 1024
+	vhdTableOffset   = vhdFooterSize + vhdHeaderSize
+	vhdVersion       = 0x00010000
+	vhdFeatures      = 2
+	vhdFixedDisk     = 2
+	vhdDynamicDisk   = 3
+	vhdNoDataOffset  = 0xFFFFFFFFFFFFFFFF
+	vhdUnusedBlock   = 0xFFFFFFFF
+	vhdCreatorApp    = "gwmi"
+	vhdCreatorHostOS = "Wi2k"
+	maxVHDSize       = 2040 * 1024 * 1024 * 1024
+)
+
+// vhdEpoch is the origin of the time stamps of VHD files
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           guid
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+type vhdDynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    guid
+	ParentTimeStamp   uint32
+	Reserved          uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [8][24]byte
+	Reserved2         [256]byte
+}
+
+// vhdGeometry returns the CHS geometry of a disk of size bytes, computed
+// as described in appendix A of the specification.
+func vhdGeometry(size int64) (cylinders uint16, heads, sectorsPerTrack uint8) {
+	totalSectors := size / vhdSectorSize
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+	var spt, h, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		spt = 255
+		h = 16
+		cylinderTimesHeads = totalSectors / spt
+	} else {
+		spt = 17
+		cylinderTimesHeads = totalSectors / spt
+		h = (cylinderTimesHeads + 1023) / 1024
+		if h < 4 {
+			h = 4
+		}
+		if cylinderTimesHeads >= h*1024 || h > 16 {
+			spt = 31
+			h = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+		if cylinderTimesHeads >= h*1024 {
+			spt = 63
+			h = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+	}
+	return uint16(cylinderTimesHeads / h), uint8(h), uint8(spt)
+}
+
+// vhdChecksum returns the one's complement of the sum of the bytes of buf
+func vhdChecksum(buf []byte) uint32 {
+	var sum uint32
+	for _, b := range buf {
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+// encodeVHD encodes data, a footer or a dynamic header, and stores its
+// checksum at checksumOffset.
+func encodeVHD(data interface{}, checksumOffset int) ([]byte, error) {
+	w := new(bytes.Buffer)
+	if err := binary.Write(w, binary.BigEndian, data); err != nil {
+		return nil, err
+	}
+	buf := w.Bytes()
+	binary.BigEndian.PutUint32(buf[checksumOffset:], 0)
+	binary.BigEndian.PutUint32(buf[checksumOffset:], vhdChecksum(buf))
+	return buf, nil
+}
+
+func newVHDFooter(size int64, diskType uint32, dataOffset uint64) (vhdFooter, error) {
+	id, err := newGUID()
+	if err != nil {
+		return vhdFooter{}, err
+	}
+	footer := vhdFooter{
+		Features:          vhdFeatures,
+		FileFormatVersion: vhdVersion,
+		DataOffset:        dataOffset,
+		TimeStamp:         uint32(time.Now().Sub(vhdEpoch) / time.Second),
+		CreatorVersion:    vhdVersion,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          diskType,
+		UniqueID:          id,
+	}
+	footer.Cylinders, footer.Heads, footer.SectorsPerTrack = vhdGeometry(size)
+	copy(footer.Cookie[:], vhdFooterCookie)
+	copy(footer.CreatorApplication[:], vhdCreatorApp)
+	copy(footer.CreatorHostOS[:], vhdCreatorHostOS)
+	return footer, nil
+}
+
+// WriteVHD writes the raw disk image of size bytes read from src to dst,
+// as a legacy VHD file. Blocks of dynamic disks that only hold zeros are
+// not allocated. size must be a multiple of 512 bytes.
+func WriteVHD(dst io.WriterAt, src io.Reader, size int64, opts ImageOptions) error {
+	diskType, err := opts.diskType()
+	if err != nil {
+		return err
+	}
+	blockSize := int64(opts.BlockSize)
+	if blockSize == 0 {
+		blockSize = DefaultVHDBlockSize
+	}
+	if blockSize < vhdSectorSize || blockSize&(blockSize-1) != 0 {
+		return fmt.Errorf("invalid block size %d", blockSize)
+	}
+	if size <= 0 || size > maxVHDSize || size%vhdSectorSize != 0 {
+		return fmt.Errorf("invalid image size %d", size)
+	}
+	if diskType == FixedDisk {
+		return writeFixedVHD(dst, src, size, blockSize)
+	}
+
+	entries := (size + blockSize - 1) / blockSize
+	batLength := roundUp(entries*4, vhdSectorSize)
+	bitmapLength := roundUp(blockSize/vhdSectorSize/8, vhdSectorSize)
+	bitmap := bytes.Repeat([]byte{0xff}, int(bitmapLength))
+
+	// Data blocks, each preceded by a sector bitmap
+	bat := make([]byte, batLength)
+	for i := range bat {
+		bat[i] = 0xff
+	}
+	blocks := &blockReader{src: src, remaining: size, buf: make([]byte, blockSize)}
+	next := int64(vhdTableOffset) + batLength
+	for block := int64(0); ; block++ {
+		buf, err := blocks.next()
+		if err != nil {
+			return err
+		}
+		if buf == nil {
+			break
+		}
+		if isZero(buf) {
+			continue
+		}
+		if _, err := dst.WriteAt(bitmap, next); err != nil {
+			return errors.Wrap(err, "writing sector bitmap")
+		}
+		if _, err := dst.WriteAt(buf, next+bitmapLength); err != nil {
+			return errors.Wrap(err, "writing block")
+		}
+		binary.BigEndian.PutUint32(bat[block*4:], uint32(next/vhdSectorSize))
+		next += bitmapLength + blockSize
+	}
+	if _, err := dst.WriteAt(bat, vhdTableOffset); err != nil {
+		return errors.Wrap(err, "writing BAT")
+	}
+
+	header := vhdDynamicHeader{
+		DataOffset:      vhdNoDataOffset,
+		TableOffset:     vhdTableOffset,
+		HeaderVersion:   vhdVersion,
+		MaxTableEntries: uint32(entries),
+		BlockSize:       uint32(blockSize),
+	}
+	copy(header.Cookie[:], vhdHeaderCookie)
+	headerBuf, err := encodeVHD(header, 36)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.WriteAt(headerBuf, vhdFooterSize); err != nil {
+		return errors.Wrap(err, "writing dynamic header")
+	}
+
+	// Dynamic disks start with a copy of the footer
+	footer, err := newVHDFooter(size, vhdDynamicDisk, vhdFooterSize)
+	if err != nil {
+		return err
+	}
+	footerBuf, err := encodeVHD(footer, 64)
+	if err != nil {
+		return err
+	}
+	for _, off := range []int64{0, next} {
+		if _, err := dst.WriteAt(footerBuf, off); err != nil {
+			return errors.Wrap(err, "writing footer")
+		}
+	}
+	return nil
+}
+
+// writeFixedVHD writes the image as is, followed by the footer. Zero
+// blocks are left as holes.
+func writeFixedVHD(dst io.WriterAt, src io.Reader, size, blockSize int64) error {
+	blocks := &blockReader{src: src, remaining: size, buf: make([]byte, blockSize)}
+	for offset := int64(0); ; offset += blockSize {
+		buf, err := blocks.next()
+		if err != nil {
+			return err
+		}
+		if buf == nil {
+			break
+		}
+		if offset+blockSize > size {
+			buf = buf[:size-offset]
+		}
+		if isZero(buf) {
+			continue
+		}
+		if _, err := dst.WriteAt(buf, offset); err != nil {
+			return errors.Wrap(err, "writing block")
+		}
+	}
+	footer, err := newVHDFooter(size, vhdFixedDisk, vhdNoDataOffset)
+	if err != nil {
+		return err
+	}
+	footerBuf, err := encodeVHD(footer, 64)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.WriteAt(footerBuf, size); err != nil {
+		return errors.Wrap(err, "writing footer")
+	}
+	return nil
+}
@@ -0,0 +1,753 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// VHDX layout, as described in MS-VHDX. See:
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-vhdx
+const (
+	vhdxSignature         = "vhdxfile"
+	vhdxHeaderSignature   = "head"
+	vhdxRegionSignature   = "regi"
+	vhdxMetadataSignature = "metadata"
+	vhdxHeaderSize        = 4 * 1024
+	vhdxRegionTableSize   = 64 * 1024
+	vhdxMetadataTableSize = 64 * 1024
+	vhdxMaxEntries        = 2047
+	vhdxSectorBitmapSize  = 1024 * 1024
+	vhdxSectorsPerBitmap  = vhdxSectorBitmapSize * 8
+	vhdxFileOffsetUnit    = 1024 * 1024
+)
+
+// Offsets of the two copies of the header and the region table
+var (
+	vhdxHeaderOffsets      = []int64{64 * 1024, 128 * 1024}
+	vhdxRegionTableOffsets = []int64{192 * 1024, 256 * 1024}
+)
+
+// Region and metadata item GUIDs
+var (
+	vhdxBATRegion          = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion     = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParameters     = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize    = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxPage83Data         = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogicalSectorSize  = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysicalSectorSize = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	vhdxParentLocator      = mustParseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+	vhdxParentLocatorType  = mustParseGUID("B04AEFB7-D19E-4A81-B789-25B8E9445913")
+)
+
+// BAT entry states
+const (
+	vhdxBlockNotPresent       = 0
+	vhdxBlockUndefined        = 1
+	vhdxBlockZero             = 2
+	vhdxBlockUnmapped         = 3
+	vhdxBlockFullyPresent     = 6
+	vhdxBlockPartiallyPresent = 7
+	vhdxBitmapPresent         = 6
+)
+
+// File parameter flags
+const (
+	vhdxLeaveBlocksAllocated = 1
+	vhdxHasParent            = 2
+)
+
+// Metadata entry flags
+const (
+	vhdxMetadataIsRequired = 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// guid is a GUID, in the mixed endian layout used on disk
+type guid [16]byte
+
+func parseGUID(s string) (guid, error) {
+	var ret guid
+	raw, err := hex.DecodeString(strings.Replace(strings.Trim(s, "{}"), "-", "", -1))
+	if err != nil || len(raw) != 16 {
+		return ret, fmt.Errorf("invalid GUID %q", s)
+	}
+	// The first three fields are little endian
+	for i, j := range []int{3, 2, 1, 0, 5, 4, 7, 6} {
+		ret[i] = raw[j]
+	}
+	copy(ret[8:], raw[8:])
+	return ret, nil
+}
+
+func mustParseGUID(s string) guid {
+	ret, err := parseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func (g guid) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+func (g guid) isZero() bool {
+	return g == guid{}
+}
+
+// vhdxHeader is the header structure of a VHDX file
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  guid
+	DataWriteGUID  guid
+	LogGUID        guid
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxRegionTableHeader struct {
+	Signature  [4]byte
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+type vhdxRegionEntry struct {
+	GUID       guid
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [20]byte
+}
+
+type vhdxMetadataEntry struct {
+	ItemID    guid
+	Offset    uint32
+	Length    uint32
+	Flags     uint32
+	Reserved2 uint32
+}
+
+type vhdxParentLocatorHeader struct {
+	LocatorType   guid
+	Reserved      uint16
+	KeyValueCount uint16
+}
+
+type vhdxParentLocatorEntry struct {
+	KeyOffset   uint32
+	ValueOffset uint32
+	KeyLength   uint16
+	ValueLength uint16
+}
+
+// VHDX is a VHDX file opened for reading. It implements io.ReaderAt over
+// the virtual disk. Reads from differencing disks go through their
+// parents as needed. It is safe for concurrent use.
+type VHDX struct {
+	path   string
+	file   io.ReaderAt
+	closer io.Closer
+
+	header             vhdxHeader
+	size               int64
+	blockSize          int64
+	logicalSectorSize  int64
+	physicalSectorSize int64
+	flags              uint32
+	diskID             guid
+	parentLocator      map[string]string
+	chunkRatio         int64
+	bat                []uint64
+
+	parent *VHDX
+
+	lock    sync.Mutex
+	bitmaps map[int64][]byte
+}
+
+// OpenVHDX opens the VHDX file at path. For differencing disks, the
+// parent is located through the relative and absolute paths stored in
+// the file, and opened as well. Files with a log that needs replaying
+// are rejected.
+func OpenVHDX(path string) (*VHDX, error) {
+	return openVHDX(path, map[string]bool{})
+}
+
+func openVHDX(path string, seen map[string]bool) (*VHDX, error) {
+	abs, err := filepath.Abs(path)
+	if err == nil {
+		if seen[abs] {
+			return nil, fmt.Errorf("differencing chain loops back to %s", path)
+		}
+		seen[abs] = true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := readVHDX(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, path)
+	}
+	v.path = path
+	v.closer = f
+	if v.flags&vhdxHasParent == 0 {
+		return v, nil
+	}
+	if err := v.openParent(seen); err != nil {
+		v.Close()
+		return nil, errors.Wrap(err, path)
+	}
+	return v, nil
+}
+
+// readVHDX reads the structures of the VHDX file in r
+func readVHDX(r io.ReaderAt) (*VHDX, error) {
+	ident := make([]byte, len(vhdxSignature))
+	if _, err := r.ReadAt(ident, 0); err != nil {
+		return nil, errors.Wrap(err, "reading file identifier")
+	}
+	if string(ident) != vhdxSignature {
+		return nil, fmt.Errorf("not a VHDX file")
+	}
+
+	v := &VHDX{
+		file:    r,
+		bitmaps: map[int64][]byte{},
+	}
+	if err := v.readHeader(); err != nil {
+		return nil, err
+	}
+	if !v.header.LogGUID.isZero() {
+		return nil, fmt.Errorf("the log must be replayed before the file can be read")
+	}
+	regions, err := v.readRegionTable()
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := regions[vhdxMetadataRegion]
+	if !ok {
+		return nil, fmt.Errorf("missing metadata region")
+	}
+	if err := v.readMetadata(metadata); err != nil {
+		return nil, errors.Wrap(err, "reading metadata")
+	}
+	bat, ok := regions[vhdxBATRegion]
+	if !ok {
+		return nil, fmt.Errorf("missing BAT region")
+	}
+	if err := v.readBAT(bat); err != nil {
+		return nil, errors.Wrap(err, "reading BAT")
+	}
+	return v, nil
+}
+
+// readChecked reads size bytes at off, and validates the CRC-32C
+// checksum stored at byte 4, computed with the checksum field zeroed.
+func readChecked(r io.ReaderAt, off int64, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	stored := binary.LittleEndian.Uint32(buf[4:8])
+	binary.LittleEndian.PutUint32(buf[4:8], 0)
+	if crc32.Checksum(buf, castagnoli) != stored {
+		return nil, fmt.Errorf("checksum mismatch at offset %d", off)
+	}
+	binary.LittleEndian.PutUint32(buf[4:8], stored)
+	return buf, nil
+}
+
+// readHeader reads both headers, and keeps the valid one with the
+// highest sequence number.
+func (v *VHDX) readHeader() error {
+	found := false
+	var lastErr error
+	for _, off := range vhdxHeaderOffsets {
+		buf, err := readChecked(v.file, off, vhdxHeaderSize)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var hdr vhdxHeader
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &hdr); err != nil {
+			lastErr = err
+			continue
+		}
+		if string(hdr.Signature[:]) != vhdxHeaderSignature {
+			lastErr = fmt.Errorf("invalid header signature at offset %d", off)
+			continue
+		}
+		if hdr.Version != 1 {
+			lastErr = fmt.Errorf("unsupported version %d", hdr.Version)
+			continue
+		}
+		if !found || hdr.SequenceNumber > v.header.SequenceNumber {
+			v.header = hdr
+			found = true
+		}
+	}
+	if !found {
+		return errors.Wrap(lastErr, "no valid header")
+	}
+	return nil
+}
+
+// readRegionTable returns the regions of the file, keyed by GUID. The
+// second copy of the table is used if the first one is corrupt.
+func (v *VHDX) readRegionTable() (map[guid]vhdxRegionEntry, error) {
+	var lastErr error
+	for _, off := range vhdxRegionTableOffsets {
+		regions, err := v.readRegionTableAt(off)
+		if err == nil {
+			return regions, nil
+		}
+		lastErr = err
+	}
+	return nil, errors.Wrap(lastErr, "no valid region table")
+}
+
+func (v *VHDX) readRegionTableAt(off int64) (map[guid]vhdxRegionEntry, error) {
+	buf, err := readChecked(v.file, off, vhdxRegionTableSize)
+	if err != nil {
+		return nil, err
+	}
+	rd := bytes.NewReader(buf)
+	var hdr vhdxRegionTableHeader
+	if err := binary.Read(rd, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr.Signature[:]) != vhdxRegionSignature {
+		return nil, fmt.Errorf("invalid region table signature at offset %d", off)
+	}
+	if hdr.EntryCount > vhdxMaxEntries {
+		return nil, fmt.Errorf("too many regions (%d)", hdr.EntryCount)
+	}
+	ret := map[guid]vhdxRegionEntry{}
+	for i := uint32(0); i < hdr.EntryCount; i++ {
+		var entry vhdxRegionEntry
+		if err := binary.Read(rd, binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		}
+		if entry.GUID != vhdxBATRegion && entry.GUID != vhdxMetadataRegion && entry.Required&1 != 0 {
+			return nil, fmt.Errorf("unknown required region %s", entry.GUID)
+		}
+		ret[entry.GUID] = entry
+	}
+	return ret, nil
+}
+
+// readMetadata reads the metadata items of the file
+func (v *VHDX) readMetadata(region vhdxRegionEntry) error {
+	if region.Length < vhdxMetadataTableSize {
+		return fmt.Errorf("metadata region is too small (%d)", region.Length)
+	}
+	buf := make([]byte, region.Length)
+	if _, err := v.file.ReadAt(buf, int64(region.FileOffset)); err != nil {
+		return err
+	}
+	rd := bytes.NewReader(buf[:vhdxMetadataTableSize])
+	var hdr vhdxMetadataTableHeader
+	if err := binary.Read(rd, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	if string(hdr.Signature[:]) != vhdxMetadataSignature {
+		return fmt.Errorf("invalid metadata table signature")
+	}
+	if hdr.EntryCount > vhdxMaxEntries {
+		return fmt.Errorf("too many metadata entries (%d)", hdr.EntryCount)
+	}
+
+	items := map[guid][]byte{}
+	for i := uint16(0); i < hdr.EntryCount; i++ {
+		var entry vhdxMetadataEntry
+		if err := binary.Read(rd, binary.LittleEndian, &entry); err != nil {
+			return err
+		}
+		end := uint64(entry.Offset) + uint64(entry.Length)
+		if end > uint64(len(buf)) {
+			return fmt.Errorf("metadata item %s is out of bounds", entry.ItemID)
+		}
+		items[entry.ItemID] = buf[entry.Offset:end]
+		switch entry.ItemID {
+		case vhdxFileParameters, vhdxVirtualDiskSize, vhdxPage83Data,
+			vhdxLogicalSectorSize, vhdxPhysicalSectorSize, vhdxParentLocator:
+		default:
+			if entry.Flags&vhdxMetadataIsRequired != 0 {
+				return fmt.Errorf("unknown required metadata item %s", entry.ItemID)
+			}
+		}
+	}
+
+	required := []guid{vhdxFileParameters, vhdxVirtualDiskSize, vhdxLogicalSectorSize, vhdxPhysicalSectorSize}
+	for _, id := range required {
+		if len(items[id]) < 4 {
+			return fmt.Errorf("missing metadata item %s", id)
+		}
+	}
+	if len(items[vhdxFileParameters]) < 8 || len(items[vhdxVirtualDiskSize]) < 8 {
+		return fmt.Errorf("truncated metadata")
+	}
+	v.blockSize = int64(binary.LittleEndian.Uint32(items[vhdxFileParameters][0:4]))
+	v.flags = binary.LittleEndian.Uint32(items[vhdxFileParameters][4:8])
+	v.size = int64(binary.LittleEndian.Uint64(items[vhdxVirtualDiskSize]))
+	v.logicalSectorSize = int64(binary.LittleEndian.Uint32(items[vhdxLogicalSectorSize]))
+	v.physicalSectorSize = int64(binary.LittleEndian.Uint32(items[vhdxPhysicalSectorSize]))
+	if page83 := items[vhdxPage83Data]; len(page83) >= 16 {
+		copy(v.diskID[:], page83)
+	}
+
+	if v.blockSize < 1024*1024 || v.blockSize > 256*1024*1024 || v.blockSize&(v.blockSize-1) != 0 {
+		return fmt.Errorf("invalid block size %d", v.blockSize)
+	}
+	if v.logicalSectorSize != 512 && v.logicalSectorSize != 4096 {
+		return fmt.Errorf("invalid logical sector size %d", v.logicalSectorSize)
+	}
+	if v.size < 0 || v.size%v.logicalSectorSize != 0 {
+		return fmt.Errorf("invalid virtual disk size %d", v.size)
+	}
+	v.chunkRatio = vhdxSectorsPerBitmap * v.logicalSectorSize / v.blockSize
+
+	if v.flags&vhdxHasParent != 0 {
+		locator, ok := items[vhdxParentLocator]
+		if !ok {
+			return fmt.Errorf("differencing disk without a parent locator")
+		}
+		var err error
+		if v.parentLocator, err = parseParentLocator(locator); err != nil {
+			return errors.Wrap(err, "parent locator")
+		}
+	}
+	return nil
+}
+
+func parseParentLocator(buf []byte) (map[string]string, error) {
+	rd := bytes.NewReader(buf)
+	var hdr vhdxParentLocatorHeader
+	if err := binary.Read(rd, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.LocatorType != vhdxParentLocatorType {
+		return nil, fmt.Errorf("unknown locator type %s", hdr.LocatorType)
+	}
+	ret := map[string]string{}
+	for i := uint16(0); i < hdr.KeyValueCount; i++ {
+		var entry vhdxParentLocatorEntry
+		if err := binary.Read(rd, binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		}
+		key, err := utf16At(buf, entry.KeyOffset, entry.KeyLength)
+		if err != nil {
+			return nil, err
+		}
+		val, err := utf16At(buf, entry.ValueOffset, entry.ValueLength)
+		if err != nil {
+			return nil, err
+		}
+		ret[key] = val
+	}
+	return ret, nil
+}
+
+// utf16At decodes the UTF-16LE string of length bytes at off in buf
+func utf16At(buf []byte, off uint32, length uint16) (string, error) {
+	end := uint64(off) + uint64(length)
+	if end > uint64(len(buf)) || length%2 != 0 {
+		return "", fmt.Errorf("invalid string at offset %d", off)
+	}
+	units := make([]uint16, length/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(buf[int(off)+2*i:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// readBAT reads the block allocation table
+func (v *VHDX) readBAT(region vhdxRegionEntry) error {
+	payloadBlocks := (v.size + v.blockSize - 1) / v.blockSize
+	var entries int64
+	if v.flags&vhdxHasParent != 0 {
+		bitmapBlocks := (payloadBlocks + v.chunkRatio - 1) / v.chunkRatio
+		entries = bitmapBlocks * (v.chunkRatio + 1)
+	} else if payloadBlocks > 0 {
+		entries = payloadBlocks + (payloadBlocks-1)/v.chunkRatio
+	}
+	if entries*8 > int64(region.Length) {
+		return fmt.Errorf("BAT region is too small for %d entries", entries)
+	}
+	buf := make([]byte, entries*8)
+	if _, err := v.file.ReadAt(buf, int64(region.FileOffset)); err != nil {
+		return err
+	}
+	v.bat = make([]uint64, entries)
+	for i := range v.bat {
+		v.bat[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	return nil
+}
+
+// openParent opens the parent of this differencing disk, and checks that
+// it holds the data this disk was created from.
+func (v *VHDX) openParent(seen map[string]bool) error {
+	candidates := []string{}
+	if rel := v.parentLocator["relative_path"]; rel != "" {
+		candidates = append(candidates, filepath.Join(filepath.Dir(v.path), windowsPath(rel)))
+	}
+	for _, key := range []string{"absolute_win32_path", "volume_path"} {
+		if pth := v.parentLocator[key]; pth != "" {
+			candidates = append(candidates, pth)
+		}
+	}
+	for _, pth := range candidates {
+		if _, err := os.Stat(pth); err != nil {
+			continue
+		}
+		parent, err := openVHDX(pth, seen)
+		if err != nil {
+			return errors.Wrap(err, "opening parent")
+		}
+		linkage := parent.header.DataWriteGUID.String()
+		if !strings.EqualFold(strings.Trim(v.parentLocator["parent_linkage"], "{}"), linkage) &&
+			!strings.EqualFold(strings.Trim(v.parentLocator["parent_linkage2"], "{}"), linkage) {
+			parent.Close()
+			return fmt.Errorf("parent %s was modified after this disk was created", pth)
+		}
+		v.parent = parent
+		return nil
+	}
+	return fmt.Errorf("parent not found (tried %s)", strings.Join(candidates, ", "))
+}
+
+// windowsPath converts the separators of the Windows path pth
+func windowsPath(pth string) string {
+	return filepath.FromSlash(strings.Replace(pth, `\`, "/", -1))
+}
+
+// Close closes this file and its parents
+func (v *VHDX) Close() error {
+	var err error
+	if v.parent != nil {
+		err = v.parent.Close()
+	}
+	if v.closer != nil {
+		if closeErr := v.closer.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Size returns the size of the virtual disk, in bytes
+func (v *VHDX) Size() int64 {
+	return v.size
+}
+
+// Parent returns the parent of this differencing disk, or nil
+func (v *VHDX) Parent() *VHDX {
+	return v.parent
+}
+
+// ParentLocator returns the entries of the parent locator of this
+// differencing disk, such as relative_path and absolute_win32_path.
+func (v *VHDX) ParentLocator() map[string]string {
+	ret := make(map[string]string, len(v.parentLocator))
+	for key, val := range v.parentLocator {
+		ret[key] = val
+	}
+	return ret
+}
+
+// Settings returns the properties of this disk, as Hyper-V reports them
+// in Msvm_VirtualHardDiskSettingData.
+func (v *VHDX) Settings() DiskSettings {
+	ret := DiskSettings{
+		Path:               v.path,
+		Type:               DynamicDisk,
+		Format:             FormatVHDX,
+		MaxInternalSize:    uint64(v.size),
+		BlockSize:          uint32(v.blockSize),
+		LogicalSectorSize:  uint32(v.logicalSectorSize),
+		PhysicalSectorSize: uint32(v.physicalSectorSize),
+		VirtualDiskID:      v.diskID.String(),
+	}
+	switch {
+	case v.flags&vhdxHasParent != 0:
+		ret.Type = DifferencingDisk
+		if v.parent != nil {
+			ret.ParentPath = v.parent.path
+		} else {
+			ret.ParentPath = v.parentLocator["absolute_win32_path"]
+		}
+	case v.flags&vhdxLeaveBlocksAllocated != 0:
+		ret.Type = FixedDisk
+	}
+	return ret
+}
+
+// ReadAt implements io.ReaderAt over the virtual disk
+func (v *VHDX) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if int64(want) > v.size-off {
+		p = p[:v.size-off]
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		block, inBlock := pos/v.blockSize, pos%v.blockSize
+		count := int64(len(p) - n)
+		if count > v.blockSize-inBlock {
+			count = v.blockSize - inBlock
+		}
+		if err := v.readBlock(p[n:n+int(count)], block, inBlock); err != nil {
+			return n, err
+		}
+		n += int(count)
+	}
+	if n < want {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBlock fills p with the data at inBlock in the payload block block
+func (v *VHDX) readBlock(p []byte, block, inBlock int64) error {
+	idx := block + block/v.chunkRatio
+	if idx >= int64(len(v.bat)) {
+		return fmt.Errorf("block %d is beyond the BAT", block)
+	}
+	entry := v.bat[idx]
+	offset := int64(entry>>20) * vhdxFileOffsetUnit
+	switch entry & 7 {
+	case vhdxBlockFullyPresent:
+		_, err := v.file.ReadAt(p, offset+inBlock)
+		return err
+	case vhdxBlockPartiallyPresent:
+		if v.parent == nil {
+			return fmt.Errorf("partially present block %d in a disk without parent", block)
+		}
+		return v.readSectors(p, block, inBlock, offset)
+	case vhdxBlockNotPresent, vhdxBlockUndefined:
+		if v.parent != nil {
+			return v.readParent(p, block*v.blockSize+inBlock)
+		}
+		zeroFill(p)
+	case vhdxBlockZero, vhdxBlockUnmapped:
+		zeroFill(p)
+	default:
+		return fmt.Errorf("invalid state %d for block %d", entry&7, block)
+	}
+	return nil
+}
+
+// readSectors fills p from a partially present block, reading each run
+// of sectors from this file or from the parent, as the sector bitmap says.
+func (v *VHDX) readSectors(p []byte, block, inBlock, offset int64) error {
+	bitmap, err := v.sectorBitmap(block / v.chunkRatio)
+	if err != nil {
+		return err
+	}
+	// First sector of the block within the chunk covered by the bitmap
+	firstSector := (block % v.chunkRatio) * v.blockSize / v.logicalSectorSize
+	present := func(pos int64) bool {
+		sector := firstSector + pos/v.logicalSectorSize
+		return bitmap[sector/8]&(1<<uint(sector%8)) != 0
+	}
+
+	n := int64(0)
+	for n < int64(len(p)) {
+		pos := inBlock + n
+		inFile := present(pos)
+		end := (pos/v.logicalSectorSize + 1) * v.logicalSectorSize
+		for end < inBlock+int64(len(p)) && present(end) == inFile {
+			end += v.logicalSectorSize
+		}
+		if end > inBlock+int64(len(p)) {
+			end = inBlock + int64(len(p))
+		}
+		chunk := p[n : end-inBlock]
+		if inFile {
+			if _, err := v.file.ReadAt(chunk, offset+pos); err != nil {
+				return err
+			}
+		} else if err := v.readParent(chunk, block*v.blockSize+pos); err != nil {
+			return err
+		}
+		n = end - inBlock
+	}
+	return nil
+}
+
+// readParent reads p from the parent at off. The parent may be smaller
+// than this disk, which reads as zeros.
+func (v *VHDX) readParent(p []byte, off int64) error {
+	n, err := v.parent.ReadAt(p, off)
+	if err == io.EOF {
+		zeroFill(p[n:])
+		return nil
+	}
+	return err
+}
+
+// sectorBitmap returns the sector bitmap of chunk
+func (v *VHDX) sectorBitmap(chunk int64) ([]byte, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if bitmap, ok := v.bitmaps[chunk]; ok {
+		return bitmap, nil
+	}
+	idx := chunk*(v.chunkRatio+1) + v.chunkRatio
+	if idx >= int64(len(v.bat)) {
+		return nil, fmt.Errorf("sector bitmap %d is beyond the BAT", chunk)
+	}
+	entry := v.bat[idx]
+	if entry&7 != vhdxBitmapPresent {
+		return nil, fmt.Errorf("missing sector bitmap for chunk %d", chunk)
+	}
+	bitmap := make([]byte, vhdxSectorBitmapSize)
+	if _, err := v.file.ReadAt(bitmap, int64(entry>>20)*vhdxFileOffsetUnit); err != nil {
+		return nil, errors.Wrap(err, "reading sector bitmap")
+	}
+	v.bitmaps[chunk] = bitmap
+	return bitmap, nil
+}
+
+func zeroFill(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults used by the image writers
+const (
+	DefaultVHDXBlockSize = 32 * 1024 * 1024
+	DefaultVHDBlockSize  = 2 * 1024 * 1024
+	maxVHDXSize          = 64 * 1024 * 1024 * 1024 * 1024
+)
+
+// VHDX layout written by WriteVHDX. Everything before the data blocks
+// fits in the first megabytes of the file.
+const (
+	vhdxLogOffset      = 1024 * 1024
+	vhdxLogLength      = 1024 * 1024
+	vhdxMetadataOffset = 2 * 1024 * 1024
+	vhdxMetadataLength = 1024 * 1024
+	vhdxBATOffset      = 3 * 1024 * 1024
+	vhdxCreator        = "go-wmi"
+)
+
+// Metadata item flags
+const (
+	vhdxMetadataIsVirtualDisk = 2
+)
+
+// ImageOptions controls the layout of the images written by WriteVHDX,
+// WriteVHD and ConvertRawImage
+type ImageOptions struct {
+	// Type is FixedDisk or DynamicDisk. Dynamic disks are written if not
+	// set. Only the blocks of dynamic disks that hold data are allocated.
+	Type DiskType
+	// BlockSize is the size of the allocation unit of dynamic disks, in
+	// bytes. It defaults to DefaultVHDXBlockSize or DefaultVHDBlockSize.
+	// VHDX block sizes are powers of two between 1 and 256 MB.
+	BlockSize uint32
+	// LogicalSectorSize and PhysicalSectorSize are the sector sizes of
+	// VHDX images, 512 or 4096. They default to 512 and 4096. VHD images
+	// always use 512 byte sectors.
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+}
+
+func (o ImageOptions) diskType() (DiskType, error) {
+	switch o.Type {
+	case 0:
+		return DynamicDisk, nil
+	case FixedDisk, DynamicDisk:
+		return o.Type, nil
+	}
+	return 0, fmt.Errorf("cannot write disks of type %d", o.Type)
+}
+
+// ConvertRawImage writes the raw disk image at rawPath to path, as a VHD
+// or VHDX file depending on the extension of path. Holes in sparse raw
+// images read as zeros, so they are not allocated in dynamic disks.
+func ConvertRawImage(rawPath, path string, opts ImageOptions) error {
+	format, err := formatFromPath(path)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(rawPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if format == FormatVHD {
+		err = WriteVHD(dst, src, info.Size(), opts)
+	} else {
+		err = WriteVHDX(dst, src, info.Size(), opts)
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return errors.Wrapf(err, "converting %s", rawPath)
+	}
+	return nil
+}
+
+// blockReader reads the blocks of a raw image
+type blockReader struct {
+	src       io.Reader
+	remaining int64
+	buf       []byte
+}
+
+// next returns the next block of the image, or nil at the end. The last
+// block is padded with zeros. The returned slice is reused.
+func (b *blockReader) next() ([]byte, error) {
+	if b.remaining <= 0 {
+		return nil, nil
+	}
+	count := int64(len(b.buf))
+	if count > b.remaining {
+		count = b.remaining
+		zeroFill(b.buf[count:])
+	}
+	if _, err := io.ReadFull(b.src, b.buf[:count]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("image ends %d bytes short of its size", b.remaining)
+		}
+		return nil, err
+	}
+	b.remaining -= count
+	return b.buf, nil
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// extend makes sure dst is at least size bytes long, without writing
+// data if dst can be truncated.
+func extend(dst io.WriterAt, size int64) error {
+	if t, ok := dst.(interface{ Truncate(int64) error }); ok {
+		return t.Truncate(size)
+	}
+	_, err := dst.WriteAt([]byte{0}, size-1)
+	return err
+}
+
+func newGUID() (guid, error) {
+	var ret guid
+	if _, err := rand.Read(ret[:]); err != nil {
+		return ret, err
+	}
+	// Version 4, variant 1. Byte 7 holds the high byte of the third
+	// field, which is stored little endian.
+	ret[7] = ret[7]&0x0f | 0x40
+	ret[8] = ret[8]&0x3f | 0x80
+	return ret, nil
+}
+
+// WriteVHDX writes the raw disk image of size bytes read from src to dst,
+// as a VHDX file. Blocks of dynamic disks that only hold zeros are not
+// allocated. size must be a multiple of the logical sector size.
+func WriteVHDX(dst io.WriterAt, src io.Reader, size int64, opts ImageOptions) error {
+	diskType, err := opts.diskType()
+	if err != nil {
+		return err
+	}
+	blockSize := int64(opts.BlockSize)
+	if blockSize == 0 {
+		blockSize = DefaultVHDXBlockSize
+	}
+	if blockSize < 1024*1024 || blockSize > 256*1024*1024 || blockSize&(blockSize-1) != 0 {
+		return fmt.Errorf("invalid block size %d", blockSize)
+	}
+	logicalSectorSize := int64(opts.LogicalSectorSize)
+	if logicalSectorSize == 0 {
+		logicalSectorSize = 512
+	}
+	physicalSectorSize := int64(opts.PhysicalSectorSize)
+	if physicalSectorSize == 0 {
+		physicalSectorSize = 4096
+	}
+	for _, sectorSize := range []int64{logicalSectorSize, physicalSectorSize} {
+		if sectorSize != 512 && sectorSize != 4096 {
+			return fmt.Errorf("invalid sector size %d", sectorSize)
+		}
+	}
+	if size <= 0 || size > maxVHDXSize || size%logicalSectorSize != 0 {
+		return fmt.Errorf("invalid image size %d", size)
+	}
+
+	chunkRatio := vhdxSectorsPerBitmap * logicalSectorSize / blockSize
+	payloadBlocks := (size + blockSize - 1) / blockSize
+	batEntries := payloadBlocks + (payloadBlocks-1)/chunkRatio
+	batLength := roundUp(batEntries*8, vhdxFileOffsetUnit)
+	dataOffset := vhdxBATOffset + batLength
+
+	// Data blocks
+	bat := make([]uint64, batEntries)
+	blocks := &blockReader{src: src, remaining: size, buf: make([]byte, blockSize)}
+	next := dataOffset
+	for block := int64(0); ; block++ {
+		buf, err := blocks.next()
+		if err != nil {
+			return err
+		}
+		if buf == nil {
+			break
+		}
+		idx := block + block/chunkRatio
+		if diskType == DynamicDisk && isZero(buf) {
+			bat[idx] = vhdxBlockNotPresent
+			continue
+		}
+		// Fixed disks keep every block at its place in the file. Zero
+		// blocks are left as holes.
+		offset := dataOffset + block*blockSize
+		if diskType == DynamicDisk {
+			offset = next
+			next += blockSize
+		}
+		if !isZero(buf) {
+			if _, err := dst.WriteAt(buf, offset); err != nil {
+				return errors.Wrap(err, "writing block")
+			}
+		}
+		bat[idx] = uint64(offset/vhdxFileOffsetUnit)<<20 | vhdxBlockFullyPresent
+	}
+	if diskType == FixedDisk {
+		next = dataOffset + payloadBlocks*blockSize
+	}
+
+	// BAT
+	batBuf := make([]byte, batLength)
+	for i, entry := range bat {
+		binary.LittleEndian.PutUint64(batBuf[i*8:], entry)
+	}
+	if _, err := dst.WriteAt(batBuf, vhdxBATOffset); err != nil {
+		return errors.Wrap(err, "writing BAT")
+	}
+
+	// Metadata
+	diskID, err := newGUID()
+	if err != nil {
+		return err
+	}
+	var flags uint32
+	if diskType == FixedDisk {
+		flags |= vhdxLeaveBlocksAllocated
+	}
+	metadata, err := vhdxMetadata(uint32(blockSize), flags, uint64(size), diskID, uint32(logicalSectorSize), uint32(physicalSectorSize))
+	if err != nil {
+		return err
+	}
+	if _, err := dst.WriteAt(metadata, vhdxMetadataOffset); err != nil {
+		return errors.Wrap(err, "writing metadata")
+	}
+
+	// Log, region tables, headers and file identifier
+	if _, err := dst.WriteAt(make([]byte, vhdxLogLength), vhdxLogOffset); err != nil {
+		return errors.Wrap(err, "writing log")
+	}
+	regions, err := vhdxRegionTable(uint32(batLength))
+	if err != nil {
+		return err
+	}
+	for _, off := range vhdxRegionTableOffsets {
+		if _, err := dst.WriteAt(regions, off); err != nil {
+			return errors.Wrap(err, "writing region table")
+		}
+	}
+	fileWriteGUID, err := newGUID()
+	if err != nil {
+		return err
+	}
+	dataWriteGUID, err := newGUID()
+	if err != nil {
+		return err
+	}
+	for idx, off := range vhdxHeaderOffsets {
+		hdr := vhdxHeader{
+			SequenceNumber: uint64(idx),
+			FileWriteGUID:  fileWriteGUID,
+			DataWriteGUID:  dataWriteGUID,
+			Version:        1,
+			LogLength:      vhdxLogLength,
+			LogOffset:      vhdxLogOffset,
+		}
+		copy(hdr.Signature[:], vhdxHeaderSignature)
+		buf, err := checksummed(hdr, vhdxHeaderSize)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.WriteAt(buf, off); err != nil {
+			return errors.Wrap(err, "writing header")
+		}
+	}
+	ident := make([]byte, 8+512)
+	copy(ident, vhdxSignature)
+	for i, unit := range utf16.Encode([]rune(vhdxCreator)) {
+		binary.LittleEndian.PutUint16(ident[8+2*i:], unit)
+	}
+	if _, err := dst.WriteAt(ident, 0); err != nil {
+		return errors.Wrap(err, "writing file identifier")
+	}
+	return extend(dst, next)
+}
+
+func roundUp(val, unit int64) int64 {
+	return (val + unit - 1) / unit * unit
+}
+
+// checksummed encodes data into a buffer of size bytes, and stores the
+// CRC-32C checksum of the buffer at byte 4.
+func checksummed(data interface{}, size int) ([]byte, error) {
+	w := bytes.NewBuffer(make([]byte, 0, size))
+	if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	copy(buf, w.Bytes())
+	binary.LittleEndian.PutUint32(buf[4:8], 0)
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(buf, castagnoli))
+	return buf, nil
+}
+
+func vhdxRegionTable(batLength uint32) ([]byte, error) {
+	table := struct {
+		Header  vhdxRegionTableHeader
+		Entries [2]vhdxRegionEntry
+	}{
+		Header: vhdxRegionTableHeader{EntryCount: 2},
+		Entries: [2]vhdxRegionEntry{
+			{GUID: vhdxBATRegion, FileOffset: vhdxBATOffset, Length: batLength, Required: 1},
+			{GUID: vhdxMetadataRegion, FileOffset: vhdxMetadataOffset, Length: vhdxMetadataLength, Required: 1},
+		},
+	}
+	copy(table.Header.Signature[:], vhdxRegionSignature)
+	return checksummed(table, vhdxRegionTableSize)
+}
+
+// vhdxMetadata returns the metadata region of a disk without parent
+func vhdxMetadata(blockSize, flags uint32, size uint64, diskID guid, logicalSectorSize, physicalSectorSize uint32) ([]byte, error) {
+	items := []struct {
+		id    guid
+		flags uint32
+		data  interface{}
+	}{
+		{vhdxFileParameters, vhdxMetadataIsRequired, [2]uint32{blockSize, flags}},
+		{vhdxVirtualDiskSize, vhdxMetadataIsRequired | vhdxMetadataIsVirtualDisk, size},
+		{vhdxPage83Data, vhdxMetadataIsRequired | vhdxMetadataIsVirtualDisk, diskID},
+		{vhdxLogicalSectorSize, vhdxMetadataIsRequired | vhdxMetadataIsVirtualDisk, logicalSectorSize},
+		{vhdxPhysicalSectorSize, vhdxMetadataIsRequired | vhdxMetadataIsVirtualDisk, physicalSectorSize},
+	}
+
+	buf := make([]byte, vhdxMetadataLength)
+	hdr := vhdxMetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(hdr.Signature[:], vhdxMetadataSignature)
+	table := bytes.NewBuffer(make([]byte, 0, vhdxMetadataTableSize))
+	if err := binary.Write(table, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	// Items follow the table, which takes the first 64KB of the region
+	offset := uint32(vhdxMetadataTableSize)
+	for _, item := range items {
+		data := new(bytes.Buffer)
+		if err := binary.Write(data, binary.LittleEndian, item.data); err != nil {
+			return nil, err
+		}
+		entry := vhdxMetadataEntry{
+			ItemID: item.id,
+			Offset: offset,
+			Length: uint32(data.Len()),
+			Flags:  item.flags,
+		}
+		if err := binary.Write(table, binary.LittleEndian, entry); err != nil {
+			return nil, err
+		}
+		copy(buf[offset:], data.Bytes())
+		offset += uint32(data.Len())
+	}
+	copy(buf, table.Bytes())
+	return buf, nil
+}
@@ -0,0 +1,340 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gabriel-samfira/go-wmi/wmi"
+	"github.com/pkg/errors"
+)
+
+// Checkpoint is a checkpoint (snapshot) of a virtual machine
+type Checkpoint struct {
+	// ID is the InstanceID of the settings of this checkpoint
+	ID           string
+	Name         string
+	CreationTime time.Time
+	// ParentID is the ID of the checkpoint this one was taken from, or
+	// empty for the first checkpoint of a virtual machine
+	ParentID string
+	Children []*Checkpoint
+
+	path string
+}
+
+// checkpointSettings holds the properties of a Msvm_VirtualSystemSettingData
+// read for a checkpoint
+type checkpointSettings struct {
+	InstanceID   string
+	ElementName  string
+	CreationTime string
+	Parent       string
+}
+
+func newCheckpoint(settings *wmi.Result) (*Checkpoint, error) {
+	s := checkpointSettings{}
+	if err := wmi.PopulateStruct(settings, &s); err != nil {
+		return nil, errors.Wrap(err, "reading checkpoint settings")
+	}
+	pth, err := settings.Path()
+	if err != nil {
+		return nil, errors.Wrap(err, "checkpoint path")
+	}
+	ret := &Checkpoint{
+		ID:       s.InstanceID,
+		Name:     s.ElementName,
+		Children: []*Checkpoint{},
+		path:     pth,
+	}
+	if s.CreationTime != "" {
+		ret.CreationTime, err = wmi.ParseDatetime(s.CreationTime)
+		if err != nil {
+			return nil, errors.Wrap(err, "CreationTime")
+		}
+	}
+	if s.Parent != "" {
+		loc, err := wmi.NewLocation(s.Parent)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parent")
+		}
+		ret.ParentID = loc.Params["InstanceID"]
+	}
+	return ret, nil
+}
+
+func (m *Manager) snapshotService() (*wmi.Result, error) {
+	svc, err := m.con.GetOne(SnapshotService, []string{}, []wmi.Query{})
+	if err != nil {
+		return nil, errors.Wrap(err, "getting SnapshotService")
+	}
+	return svc, nil
+}
+
+// modifySystemSettings applies the modified system settings in settings
+func (m *Manager) modifySystemSettings(settings *wmi.Result) error {
+	text, err := settings.GetText(1)
+	if err != nil {
+		return errors.Wrap(err, "GetText")
+	}
+	out, err := m.svc.Call("ModifySystemSettings", map[string]interface{}{
+		"SystemSettings": text,
+	})
+	if err != nil {
+		return errors.Wrap(err, "calling ModifySystemSettings")
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "ModifySystemSettings")
+	}
+	return nil
+}
+
+// CreateCheckpoint takes a checkpoint of this virtual machine, of the type
+// set with SetCheckpointType, and names it name if not empty.
+func (v *VirtualMachine) CreateCheckpoint(name string) (*Checkpoint, error) {
+	svc, err := v.mgr.snapshotService()
+	if err != nil {
+		return nil, err
+	}
+	defer svc.Release()
+	out, err := svc.Call("CreateSnapshot", map[string]interface{}{
+		"AffectedSystem": v.path,
+		"SnapshotType":   uint16(SnapshotFull),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "calling CreateSnapshot")
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return nil, errors.Wrap(err, "CreateSnapshot")
+	}
+
+	settings, err := v.mgr.jobResult(out, "ResultingSnapshot", VirtualSystemSettingDataClass)
+	if err != nil {
+		return nil, err
+	}
+	defer settings.Release()
+	if name != "" {
+		if err := settings.Set("ElementName", name); err != nil {
+			return nil, errors.Wrap(err, "Set ElementName")
+		}
+		if err := v.mgr.modifySystemSettings(settings); err != nil {
+			return nil, errors.Wrap(err, "renaming checkpoint")
+		}
+	}
+	return newCheckpoint(settings)
+}
+
+// jobResult returns the object referenced by the out parameter param of
+// a method that creates an object of class. The parameter is only set
+// when the method completes synchronously. Otherwise the object is found
+// through the elements affected by the job.
+func (m *Manager) jobResult(out wmi.Outputs, param, class string) (*wmi.Result, error) {
+	pth, err := out.String(param)
+	if err == nil && pth != "" {
+		return m.getByPath(pth)
+	}
+	jobPath, err := out.String("Job")
+	if err != nil || jobPath == "" {
+		return nil, fmt.Errorf("neither %s nor Job were returned", param)
+	}
+	job, err := m.getByPath(jobPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting job")
+	}
+	defer job.Release()
+	affected, err := job.Get("associators_", AffectedJobElementClass, class)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting AffectedJobElementClass")
+	}
+	defer affected.Release()
+	ret, err := affected.ItemAtIndex(0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching %s", class)
+	}
+	return ret, nil
+}
+
+// getByPath returns the object at pth, bypassing the query cache
+func (m *Manager) getByPath(pth string) (*wmi.Result, error) {
+	loc, err := wmi.NewLocation(pth)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting location")
+	}
+	return loc.GetResultFrom(m.con, wmi.Options{NoCache: true})
+}
+
+// checkpointSettings returns the settings of the checkpoints of this
+// virtual machine. If id is not empty, only the checkpoint with that ID
+// is returned.
+func (v *VirtualMachine) checkpointSettings(id string) ([]*wmi.Result, error) {
+	vmID, err := v.ID()
+	if err != nil {
+		return nil, err
+	}
+	qParams := []wmi.Query{
+		&wmi.AndQuery{
+			QueryFields: wmi.QueryFields{
+				Key:   "VirtualSystemType",
+				Value: VirtualSystemTypeSnapshot,
+				Type:  wmi.Equals},
+		},
+		&wmi.AndQuery{
+			QueryFields: wmi.QueryFields{
+				Key:   "VirtualSystemIdentifier",
+				Value: vmID,
+				Type:  wmi.Equals},
+		},
+	}
+	if id != "" {
+		qParams = append(qParams, &wmi.AndQuery{
+			QueryFields: wmi.QueryFields{
+				Key:   "InstanceID",
+				Value: id,
+				Type:  wmi.Equals},
+		})
+	}
+	result, err := v.mgr.con.Gwmi(VirtualSystemSettingDataClass, []string{}, qParams)
+	if err != nil {
+		return nil, errors.Wrap(err, "VirtualSystemSettingDataClass")
+	}
+	defer result.Release()
+	elements, err := result.Elements()
+	if err != nil {
+		return nil, errors.Wrap(err, "Elements")
+	}
+	if id != "" && len(elements) == 0 {
+		return nil, fmt.Errorf("checkpoint %s not found", id)
+	}
+	return elements, nil
+}
+
+// checkpointPath returns the path of the settings of the checkpoint id
+func (v *VirtualMachine) checkpointPath(id string) (string, error) {
+	elements, err := v.checkpointSettings(id)
+	if err != nil {
+		return "", err
+	}
+	defer releaseResults(elements)
+	pth, err := elements[0].Path()
+	if err != nil {
+		return "", errors.Wrap(err, "checkpoint path")
+	}
+	return pth, nil
+}
+
+// Checkpoints returns the checkpoint tree of this virtual machine. The
+// returned checkpoints are the roots of the tree, and Children holds the
+// checkpoints taken from each checkpoint. Siblings are sorted by
+// creation time.
+func (v *VirtualMachine) Checkpoints() ([]*Checkpoint, error) {
+	elements, err := v.checkpointSettings("")
+	if err != nil {
+		return nil, err
+	}
+	defer releaseResults(elements)
+	byID := map[string]*Checkpoint{}
+	all := make([]*Checkpoint, 0, len(elements))
+	for _, val := range elements {
+		checkpoint, err := newCheckpoint(val)
+		if err != nil {
+			return nil, err
+		}
+		byID[checkpoint.ID] = checkpoint
+		all = append(all, checkpoint)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].CreationTime.Before(all[j].CreationTime)
+	})
+
+	roots := []*Checkpoint{}
+	for _, checkpoint := range all {
+		if parent, ok := byID[checkpoint.ParentID]; ok {
+			parent.Children = append(parent.Children, checkpoint)
+			continue
+		}
+		roots = append(roots, checkpoint)
+	}
+	return roots, nil
+}
+
+// ApplyCheckpoint reverts this virtual machine to the checkpoint id. The
+// virtual machine must be off or saved.
+func (v *VirtualMachine) ApplyCheckpoint(id string) error {
+	return v.callSnapshotService("ApplySnapshot", "Snapshot", id)
+}
+
+// DeleteCheckpoint deletes the checkpoint id. Its children are kept, and
+// become children of its parent.
+func (v *VirtualMachine) DeleteCheckpoint(id string) error {
+	return v.callSnapshotService("DestroySnapshot", "AffectedSnapshot", id)
+}
+
+// DeleteCheckpointTree deletes the checkpoint id and all the
+// checkpoints taken from it.
+func (v *VirtualMachine) DeleteCheckpointTree(id string) error {
+	return v.callSnapshotService("DestroySnapshotTree", "SnapshotSettingData", id)
+}
+
+func (v *VirtualMachine) callSnapshotService(method, param, id string) error {
+	pth, err := v.checkpointPath(id)
+	if err != nil {
+		return err
+	}
+	svc, err := v.mgr.snapshotService()
+	if err != nil {
+		return err
+	}
+	defer svc.Release()
+	out, err := svc.Call(method, map[string]interface{}{
+		param: pth,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "calling %s", method)
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, method)
+	}
+	return nil
+}
+
+// RenameCheckpoint sets the name of the checkpoint id
+func (v *VirtualMachine) RenameCheckpoint(id, name string) error {
+	elements, err := v.checkpointSettings(id)
+	if err != nil {
+		return err
+	}
+	defer releaseResults(elements)
+	if err := elements[0].Set("ElementName", name); err != nil {
+		return errors.Wrap(err, "Set ElementName")
+	}
+	return v.mgr.modifySystemSettings(elements[0])
+}
+
+// CheckpointType returns the type of checkpoint taken of this virtual machine
+func (v *VirtualMachine) CheckpointType() (CheckpointType, error) {
+	settings := struct {
+		UserSnapshotType int32
+	}{}
+	if err := wmi.PopulateStruct(v.activeSettingsData, &settings); err != nil {
+		return 0, errors.Wrap(err, "UserSnapshotType")
+	}
+	return CheckpointType(settings.UserSnapshotType), nil
+}
+
+// SetCheckpointType sets the type of checkpoint taken of this virtual
+// machine. CheckpointDisabled prevents checkpoints from being taken.
+func (v *VirtualMachine) SetCheckpointType(checkpointType CheckpointType) error {
+	if err := v.activeSettingsData.Set("UserSnapshotType", uint16(checkpointType)); err != nil {
+		return errors.Wrap(err, "Set UserSnapshotType")
+	}
+	return v.mgr.modifySystemSettings(v.activeSettingsData)
+}
+
+func releaseResults(results []*wmi.Result) {
+	for _, val := range results {
+		val.Release()
+	}
+}
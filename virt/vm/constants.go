@@ -1,5 +1,7 @@
 package vm
 
+import "time"
+
 // Hyper-V virtual machine specific constants
 const (
 	VMManagementService                    = "Msvm_VirtualSystemManagementService"
@@ -88,6 +90,72 @@ const (
 	SnapshotFull = 2 // _SNAPSHOT_FULL
 )
 
+// Checkpoint classes and system types
+const (
+	SnapshotService           = "Msvm_VirtualSystemSnapshotService"
+	VirtualSystemTypeSnapshot = "Microsoft:Hyper-V:Snapshot:Realized"
+)
+
+// Export and import classes
+const (
+	SystemExportSettingDataClass        = "Msvm_SystemExportSettingData"
+	VirtualSystemExportSettingDataClass = "Msvm_VirtualSystemExportSettingData"
+	PlannedComputerSystemClass          = "Msvm_PlannedComputerSystem"
+)
+
+// ExportCheckpoints selects the checkpoints exported with a virtual machine
+type ExportCheckpoints uint8
+
+// Values of the CopySnapshotConfiguration property of
+// Msvm_VirtualSystemExportSettingData
+var (
+	ExportAllCheckpoints ExportCheckpoints = 0
+	ExportNoCheckpoints  ExportCheckpoints = 1
+)
+
+// Migration classes
+const (
+	MigrationService          = "Msvm_VirtualSystemMigrationService"
+	MigrationSettingDataClass = "Msvm_VirtualSystemMigrationSettingData"
+)
+
+// MigrationKind selects what a migration moves
+type MigrationKind int
+
+// Migration kinds
+var (
+	// LiveMigration moves a virtual machine to another host while it runs
+	LiveMigration MigrationKind = 0
+	// QuickMigration saves the virtual machine, moves it to another host
+	// and starts it there. If the migration fails, it is started again on
+	// this host.
+	QuickMigration MigrationKind = 1
+	// StorageMigration moves the storage of a virtual machine on its host
+	StorageMigration MigrationKind = 2
+	// VMAndStorageMigration moves a virtual machine and its storage to
+	// another host
+	VMAndStorageMigration MigrationKind = 3
+)
+
+// Values of the MigrationType property of Msvm_VirtualSystemMigrationSettingData
+const (
+	migrationTypeVirtualSystem           = 32768
+	migrationTypeStorage                 = 32769
+	migrationTypeVirtualSystemAndStorage = 32771
+)
+
+// CheckpointType is the type of checkpoint taken of a virtual machine
+type CheckpointType uint16
+
+// Checkpoint types, as held by the UserSnapshotType property of
+// Msvm_VirtualSystemSettingData
+var (
+	CheckpointDisabled       CheckpointType = 2
+	CheckpointProduction     CheckpointType = 3
+	CheckpointProductionOnly CheckpointType = 4
+	CheckpointStandard       CheckpointType = 5
+)
+
 // Misc
 const (
 	VirtualSystemCurrentSettings = 3  // _VIRTUAL_SYSTEM_CURRENT_SETTINGS
@@ -102,3 +170,7 @@ var (
 	Generation1 GenerationType = "Microsoft:Hyper-V:SubType:1"
 	Generation2 GenerationType = "Microsoft:Hyper-V:SubType:2"
 )
+
+// statePollInterval is how often the power state of a virtual machine
+// is checked while waiting for it to change
+const statePollInterval = time.Second
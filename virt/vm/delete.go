@@ -0,0 +1,214 @@
+package vm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gabriel-samfira/go-wmi/virt/storage"
+	"github.com/gabriel-samfira/go-wmi/wmi"
+	"github.com/pkg/errors"
+)
+
+// virtualDiskExtensions are the extensions of the files DeleteVM
+// removes when DeleteDisks is set
+var virtualDiskExtensions = map[string]bool{
+	".vhd":   true,
+	".vhdx":  true,
+	".avhd":  true,
+	".avhdx": true,
+}
+
+// DeleteOptions controls how DeleteVM stops a virtual machine and
+// what it removes besides the virtual machine itself
+type DeleteOptions struct {
+	// ShutdownTimeout is how long the guest is given to shut down before
+	// the virtual machine is turned off. If zero, a running virtual
+	// machine is turned off right away.
+	ShutdownTimeout time.Duration
+	// DeleteDisks removes the virtual hard disk files attached to the
+	// virtual machine, along with the differencing disks Hyper-V created
+	// for its checkpoints. The parents of the attached disks, such as
+	// shared base images, and ISO images are never removed.
+	DeleteDisks bool
+	// DeleteConfiguration removes the directory Hyper-V keeps the runtime
+	// state of the virtual machine in. The configuration root holding it
+	// may be shared with other virtual machines, and is left in place.
+	DeleteConfiguration bool
+}
+
+// DeletedVM reports what DeleteVM removed
+type DeletedVM struct {
+	// ID and Name identify the deleted virtual machine
+	ID   string
+	Name string
+	// Destroyed is true once the virtual machine was removed from Hyper-V
+	Destroyed bool
+	// Files holds the disk files and directories that were removed
+	Files []string
+}
+
+// DeleteVM stops the virtual machine identified by id, if it is running,
+// and removes it from Hyper-V. The files named in opts are removed after
+// that. The returned report holds what was removed, also when an error
+// stops the deletion part way.
+func (m *Manager) DeleteVM(id string, opts DeleteOptions) (*DeletedVM, error) {
+	vm, err := m.GetVM(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetVM")
+	}
+	settings := struct {
+		ElementName           string
+		ConfigurationDataRoot string
+	}{}
+	if err := wmi.PopulateStruct(vm.activeSettingsData, &settings); err != nil {
+		return nil, errors.Wrap(err, "reading VM settings")
+	}
+	ret := &DeletedVM{
+		ID:   id,
+		Name: settings.ElementName,
+	}
+
+	// Collect the disks before destroying the VM, which removes the
+	// settings pointing to them.
+	var disks []string
+	if opts.DeleteDisks {
+		disks, err = vm.diskFiles()
+		if err != nil {
+			return ret, errors.Wrap(err, "listing disks")
+		}
+	}
+
+	if err := vm.stop(opts.ShutdownTimeout); err != nil {
+		return ret, errors.Wrap(err, "stopping VM")
+	}
+	out, err := m.svc.Call("DestroySystem", map[string]interface{}{
+		"AffectedSystem": vm.path,
+	})
+	if err != nil {
+		return ret, errors.Wrap(err, "calling DestroySystem")
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return ret, errors.Wrap(err, "DestroySystem")
+	}
+	ret.Destroyed = true
+
+	for _, disk := range disks {
+		if err := os.Remove(disk); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return ret, errors.Wrap(err, "removing disk")
+		}
+		ret.Files = append(ret.Files, disk)
+	}
+
+	if opts.DeleteConfiguration && settings.ConfigurationDataRoot != "" {
+		stateDir := filepath.Join(settings.ConfigurationDataRoot, "Virtual Machines", id)
+		if _, err := os.Stat(stateDir); err == nil {
+			if err := os.RemoveAll(stateDir); err != nil {
+				return ret, errors.Wrap(err, "removing VM state directory")
+			}
+			ret.Files = append(ret.Files, stateDir)
+		}
+	}
+	return ret, nil
+}
+
+// stop turns this virtual machine off if it is running, giving the guest
+// timeout to shut down first.
+func (v *VirtualMachine) stop(timeout time.Duration) error {
+	state, err := v.State()
+	if err != nil {
+		return err
+	}
+	if state == Disabled {
+		return nil
+	}
+	if timeout > 0 && state == Enabled {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return v.Shutdown(ctx, true, "virtual machine is being deleted")
+	}
+	return v.SetPowerState(Disabled)
+}
+
+// diskFiles returns the virtual hard disk files attached to this virtual
+// machine, followed by the checkpoint disks they are chained to.
+func (v *VirtualMachine) diskFiles() ([]string, error) {
+	images, err := storage.NewImageManager()
+	if err != nil {
+		return nil, errors.Wrap(err, "NewImageManager")
+	}
+	defer images.Release()
+
+	storageSettings, err := v.activeSettingsData.Get("associators_", nil, StorageAllocSettingDataClass)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting StorageAllocSettingDataClass")
+	}
+	defer storageSettings.Release()
+	elements, err := storageSettings.Elements()
+	if err != nil {
+		return nil, errors.Wrap(err, "Elements")
+	}
+	ret := []string{}
+	seen := map[string]bool{}
+	for _, val := range elements {
+		settings := struct {
+			ResourceSubType string
+			HostResource    []string
+		}{}
+		err := wmi.PopulateStruct(val, &settings)
+		val.Release()
+		if err != nil {
+			return nil, errors.Wrap(err, "reading storage settings")
+		}
+		if settings.ResourceSubType != IDEDiskResSubType {
+			continue
+		}
+		for _, pth := range settings.HostResource {
+			if !virtualDiskExtensions[strings.ToLower(filepath.Ext(pth))] {
+				continue
+			}
+			chain, err := checkpointChain(images, pth)
+			if err != nil {
+				return nil, err
+			}
+			for _, disk := range chain {
+				if !seen[strings.ToLower(disk)] {
+					seen[strings.ToLower(disk)] = true
+					ret = append(ret, disk)
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// checkpointChain returns pth and the disks it is chained to through
+// checkpoints. Hyper-V attaches a new .avhd or .avhdx differencing disk
+// for every checkpoint, whose parent is the disk attached before. The
+// chain is followed up to the first disk that is not a checkpoint disk,
+// which is the disk that was attached to the virtual machine. Its own
+// parents are not part of the virtual machine.
+func checkpointChain(images *storage.Manager, pth string) ([]string, error) {
+	ret := []string{}
+	seen := map[string]bool{}
+	for pth != "" && !seen[strings.ToLower(pth)] {
+		seen[strings.ToLower(pth)] = true
+		ret = append(ret, pth)
+		ext := strings.ToLower(filepath.Ext(pth))
+		if ext != ".avhd" && ext != ".avhdx" {
+			break
+		}
+		settings, err := images.GetDiskSettings(pth)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading disk settings of %s", pth)
+		}
+		pth = settings.ParentPath
+	}
+	return ret, nil
+}
@@ -0,0 +1,286 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gabriel-samfira/go-wmi/wmi"
+	"github.com/pkg/errors"
+)
+
+// ExportOptions controls what Export writes
+type ExportOptions struct {
+	// Checkpoints selects the checkpoints exported with the virtual machine
+	Checkpoints ExportCheckpoints
+	// RuntimeState exports the saved state and memory of the virtual machine
+	RuntimeState bool
+	// ExcludeStorage exports the configuration without copying the
+	// virtual hard disks
+	ExcludeStorage bool
+	// NoSubdirectory exports directly into the export directory, instead
+	// of into a subdirectory named after the virtual machine
+	NoSubdirectory bool
+}
+
+// Export exports this virtual machine to dir, so it can be imported on
+// another host with Manager.Import.
+func (v *VirtualMachine) Export(dir string, opts ExportOptions) error {
+	settingsResult, err := v.computerSystem.Get("associators_", SystemExportSettingDataClass, VirtualSystemExportSettingDataClass)
+	if err != nil {
+		return errors.Wrap(err, "getting VirtualSystemExportSettingDataClass")
+	}
+	defer settingsResult.Release()
+	settings, err := settingsResult.ItemAtIndex(0)
+	if err != nil {
+		return errors.Wrap(err, "fetching export settings")
+	}
+	defer settings.Release()
+
+	values := []struct {
+		name  string
+		value interface{}
+	}{
+		{"CopySnapshotConfiguration", uint8(opts.Checkpoints)},
+		{"CopyVmRuntimeInformation", opts.RuntimeState},
+		{"CopyVmStorage", !opts.ExcludeStorage},
+		{"CreateVmExportSubdirectory", !opts.NoSubdirectory},
+	}
+	for _, val := range values {
+		if err := settings.Set(val.name, val.value); err != nil {
+			return errors.Wrapf(err, "Set %s", val.name)
+		}
+	}
+	settingsText, err := settings.GetText(1)
+	if err != nil {
+		return errors.Wrap(err, "GetText")
+	}
+
+	out, err := v.mgr.svc.Call("ExportSystemDefinition", map[string]interface{}{
+		"ComputerSystem":    v.path,
+		"ExportDirectory":   dir,
+		"ExportSettingData": settingsText,
+	})
+	if err != nil {
+		return errors.Wrap(err, "calling ExportSystemDefinition")
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "ExportSystemDefinition")
+	}
+	return nil
+}
+
+// ImportOptions controls how Import registers a virtual machine
+type ImportOptions struct {
+	// CheckpointDir is the directory holding the exported checkpoints,
+	// usually the Snapshots directory of the export. If empty, no
+	// checkpoints are imported.
+	CheckpointDir string
+	// GenerateNewID gives the imported virtual machine a new ID, so the
+	// same export can be imported more than once on a host.
+	GenerateNewID bool
+	// Copy copies the virtual hard disks into DestinationDir and keeps the
+	// configuration there, leaving the export untouched. Otherwise, the
+	// virtual machine is registered in place and uses the exported files.
+	// Disks are copied as single files, so differencing disks keep their
+	// original parents.
+	Copy           bool
+	DestinationDir string
+}
+
+// Import imports the virtual machine exported to path, the configuration
+// file (.vmcx) in the Virtual Machines directory of an export.
+func (m *Manager) Import(path string, opts ImportOptions) (*VirtualMachine, error) {
+	if opts.Copy && opts.DestinationDir == "" {
+		return nil, fmt.Errorf("copying a virtual machine requires a destination directory")
+	}
+	var checkpointDir interface{}
+	if opts.CheckpointDir != "" {
+		checkpointDir = opts.CheckpointDir
+	}
+	out, err := m.svc.Call("ImportSystemDefinition", map[string]interface{}{
+		"SystemDefinitionFile":        path,
+		"SnapshotFolder":              checkpointDir,
+		"GenerateNewSystemIdentifier": opts.GenerateNewID,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "calling ImportSystemDefinition")
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return nil, errors.Wrap(err, "ImportSystemDefinition")
+	}
+	planned, err := m.jobResult(out, "ImportedSystem", PlannedComputerSystemClass)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting planned system")
+	}
+	defer planned.Release()
+	plannedPath, err := planned.Path()
+	if err != nil {
+		return nil, errors.Wrap(err, "planned system path")
+	}
+
+	// Disks copied for the planned system are removed along with it if
+	// the import fails.
+	var copied []string
+	abort := func() {
+		m.destroySystem(plannedPath)
+		removeFiles(copied)
+	}
+	if opts.Copy {
+		copied, err = m.relocatePlannedSystem(planned, opts.DestinationDir)
+		if err != nil {
+			abort()
+			return nil, errors.Wrap(err, "copying virtual machine")
+		}
+	}
+
+	realized, err := m.svc.Call("RealizePlannedSystem", map[string]interface{}{
+		"PlannedSystem": plannedPath,
+	})
+	if err != nil {
+		abort()
+		return nil, errors.Wrap(err, "calling RealizePlannedSystem")
+	}
+	defer realized.Release()
+	if err := realized.Wait(); err != nil {
+		abort()
+		return nil, errors.Wrap(err, "RealizePlannedSystem")
+	}
+	cs, err := m.jobResult(realized, "ResultingSystem", ComputerSystemClass)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting imported system")
+	}
+	defer cs.Release()
+
+	// The name field of the computer system is actually the InstanceID...
+	system := struct {
+		Name string
+	}{}
+	if err := wmi.PopulateStruct(cs, &system); err != nil {
+		return nil, errors.Wrap(err, "fetching VM ID")
+	}
+	vm, err := m.GetVM(system.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching VM")
+	}
+	return vm, nil
+}
+
+// relocatePlannedSystem moves the configuration of the planned system to
+// dir, and copies its virtual hard disks there. It returns the files it
+// copied, also when it fails part way.
+func (m *Manager) relocatePlannedSystem(planned *wmi.Result, dir string) ([]string, error) {
+	settingsResult, err := planned.Get("associators_", SettingsDefineStateClass, VirtualSystemSettingDataClass)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting VirtualSystemSettingDataClass")
+	}
+	defer settingsResult.Release()
+	settings, err := settingsResult.ItemAtIndex(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching planned settings")
+	}
+	defer settings.Release()
+	for _, name := range []string{"ConfigurationDataRoot", "SnapshotDataRoot", "SwapFileDataRoot"} {
+		if err := settings.Set(name, dir); err != nil {
+			return nil, errors.Wrapf(err, "Set %s", name)
+		}
+	}
+	if err := m.modifySystemSettings(settings); err != nil {
+		return nil, err
+	}
+
+	storageSettings, err := settings.Get("associators_", nil, StorageAllocSettingDataClass)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting StorageAllocSettingDataClass")
+	}
+	defer storageSettings.Release()
+	elements, err := storageSettings.Elements()
+	if err != nil {
+		return nil, errors.Wrap(err, "Elements")
+	}
+	defer releaseResults(elements)
+
+	diskDir := filepath.Join(dir, "Virtual Hard Disks")
+	modified := []string{}
+	ret := []string{}
+	for _, val := range elements {
+		storage := struct {
+			ResourceSubType string
+			HostResource    []string
+		}{}
+		if err := wmi.PopulateStruct(val, &storage); err != nil {
+			return ret, errors.Wrap(err, "reading storage settings")
+		}
+		if storage.ResourceSubType != IDEDiskResSubType || len(storage.HostResource) == 0 {
+			continue
+		}
+		copied := make([]string, len(storage.HostResource))
+		for idx, src := range storage.HostResource {
+			copied[idx] = filepath.Join(diskDir, filepath.Base(src))
+			if err := copyFile(src, copied[idx]); err != nil {
+				return ret, errors.Wrapf(err, "copying %s", src)
+			}
+			ret = append(ret, copied[idx])
+		}
+		if err := val.Set("HostResource", copied); err != nil {
+			return ret, errors.Wrap(err, "Set HostResource")
+		}
+		text, err := val.GetText(1)
+		if err != nil {
+			return ret, errors.Wrap(err, "GetText")
+		}
+		modified = append(modified, text)
+	}
+	if len(modified) == 0 {
+		return ret, nil
+	}
+	return ret, m.modifyResourceSettings(modified)
+}
+
+// destroySystem removes the system at pth, such as a planned system left
+// behind by a failed import. Errors are ignored, as the caller already
+// has one to report.
+func (m *Manager) destroySystem(pth string) {
+	out, err := m.svc.Call("DestroySystem", map[string]interface{}{
+		"AffectedSystem": pth,
+	})
+	if err != nil {
+		return
+	}
+	defer out.Release()
+	out.Wait()
+}
+
+// removeFiles removes paths, such as files copied for an import that
+// failed. Errors are ignored, as the caller already has one to report.
+func removeFiles(paths []string) {
+	for _, pth := range paths {
+		os.Remove(pth)
+	}
+}
+
+// copyFile copies src to dst, creating the directory of dst if needed.
+// An existing dst is not overwritten.
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,320 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-samfira/go-wmi/wmi"
+	"github.com/pkg/errors"
+)
+
+// MigrateOptions controls how Migrate moves a virtual machine
+type MigrateOptions struct {
+	// Kind selects what is migrated
+	Kind MigrationKind
+	// DestinationAddresses restricts the IP addresses of the destination
+	// host used for the migration. If empty, any address can be used.
+	DestinationAddresses []string
+	// DestinationDir is where the configuration and, for storage
+	// migrations, the virtual hard disks not named in DiskPaths are
+	// moved to. If empty, the configuration keeps its current location.
+	DestinationDir string
+	// DiskPaths maps the current paths of virtual hard disks to their
+	// destination paths, for storage migrations.
+	DiskPaths map[string]string
+	// SkipCompatibilityCheck skips CheckMigrationCompatibility before
+	// moving the virtual machine to another host.
+	SkipCompatibilityCheck bool
+	// Progress, if set, is called with the completion percentage of the
+	// migration job each time it changes.
+	Progress func(percent int)
+}
+
+// IncompatibleError is returned when a virtual machine cannot run on
+// the host it is migrated to
+type IncompatibleError struct {
+	Host    string
+	Reasons []string
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("virtual machine is not compatible with %s: %s", e.Host, strings.Join(e.Reasons, "; "))
+}
+
+func (m *Manager) migrationService() (*wmi.Result, error) {
+	svc, err := m.con.GetOne(MigrationService, []string{}, []wmi.Query{})
+	if err != nil {
+		return nil, errors.Wrap(err, "getting MigrationService")
+	}
+	return svc, nil
+}
+
+// CheckMigrationCompatibility checks that this virtual machine can run
+// on destinationHost. An *IncompatibleError holding the reasons given by
+// the destination is returned if it cannot.
+func (v *VirtualMachine) CheckMigrationCompatibility(destinationHost string) error {
+	svc, err := v.mgr.migrationService()
+	if err != nil {
+		return err
+	}
+	defer svc.Release()
+	out, err := svc.Call("GetSystemCompatibilityInfo", map[string]interface{}{
+		"ComputerSystem": v.path,
+	})
+	if err != nil {
+		return errors.Wrap(err, "calling GetSystemCompatibilityInfo")
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "GetSystemCompatibilityInfo")
+	}
+	info, err := out.Bytes("CompatibilityInfo")
+	if err != nil {
+		return errors.Wrap(err, "CompatibilityInfo")
+	}
+
+	remote, err := wmi.NewConnection(destinationHost, wmi.VirtualizationV2Namespace)
+	if err != nil {
+		return errors.Wrapf(err, "connecting to %s", destinationHost)
+	}
+	defer remote.Close()
+	remoteSvc, err := remote.GetOne(MigrationService, []string{}, []wmi.Query{})
+	if err != nil {
+		return errors.Wrap(err, "getting destination MigrationService")
+	}
+	defer remoteSvc.Release()
+	check, err := remoteSvc.Call("CheckSystemCompatibilityInfo", map[string]interface{}{
+		"CompatibilityInfo": info,
+	})
+	if err != nil {
+		return errors.Wrap(err, "calling CheckSystemCompatibilityInfo")
+	}
+	defer check.Release()
+	code, err := check.ReturnValue()
+	if err != nil {
+		return errors.Wrap(err, "ReturnValue")
+	}
+	if code == wmi.ReturnCompleted {
+		return nil
+	}
+	reasons, err := check.Strings("Reasons")
+	if err != nil || len(reasons) == 0 {
+		reasons = []string{code.String()}
+	}
+	return &IncompatibleError{Host: destinationHost, Reasons: reasons}
+}
+
+// Migrate moves this virtual machine, its storage, or both, to
+// destinationHost. For storage migrations, destinationHost may be empty,
+// in which case the local host is used. Cancelling ctx asks Hyper-V to
+// cancel the migration job.
+func (v *VirtualMachine) Migrate(ctx context.Context, destinationHost string, opts MigrateOptions) error {
+	var migrationType uint16
+	switch opts.Kind {
+	case LiveMigration, QuickMigration:
+		migrationType = migrationTypeVirtualSystem
+	case StorageMigration:
+		migrationType = migrationTypeStorage
+	case VMAndStorageMigration:
+		migrationType = migrationTypeVirtualSystemAndStorage
+	default:
+		return fmt.Errorf("invalid migration kind %d", opts.Kind)
+	}
+	if destinationHost == "" {
+		if opts.Kind != StorageMigration {
+			return fmt.Errorf("missing destination host")
+		}
+		host, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "getting host name")
+		}
+		destinationHost = host
+	}
+
+	if opts.Kind != StorageMigration && !opts.SkipCompatibilityCheck {
+		if err := v.CheckMigrationCompatibility(destinationHost); err != nil {
+			return err
+		}
+	}
+
+	migrationSettings, err := v.mgr.con.SpawnInstance(MigrationSettingDataClass)
+	if err != nil {
+		return errors.Wrap(err, "SpawnInstance")
+	}
+	defer migrationSettings.Release()
+	if err := migrationSettings.Set("MigrationType", migrationType); err != nil {
+		return errors.Wrap(err, "Set MigrationType")
+	}
+	if len(opts.DestinationAddresses) > 0 {
+		if err := migrationSettings.Set("DestinationIPAddressList", opts.DestinationAddresses); err != nil {
+			return errors.Wrap(err, "Set DestinationIPAddressList")
+		}
+	}
+	migrationText, err := migrationSettings.GetText(1)
+	if err != nil {
+		return errors.Wrap(err, "GetText")
+	}
+
+	params := map[string]interface{}{
+		"ComputerSystem":       v.path,
+		"DestinationHost":      destinationHost,
+		"MigrationSettingData": migrationText,
+	}
+	if opts.DestinationDir != "" {
+		systemText, err := v.relocatedSystemSettings(opts.DestinationDir)
+		if err != nil {
+			return err
+		}
+		params["NewSystemSettingData"] = systemText
+	}
+	if opts.Kind == StorageMigration || opts.Kind == VMAndStorageMigration {
+		resources, err := v.relocatedDiskSettings(opts.DestinationDir, opts.DiskPaths)
+		if err != nil {
+			return err
+		}
+		if len(resources) > 0 {
+			params["NewResourceSettingData"] = resources
+		}
+	}
+
+	// Quick migrations save a running virtual machine first, and start it
+	// again on the destination. If the migration fails, the virtual
+	// machine is started again from its saved state on this host.
+	saved := false
+	var id string
+	if opts.Kind == QuickMigration {
+		state, err := v.State()
+		if err != nil {
+			return err
+		}
+		if state == Enabled {
+			if id, err = v.ID(); err != nil {
+				return err
+			}
+			if err := v.SetPowerState(Offline); err != nil {
+				return errors.Wrap(err, "saving VM")
+			}
+			saved = true
+		}
+	}
+
+	if err := v.migrate(ctx, params, opts.Progress); err != nil {
+		if saved {
+			if restoreErr := v.SetPowerState(Enabled); restoreErr != nil {
+				return errors.Wrapf(err, "restoring saved VM failed too (%s)", restoreErr)
+			}
+		}
+		return err
+	}
+	if saved {
+		if err := startMigrated(destinationHost, id); err != nil {
+			return errors.Wrapf(err, "starting VM on %s", destinationHost)
+		}
+	}
+	return nil
+}
+
+// startMigrated starts the virtual machine with the given ID on host,
+// from the state it was saved in before a quick migration.
+func startMigrated(host, id string) error {
+	mgr, err := newVMManager(host)
+	if err != nil {
+		return errors.Wrapf(err, "connecting to %s", host)
+	}
+	defer mgr.Release()
+	vm, err := mgr.GetVM(id)
+	if err != nil {
+		return err
+	}
+	return vm.SetPowerState(Enabled)
+}
+
+// migrate calls MigrateVirtualSystemToHost with params, and waits for the
+// migration job to complete.
+func (v *VirtualMachine) migrate(ctx context.Context, params map[string]interface{}, progress func(percent int)) error {
+	svc, err := v.mgr.migrationService()
+	if err != nil {
+		return err
+	}
+	defer svc.Release()
+	out, err := svc.Call("MigrateVirtualSystemToHost", params)
+	if err != nil {
+		return errors.Wrap(err, "calling MigrateVirtualSystemToHost")
+	}
+	defer out.Release()
+	if err := out.WaitContext(ctx, progress); err != nil {
+		return errors.Wrap(err, "MigrateVirtualSystemToHost")
+	}
+	return nil
+}
+
+// relocatedSystemSettings returns the settings of this virtual machine,
+// with the configuration moved to dir.
+func (v *VirtualMachine) relocatedSystemSettings(dir string) (string, error) {
+	settings, err := v.activeSettingsData.Get("Clone_")
+	if err != nil {
+		return "", errors.Wrap(err, "Clone_")
+	}
+	defer settings.Release()
+	for _, name := range []string{"ConfigurationDataRoot", "SnapshotDataRoot", "SwapFileDataRoot"} {
+		if err := settings.Set(name, dir); err != nil {
+			return "", errors.Wrapf(err, "Set %s", name)
+		}
+	}
+	text, err := settings.GetText(1)
+	if err != nil {
+		return "", errors.Wrap(err, "GetText")
+	}
+	return text, nil
+}
+
+// relocatedDiskSettings returns the storage settings of the virtual hard
+// disks of this virtual machine, pointing to their destination. Disks
+// are moved to the path given in diskPaths or, if missing, into dir.
+// Disks with neither are left out, and stay where they are.
+func (v *VirtualMachine) relocatedDiskSettings(dir string, diskPaths map[string]string) ([]string, error) {
+	storageSettings, err := v.activeSettingsData.Get("associators_", nil, StorageAllocSettingDataClass)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting StorageAllocSettingDataClass")
+	}
+	defer storageSettings.Release()
+	elements, err := storageSettings.Elements()
+	if err != nil {
+		return nil, errors.Wrap(err, "Elements")
+	}
+	defer releaseResults(elements)
+
+	ret := []string{}
+	for _, val := range elements {
+		storage := struct {
+			ResourceSubType string
+			HostResource    []string
+		}{}
+		if err := wmi.PopulateStruct(val, &storage); err != nil {
+			return nil, errors.Wrap(err, "reading storage settings")
+		}
+		if storage.ResourceSubType != IDEDiskResSubType || len(storage.HostResource) == 0 {
+			continue
+		}
+		src := storage.HostResource[0]
+		dst, ok := diskPaths[src]
+		if !ok {
+			if dir == "" {
+				continue
+			}
+			dst = filepath.Join(dir, filepath.Base(src))
+		}
+		if err := val.Set("HostResource", []string{dst}); err != nil {
+			return nil, errors.Wrap(err, "Set HostResource")
+		}
+		text, err := val.GetText(1)
+		if err != nil {
+			return nil, errors.Wrap(err, "GetText")
+		}
+		ret = append(ret, text)
+	}
+	return ret, nil
+}
@@ -27,11 +27,11 @@ func (s *SCSIController) AttachDriveToAddress(path string, driveType DriveType,
 	if err := resData.Set("Parent", s.path); err != nil {
 		return "", errors.Wrap(err, "set Parent")
 	}
-	if err := resData.Set("Address", strconv.Itoa(address)); err != nil {
-		return "", errors.Wrap(err, "set Parent")
+	if err := resData.Set("Address", address); err != nil {
+		return "", errors.Wrap(err, "set Address")
 	}
-	if err := resData.Set("AddressOnParent", strconv.Itoa(address)); err != nil {
-		return "", errors.Wrap(err, "set Parent")
+	if err := resData.Set("AddressOnParent", address); err != nil {
+		return "", errors.Wrap(err, "set AddressOnParent")
 	}
 
 	dataText, err := resData.GetText(1)
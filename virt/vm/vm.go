@@ -1,23 +1,32 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/gabriel-samfira/go-wmi/utils"
 	"github.com/gabriel-samfira/go-wmi/wmi"
 
-	"github.com/go-ole/go-ole"
 	"github.com/pkg/errors"
 )
 
 // NewVMManager returns a new Manager type
 func NewVMManager() (*Manager, error) {
-	w, err := wmi.NewConnection(".", `root\virtualization\v2`)
+	return newVMManager(".")
+}
+
+// newVMManager returns a VM Manager connected to host
+func newVMManager(host string) (*Manager, error) {
+	w, err := wmi.NewConnection(host, `root\virtualization\v2`)
 	if err != nil {
 		return nil, err
 	}
+	// Values set on settings data are checked against the schema,
+	// and converted to the types Hyper-V expects.
+	w.SetStrictWrites(true)
 
 	// Get virtual machine management service
 	svc, err := w.GetOne(VMManagementService, []string{}, []wmi.Query{})
@@ -39,6 +48,12 @@ type Manager struct {
 	svc *wmi.Result
 }
 
+// SetRetryPolicy sets the retry policy of the connection used by this
+// manager. Use nil to disable retries.
+func (m *Manager) SetRetryPolicy(p *wmi.RetryPolicy) {
+	m.con.SetRetryPolicy(p)
+}
+
 // GetVM returns the virtual machine identified by instanceID
 func (m *Manager) GetVM(instanceID string) (*VirtualMachine, error) {
 	fields := []string{}
@@ -128,14 +143,9 @@ func (m *Manager) ListVM() ([]*VirtualMachine, error) {
 
 // CreateVM creates a new virtual machine
 func (m *Manager) CreateVM(name string, memoryMB int64, cpus int, limitCPUFeatures bool, notes []string, generation GenerationType, secureBoot bool) (*VirtualMachine, error) {
-	vmSettingsDataInstance, err := m.con.Get(VirtualSystemSettingDataClass)
-	if err != nil {
-		return nil, err
-	}
-
-	newVMInstance, err := vmSettingsDataInstance.Get("SpawnInstance_")
+	newVMInstance, err := m.con.SpawnInstance(VirtualSystemSettingDataClass)
 	if err != nil {
-		return nil, errors.Wrap(err, "calling SpawnInstance_")
+		return nil, errors.Wrap(err, "SpawnInstance")
 	}
 
 	if err := newVMInstance.Set("ElementName", name); err != nil {
@@ -168,28 +178,29 @@ func (m *Manager) CreateVM(name string, memoryMB int64, cpus int, limitCPUFeatur
 		return nil, errors.Wrap(err, "Failed to get VM instance XML")
 	}
 
-	jobPath := ole.VARIANT{}
-	resultingSystem := ole.VARIANT{}
-	jobState, err := m.svc.Get("DefineSystem", vmText, nil, nil, &resultingSystem, &jobPath)
+	out, err := m.svc.Call("DefineSystem", map[string]interface{}{
+		"SystemSettings": vmText,
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "calling DefineSystem")
 	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return nil, errors.Wrap(err, "waiting for job")
-		}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return nil, errors.Wrap(err, "DefineSystem")
 	}
 
 	// The resultingSystem value for DefineSystem is always a string containing the
 	// location of the newly created resource
-	locationURI := resultingSystem.Value().(string)
+	locationURI, err := out.String("ResultingSystem")
+	if err != nil {
+		return nil, errors.Wrap(err, "ResultingSystem")
+	}
 	loc, err := wmi.NewLocation(locationURI)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting location")
 	}
 
-	result, err := loc.GetResult()
+	result, err := loc.GetResultFrom(m.con)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting result")
 	}
@@ -270,40 +281,35 @@ func (v *VirtualMachine) SetBootOrder(bootOrder []int32) error {
 	if err := v.activeSettingsData.Set("BootOrder", bootOrder); err != nil {
 		return errors.Wrap(err, "Set BootOrder")
 	}
+	return v.mgr.modifySystemSettings(v.activeSettingsData)
+}
 
-	vmText, err := v.activeSettingsData.GetText(1)
-	if err != nil {
-		return errors.Wrap(err, "GetText")
-	}
+func (v *VirtualMachine) modifyResourceSettings(settings []string) error {
+	return v.mgr.modifyResourceSettings(settings)
+}
 
-	jobPath := ole.VARIANT{}
-	jobState, err := v.mgr.svc.Get("ModifySystemSettings", vmText, &jobPath)
+func (m *Manager) modifyResourceSettings(settings []string) error {
+	out, err := m.svc.Call("ModifyResourceSettings", map[string]interface{}{
+		"ResourceSettings": settings,
+	})
 	if err != nil {
-		return errors.Wrap(err, "calling ModifySystemSettings")
+		return errors.Wrap(err, "calling ModifyResourceSettings")
 	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return errors.Wrap(err, "waiting for job")
-		}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "ModifyResourceSettings")
 	}
 	return nil
 }
 
-func (v *VirtualMachine) modifyResourceSettings(settings []string) error {
-	jobPath := ole.VARIANT{}
-	resultingSystem := ole.VARIANT{}
-	jobState, err := v.mgr.svc.Get("ModifyResourceSettings", settings, &resultingSystem, &jobPath)
+// hasChanges returns true if modified differs from current, so
+// no-op modifications can be skipped.
+func hasChanges(current, modified *wmi.Result) (bool, error) {
+	changes, err := wmi.Diff(current, modified)
 	if err != nil {
-		return errors.Wrap(err, "calling ModifyResourceSettings")
-	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err := wmi.WaitForJob(jobPath.Value().(string))
-		if err != nil {
-			return errors.Wrap(err, "waiting for job")
-		}
+		return false, errors.Wrap(err, "Diff")
 	}
-	return nil
+	return len(changes) > 0, nil
 }
 
 // SetMemory sets the virtual machine memory allocation
@@ -317,6 +323,11 @@ func (v *VirtualMachine) SetMemory(memoryMB int64) error {
 	if err != nil {
 		return errors.Wrap(err, "ItemAtIndex")
 	}
+	current, err := memorySettings.Get("Clone_")
+	if err != nil {
+		return errors.Wrap(err, "Clone_")
+	}
+	defer current.Release()
 
 	if err := memorySettings.Set("Limit", memoryMB); err != nil {
 		return errors.Wrap(err, "Limit")
@@ -330,6 +341,10 @@ func (v *VirtualMachine) SetMemory(memoryMB int64) error {
 		return errors.Wrap(err, "VirtualQuantity")
 	}
 
+	if changed, err := hasChanges(current, memorySettings); err != nil || !changed {
+		return err
+	}
+
 	memText, err := memorySettings.GetText(1)
 	if err != nil {
 		return errors.Wrap(err, "Failed to get VM instance XML")
@@ -354,17 +369,22 @@ func (v *VirtualMachine) SetCPUs(cpus int, limitCPUFeatures bool) error {
 	if err != nil {
 		return errors.Wrap(err, "ItemAtIndex")
 	}
+	current, err := procSettings.Get("Clone_")
+	if err != nil {
+		return errors.Wrap(err, "Clone_")
+	}
+	defer current.Release()
 
 	if err := procSettings.Set("VirtualQuantity", uint64(cpus)); err != nil {
 		return errors.Wrap(err, "VirtualQuantity")
 	}
 
-	if err := procSettings.Set("Reservation", cpus); err != nil {
+	if err := procSettings.Set("Reservation", uint64(cpus)); err != nil {
 		return errors.Wrap(err, "Reservation")
 	}
 
 	// Use 100% of CPU core
-	if err := procSettings.Set("Limit", 100000); err != nil {
+	if err := procSettings.Set("Limit", uint64(100000)); err != nil {
 		return errors.Wrap(err, "Limit")
 	}
 
@@ -372,6 +392,10 @@ func (v *VirtualMachine) SetCPUs(cpus int, limitCPUFeatures bool) error {
 		return errors.Wrap(err, "LimitProcessorFeatures")
 	}
 
+	if changed, err := hasChanges(current, procSettings); err != nil || !changed {
+		return err
+	}
+
 	procText, err := procSettings.GetText(1)
 	if err != nil {
 		return errors.Wrap(err, "Failed to get VM instance XML")
@@ -381,18 +405,105 @@ func (v *VirtualMachine) SetCPUs(cpus int, limitCPUFeatures bool) error {
 
 // SetPowerState sets the desired power state on a virtual machine.
 func (v *VirtualMachine) SetPowerState(state PowerState) error {
-	jobPath := ole.VARIANT{}
-	jobState, err := v.computerSystem.Get("RequestStateChange", uint16(state), &jobPath)
+	out, err := v.computerSystem.Call("RequestStateChange", map[string]interface{}{
+		"RequestedState": uint16(state),
+	})
 	if err != nil {
 		return errors.Wrap(err, "calling RequestStateChange")
 	}
-	if jobState.Value().(int32) == wmi.JobStatusStarted {
-		err = wmi.WaitForJob(jobPath.Value().(string))
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "RequestStateChange")
+	}
+	return nil
+}
+
+// State returns the current power state of this virtual machine
+func (v *VirtualMachine) State() (PowerState, error) {
+	if err := v.computerSystem.Refresh(); err != nil {
+		return 0, errors.Wrap(err, "Refresh")
+	}
+	state := struct {
+		EnabledState int32
+	}{}
+	if err := wmi.PopulateStruct(v.computerSystem, &state); err != nil {
+		return 0, errors.Wrap(err, "EnabledState")
+	}
+	return PowerState(state.EnabledState), nil
+}
+
+// Shutdown asks the guest operating system to shut down, through the
+// shutdown integration service, and waits until the virtual machine is
+// off. If force is true, open applications do not block the guest
+// shutdown, and the virtual machine is turned off if ctx is done first or
+// the guest cannot be asked to shut down. Otherwise the error is returned
+// and the virtual machine is left running. The reason is passed on to the
+// guest. Virtual machines that are already off are left as they are.
+func (v *VirtualMachine) Shutdown(ctx context.Context, force bool, reason string) error {
+	state, err := v.State()
+	if err != nil {
+		return err
+	}
+	if state == Disabled {
+		return nil
+	}
+	err = v.initiateShutdown(force, reason)
+	if err == nil {
+		err = v.waitForState(ctx, Disabled)
+	}
+	if err == nil || !force {
+		return err
+	}
+	if stopErr := v.SetPowerState(Disabled); stopErr != nil {
+		return errors.Wrapf(stopErr, "turning off after failed shutdown (%v)", err)
+	}
+	return nil
+}
+
+func (v *VirtualMachine) initiateShutdown(force bool, reason string) error {
+	components, err := v.computerSystem.Get("associators_", nil, ShutdownComponentClass)
+	if err != nil {
+		return errors.Wrap(err, "getting ShutdownComponentClass")
+	}
+	defer components.Release()
+	component, err := components.ItemAtIndex(0)
+	if err != nil {
+		return errors.Wrap(err, "shutdown integration service not found")
+	}
+	defer component.Release()
+	out, err := component.Call("InitiateShutdown", map[string]interface{}{
+		"Force":  force,
+		"Reason": reason,
+	})
+	if err != nil {
+		return errors.Wrap(err, "calling InitiateShutdown")
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		return errors.Wrap(err, "InitiateShutdown")
+	}
+	return nil
+}
+
+// waitForState polls the power state of this virtual machine until it
+// is state, or ctx is done.
+func (v *VirtualMachine) waitForState(ctx context.Context, state PowerState) error {
+	ticker := time.NewTicker(statePollInterval)
+	defer ticker.Stop()
+	for {
+		current, err := v.State()
 		if err != nil {
-			return errors.Wrap(err, "waiting for job")
+			return err
+		}
+		if current == state {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting for state %d (currently %d)", state, current)
+		case <-ticker.C:
 		}
 	}
-	return nil
 }
 
 // CreateNewSCSIController will create a new ISCSI controller on this VM
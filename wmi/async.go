@@ -0,0 +1,173 @@
+package wmi
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	"github.com/pkg/errors"
+)
+
+// asyncQueryBuffer is the number of objects QueryAsync buffers
+// before the provider is made to wait for the consumer.
+const asyncQueryBuffer = 64
+
+// AsyncQuery is a query started by QueryAsync. Objects are delivered on
+// the channel returned by Results as the provider produces them. The
+// channel is closed once the query completes, fails or is cancelled.
+type AsyncQuery struct {
+	results chan *Result
+	done    chan struct{}
+	// stop is closed when the query completes, to unblock deliveries
+	stop   chan struct{}
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	closed  bool
+	err     error
+	sending sync.WaitGroup
+}
+
+// Results returns the channel on which objects are delivered
+func (a *AsyncQuery) Results() <-chan *Result {
+	return a.results
+}
+
+// Done returns a channel that is closed when the query completes
+func (a *AsyncQuery) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err returns the completion status of the query. It returns nil while
+// the query is still running, or if it completed successfully.
+func (a *AsyncQuery) Err() error {
+	select {
+	case <-a.done:
+		return a.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the query completes and returns its completion status.
+// Results must be drained concurrently, or Wait may block forever.
+func (a *AsyncQuery) Wait() error {
+	<-a.done
+	return a.Err()
+}
+
+// Close cancels the query if it is still running, and releases the
+// objects that were delivered but not received.
+func (a *AsyncQuery) Close() {
+	a.cancel()
+	<-a.done
+	for res := range a.results {
+		res.Release()
+	}
+}
+
+// deliver sends res to the consumer. The lock is not held while waiting
+// for the consumer, so the query can complete in the meantime.
+func (a *AsyncQuery) deliver(ctx context.Context, res *Result) {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		res.Release()
+		return
+	}
+	a.sending.Add(1)
+	a.lock.Unlock()
+	defer a.sending.Done()
+
+	select {
+	case a.results <- res:
+	case <-ctx.Done():
+		res.Release()
+	case <-a.stop:
+		res.Release()
+	}
+}
+
+func (a *AsyncQuery) complete(err error) {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return
+	}
+	a.closed = true
+	a.err = err
+	close(a.stop)
+	a.lock.Unlock()
+
+	// Deliveries in flight must end before results is closed
+	a.sending.Wait()
+	close(a.results)
+	close(a.done)
+}
+
+// QueryAsync runs a WQL query through ExecQueryAsync and returns
+// immediately. Cancelling ctx cancels the in flight call, in which
+// case the query completes with the context error. Call Close to stop
+// a query before it completes without cancelling ctx.
+func (w *WMI) QueryAsync(ctx context.Context, wql string, opts ...Options) (*AsyncQuery, error) {
+	if w.replay != nil {
+		return nil, errors.Wrap(errNotReplayable, "QueryAsync")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	q := &AsyncQuery{
+		results: make(chan *Result, asyncQueryBuffer),
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		cancel:  cancel,
+	}
+	sink, err := newAsyncSink(
+		func(v *ole.VARIANT) {
+			q.deliver(ctx, w.newResult(v))
+		},
+		func(err error) {
+			if err != nil {
+				err = errors.Wrap(err, "ExecQueryAsync")
+			}
+			q.complete(err)
+		})
+	if err != nil {
+		cancel()
+		return nil, errors.Wrap(err, "creating sink")
+	}
+
+	o := mergeOptions(opts)
+	flags, wctx, release, err := o.callParams(0)
+	if err != nil {
+		sink.close()
+		cancel()
+		return nil, err
+	}
+	services, err := w.conn.servicesObject()
+	if err != nil {
+		release()
+		sink.close()
+		cancel()
+		return nil, err
+	}
+	_, err = oleutil.CallMethod(services, "ExecQueryAsync", sink.object(), wql, "WQL", flags, wctx)
+	services.Release()
+	release()
+	if err != nil {
+		sink.close()
+		cancel()
+		return nil, errors.Wrap(err, "ExecQueryAsync")
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			sink.cancel()
+			q.complete(ctx.Err())
+		case <-q.done:
+			cancel()
+		}
+		sink.close()
+	}()
+	return q, nil
+}
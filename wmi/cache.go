@@ -0,0 +1,377 @@
+package wmi
+
+import (
+	"container/list"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/go-ole/go-ole"
+)
+
+// QueryCache caches the results of queries and association lookups,
+// keyed by server, namespace and WQL. Entries expire after a TTL, the
+// least recently used entries are evicted once the cache is full, and
+// mutating calls made through this package invalidate the entries of
+// the classes they affect.
+//
+// Cached results hold references to shared objects. Properties set on an
+// object returned from the cache are seen by every caller getting the same
+// entry, until they are overwritten by a refresh or the entry is dropped.
+type QueryCache struct {
+	lock       sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type cacheEntry struct {
+	key       string
+	namespace string
+	// classes are the classes whose changes invalidate this entry.
+	// An entry without classes is invalidated by any change in its
+	// namespace.
+	classes []string
+	res     *Result
+	expires time.Time
+}
+
+// NewQueryCache returns a cache holding up to maxEntries results for ttl.
+// A zero ttl keeps results until they are evicted or invalidated, and a
+// zero maxEntries does not bound the size of the cache.
+func NewQueryCache(ttl time.Duration, maxEntries int) *QueryCache {
+	return &QueryCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+var (
+	cacheLock   sync.RWMutex
+	activeCache *QueryCache
+)
+
+// SetQueryCache sets the cache used by all connections of this process.
+// Use nil to disable caching. The previous cache is not purged.
+func SetQueryCache(c *QueryCache) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	activeCache = c
+}
+
+func queryCache() *QueryCache {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	return activeCache
+}
+
+// Len returns the number of results held by the cache
+func (c *QueryCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// Purge drops all results held by the cache
+func (c *QueryCache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Front())
+	}
+}
+
+// Invalidate drops the results of queries against any of classes in
+// namespace. If no classes are given, all results in namespace are
+// dropped. An empty namespace matches all namespaces. Classes are
+// matched by name, so results of queries against a parent class must
+// be invalidated explicitly.
+func (c *QueryCache) Invalidate(namespace string, classes ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var next *list.Element
+	for elem := c.lru.Front(); elem != nil; elem = next {
+		next = elem.Next()
+		entry := elem.Value.(*cacheEntry)
+		if namespace != "" && !strings.EqualFold(namespace, entry.namespace) {
+			continue
+		}
+		if len(classes) == 0 || len(entry.classes) == 0 || matchClass(entry.classes, classes) {
+			c.remove(elem)
+		}
+	}
+}
+
+func matchClass(have, want []string) bool {
+	for _, a := range have {
+		for _, b := range want {
+			if strings.EqualFold(a, b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// remove drops elem. The cache lock must be held.
+func (c *QueryCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	entry.res.Release()
+}
+
+// get returns a new reference to the result cached under key, owned by
+// session and conn, or nil if there is none.
+func (c *QueryCache) get(key string, session *Session, conn *connState) *Result {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry.res.share(session, conn)
+}
+
+// put caches a reference to res under key
+func (c *QueryCache) put(key, namespace string, classes []string, res *Result) {
+	cached := res.share(nil, nil)
+	if cached == nil {
+		return
+	}
+	entry := &cacheEntry{
+		key:       key,
+		namespace: namespace,
+		classes:   classes,
+		res:       cached,
+	}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// share returns a new *Result holding another reference to the object
+// held by r, or nil if r does not hold an object.
+func (r *Result) share(session *Session, conn *connState) *Result {
+	if r.fake != nil {
+		return newReplayResult(session, conn, r.fake)
+	}
+	disp := r.dispatch()
+	if disp == nil {
+		return nil
+	}
+	disp.AddRef()
+	v := ole.NewVariant(ole.VT_DISPATCH, int64(uintptr(unsafe.Pointer(disp))))
+	ret := newResult(session, &v)
+	ret.conn = conn
+	return ret
+}
+
+// cacheKey returns the key under which a query is cached
+func cacheKey(server, namespace string, args []string) string {
+	return strings.ToLower(server) + "|" + strings.ToLower(namespace) + "|" + strings.Join(args, "|")
+}
+
+// cachedQuery returns the result cached under the server, namespace and
+// args of a query, or runs the query with f and caches its result. The
+// returned result is owned by session and conn. Queries returning forward
+// only enumerators are never cached, as they can only be read once.
+func cachedQuery(session *Session, conn *connState, server, namespace string, opts *Options, classes, args []string, f func() (*Result, error)) (*Result, bool, error) {
+	cache := queryCache()
+	if cache == nil || (opts != nil && (opts.NoCache || opts.Flags&FlagForwardOnly != 0)) {
+		ret, err := f()
+		return ret, false, err
+	}
+	key := cacheKey(server, namespace, args)
+	if ret := cache.get(key, session, conn); ret != nil {
+		return ret, true, nil
+	}
+	ret, err := f()
+	if err == nil {
+		cache.put(key, namespace, classes, ret)
+	}
+	return ret, false, err
+}
+
+// associationClasses returns the classes whose changes invalidate the
+// result of an associators_ or references_ call on an object of class.
+// It returns false for other methods.
+func associationClasses(method, class string, params []interface{}) ([]string, bool) {
+	idx := -1
+	switch strings.ToLower(method) {
+	case "associators_":
+		// strAssocClass, strResultClass, ...
+		idx = 1
+	case "references_":
+		// strResultClass, ...
+		idx = 0
+	default:
+		return nil, false
+	}
+	if idx >= len(params) {
+		return nil, true
+	}
+	result, ok := params[idx].(string)
+	if !ok || result == "" || class == "" {
+		// Any change may affect an unfiltered association.
+		return nil, true
+	}
+	return []string{result, class}, true
+}
+
+// objectPathRegexp matches object paths, such as
+// \\HOST\root\cimv2:Win32_Service.Name="wmi" or Win32_Service.Name="wmi"
+var objectPathRegexp = regexp.MustCompile(`^(\\\\[^\\]+\\[^:]+:)?[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*=|=@)`)
+
+// valueClass returns the class referenced by val when it holds an object
+// path or an embedded instance, or an empty string.
+func valueClass(val string) string {
+	val = strings.TrimSpace(val)
+	if strings.HasPrefix(val, "<") {
+		obj, err := decodeCIMXML(val, nil)
+		if err != nil {
+			return ""
+		}
+		return obj.Class
+	}
+	if objectPathRegexp.MatchString(val) {
+		return pathClass(val)
+	}
+	return ""
+}
+
+// paramClasses returns the classes of the objects, object paths and
+// embedded instances passed to a call.
+func paramClasses(params []interface{}) []string {
+	ret := []string{}
+	for _, param := range params {
+		switch val := param.(type) {
+		case string:
+			if class := valueClass(val); class != "" {
+				ret = append(ret, class)
+			}
+		case []string:
+			for _, item := range val {
+				if class := valueClass(item); class != "" {
+					ret = append(ret, class)
+				}
+			}
+		case *Result:
+			if val == nil {
+				continue
+			}
+			val.describe()
+			if val.class != "" {
+				ret = append(ret, val.class)
+			}
+		}
+	}
+	return ret
+}
+
+// outputClasses returns the classes of the references and embedded
+// instances held by the out parameters of a method.
+func outputClasses(out *Result) []string {
+	if out == nil {
+		return nil
+	}
+	text, err := out.GetText(1)
+	if err != nil {
+		return nil
+	}
+	obj, err := decodeCIMXML(text, nil)
+	if err != nil {
+		return nil
+	}
+	ret := []string{}
+	for _, prop := range obj.Properties {
+		if prop.IsReference {
+			ret = append(ret, pathClass(prop.Text))
+			continue
+		}
+		for _, val := range append([]string{prop.Text}, prop.Texts...) {
+			if class := valueClass(val); class != "" {
+				ret = append(ret, class)
+			}
+		}
+	}
+	return ret
+}
+
+// objectReadMethods are the SWbemObject methods that do not change state,
+// and are retried without the caller opting in.
+var objectReadMethods = map[string]bool{
+	"associators_":       true,
+	"references_":        true,
+	"gettext_":           true,
+	"getobjecttext_":     true,
+	"spawninstance_":     true,
+	"spawnderivedclass_": true,
+	"clone_":             true,
+	"compareto_":         true,
+	"refresh_":           true,
+	"instances_":         true,
+	"subclasses_":        true,
+}
+
+// invalidateObjectCall drops the cached results affected by a successful
+// call of method on r. The call affects the class of r, and the classes
+// of the objects it was handed and returned.
+func (r *Result) invalidateObjectCall(method string, in map[string]interface{}, params []interface{}, out *Result) {
+	cache := queryCache()
+	if cache == nil || isReadObjectMethod(method) {
+		return
+	}
+	cache.Invalidate(r.namespace, r.objectCallClasses(method, in, params, out)...)
+}
+
+// objectCallClasses returns the classes affected by a call of method
+// on r, and looks up the namespace of r.
+func (r *Result) objectCallClasses(method string, in map[string]interface{}, params []interface{}, out *Result) []string {
+	r.describe()
+	classes := paramClasses(params)
+	for _, val := range in {
+		classes = append(classes, paramClasses([]interface{}{val})...)
+	}
+	if r.class != "" {
+		classes = append(classes, r.class)
+	}
+	if strings.EqualFold(method, "ExecMethod_") {
+		classes = append(classes, outputClasses(out)...)
+	}
+	return classes
+}
+
+// invalidateServiceCall drops the cached results affected by a
+// successful call of method on the SWbemServices object of w
+func (w *WMI) invalidateServiceCall(method string, params []interface{}, out *Result) {
+	cache := queryCache()
+	if cache == nil || isReadMethod(method) {
+		return
+	}
+	classes := paramClasses(params)
+	if strings.EqualFold(method, "ExecMethod") {
+		classes = append(classes, outputClasses(out)...)
+	}
+	cache.Invalidate(w.Namespace, classes...)
+}
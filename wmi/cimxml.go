@@ -0,0 +1,573 @@
+package wmi
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-ole/go-ole"
+	"github.com/pkg/errors"
+)
+
+// CIM-XML (DTD 2.0) is the format returned by GetText_(1). The types below
+// cover the subset of the DTD emitted by WMI for classes and instances.
+// See: https://www.dmtf.org/sites/default/files/standards/documents/DSP0201_2.4.0.pdf
+
+type xmlCIMObject struct {
+	XMLName    xml.Name
+	ClassName  string        `xml:"CLASSNAME,attr"`
+	Name       string        `xml:"NAME,attr"`
+	SuperClass string        `xml:"SUPERCLASS,attr"`
+	Properties []xmlProperty `xml:",any"`
+}
+
+type xmlProperty struct {
+	XMLName        xml.Name
+	Name           string         `xml:"NAME,attr"`
+	Type           string         `xml:"TYPE,attr"`
+	ReferenceClass string         `xml:"REFERENCECLASS,attr"`
+	EmbeddedObject string         `xml:"EmbeddedObject,attr"`
+	Value          *string        `xml:"VALUE"`
+	ValueArray     *xmlValueArray `xml:"VALUE.ARRAY"`
+	Reference      *xmlReference  `xml:"VALUE.REFERENCE"`
+}
+
+type xmlValueArray struct {
+	Values []string `xml:"VALUE"`
+}
+
+type xmlReference struct {
+	InstancePath      *xmlInstancePath      `xml:"INSTANCEPATH"`
+	LocalInstancePath *xmlLocalInstancePath `xml:"LOCALINSTANCEPATH"`
+	InstanceName      *xmlInstanceName      `xml:"INSTANCENAME"`
+}
+
+type xmlInstancePath struct {
+	NamespacePath xmlNamespacePath `xml:"NAMESPACEPATH"`
+	InstanceName  xmlInstanceName  `xml:"INSTANCENAME"`
+}
+
+type xmlNamespacePath struct {
+	Host      string                `xml:"HOST"`
+	Namespace xmlLocalNamespacePath `xml:"LOCALNAMESPACEPATH"`
+}
+
+type xmlLocalInstancePath struct {
+	Namespace    xmlLocalNamespacePath `xml:"LOCALNAMESPACEPATH"`
+	InstanceName xmlInstanceName       `xml:"INSTANCENAME"`
+}
+
+type xmlLocalNamespacePath struct {
+	Namespaces []struct {
+		Name string `xml:"NAME,attr"`
+	} `xml:"NAMESPACE"`
+}
+
+type xmlInstanceName struct {
+	ClassName   string          `xml:"CLASSNAME,attr"`
+	KeyBindings []xmlKeyBinding `xml:"KEYBINDING"`
+}
+
+type xmlKeyBinding struct {
+	Name      string        `xml:"NAME,attr"`
+	KeyValue  *xmlKeyValue  `xml:"KEYVALUE"`
+	Reference *xmlReference `xml:"VALUE.REFERENCE"`
+}
+
+type xmlKeyValue struct {
+	ValueType string `xml:"VALUETYPE,attr"`
+	Value     string `xml:",chardata"`
+}
+
+func (l xmlLocalNamespacePath) String() string {
+	parts := make([]string, len(l.Namespaces))
+	for idx, val := range l.Namespaces {
+		parts[idx] = val.Name
+	}
+	return strings.Join(parts, `\`)
+}
+
+func (i xmlInstanceName) String() string {
+	if len(i.KeyBindings) == 0 {
+		return i.ClassName + "=@"
+	}
+	keys := make([]string, len(i.KeyBindings))
+	for idx, val := range i.KeyBindings {
+		var v string
+		switch {
+		case val.Reference != nil:
+			v, _ = escapePathValue(val.Reference.String())
+		case val.KeyValue != nil && val.KeyValue.ValueType != "string" && val.KeyValue.ValueType != "":
+			v = val.KeyValue.Value
+		case val.KeyValue != nil:
+			v, _ = escapePathValue(val.KeyValue.Value)
+		}
+		keys[idx] = fmt.Sprintf("%s=%s", val.Name, v)
+	}
+	return fmt.Sprintf("%s.%s", i.ClassName, strings.Join(keys, ","))
+}
+
+// String returns the WMI object path held by this reference
+func (r *xmlReference) String() string {
+	switch {
+	case r.InstancePath != nil:
+		return fmt.Sprintf(`\\%s\%s:%s`,
+			r.InstancePath.NamespacePath.Host,
+			r.InstancePath.NamespacePath.Namespace,
+			r.InstancePath.InstanceName)
+	case r.LocalInstancePath != nil:
+		return fmt.Sprintf(`%s:%s`, r.LocalInstancePath.Namespace, r.LocalInstancePath.InstanceName)
+	case r.InstanceName != nil:
+		return r.InstanceName.String()
+	}
+	return ""
+}
+
+// cimProperty is a property of a decoded CIM-XML object
+type cimProperty struct {
+	Name           string
+	Type           string
+	ReferenceClass string
+	EmbeddedObject string
+	IsArray        bool
+	IsReference    bool
+	Null           bool
+	Text           string
+	Texts          []string
+	VT             ole.VT
+}
+
+// cimObject is a class or instance decoded from CIM-XML
+type cimObject struct {
+	Class      string
+	SuperClass string
+	IsClass    bool
+	Path       string
+	Properties []*cimProperty
+}
+
+// property returns the property called name, or nil
+func (c *cimObject) property(name string) *cimProperty {
+	for _, val := range c.Properties {
+		if strings.EqualFold(val.Name, name) {
+			return val
+		}
+	}
+	return nil
+}
+
+// defaultVT returns the VARIANT type that the scripting API
+// uses for a CIM type.
+// See: https://docs.microsoft.com/en-us/windows/win32/wmisdk/numbers
+func defaultVT(cimType string, isArray bool) ole.VT {
+	var vt ole.VT
+	switch strings.ToLower(cimType) {
+	case "uint8":
+		vt = ole.VT_UI1
+	case "sint8", "sint16", "char16":
+		vt = ole.VT_I2
+	case "uint16", "sint32", "uint32":
+		vt = ole.VT_I4
+	case "real32":
+		vt = ole.VT_R4
+	case "real64":
+		vt = ole.VT_R8
+	case "boolean":
+		vt = ole.VT_BOOL
+	case "object":
+		vt = ole.VT_DISPATCH
+	default:
+		vt = ole.VT_BSTR
+	}
+	if isArray {
+		vt |= ole.VT_ARRAY
+	}
+	return vt
+}
+
+// parseVariantText converts the text form of a value to the
+// Go type that ole.VARIANT.Value() returns for vt.
+func parseVariantText(vt ole.VT, text string) (interface{}, error) {
+	parseInt := func(bits int) (int64, error) {
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err == nil {
+			return i, nil
+		}
+		u, uerr := strconv.ParseUint(text, 10, 64)
+		if uerr != nil {
+			return 0, err
+		}
+		return int64(u), nil
+	}
+	switch vt &^ ole.VT_ARRAY {
+	case ole.VT_BSTR, ole.VT_DATE:
+		return text, nil
+	case ole.VT_BOOL:
+		return strings.EqualFold(text, "true"), nil
+	case ole.VT_R4:
+		f, err := strconv.ParseFloat(text, 32)
+		return float32(f), err
+	case ole.VT_R8:
+		return strconv.ParseFloat(text, 64)
+	}
+	i, err := parseInt(64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", text)
+	}
+	switch vt &^ ole.VT_ARRAY {
+	case ole.VT_I1:
+		return int8(i), nil
+	case ole.VT_UI1:
+		return uint8(i), nil
+	case ole.VT_I2:
+		return int16(i), nil
+	case ole.VT_UI2:
+		return uint16(i), nil
+	case ole.VT_I4:
+		return int32(i), nil
+	case ole.VT_UI4:
+		return uint32(i), nil
+	case ole.VT_I8:
+		return i, nil
+	case ole.VT_UI8:
+		return uint64(i), nil
+	case ole.VT_INT:
+		return int(i), nil
+	case ole.VT_UINT:
+		return uint(i), nil
+	}
+	return nil, fmt.Errorf("unsupported VARIANT type %d", vt)
+}
+
+// goValue returns the value of this property, as ole.VARIANT.Value()
+// would return it. Arrays are returned as []interface{}.
+func (p *cimProperty) goValue() (interface{}, error) {
+	if p.Null {
+		return nil, nil
+	}
+	if !p.IsArray {
+		return parseVariantText(p.VT, p.Text)
+	}
+	ret := make([]interface{}, len(p.Texts))
+	for idx, val := range p.Texts {
+		v, err := parseVariantText(p.VT, val)
+		if err != nil {
+			return nil, err
+		}
+		ret[idx] = v
+	}
+	return ret, nil
+}
+
+// decodeCIMXML decodes a CIM-XML class or instance. types maps property
+// names to the VARIANT type WMI returned for them. Properties missing
+// from types get the default type for their CIM type.
+func decodeCIMXML(text string, types map[string]uint16) (*cimObject, error) {
+	var obj xmlCIMObject
+	if err := xml.Unmarshal([]byte(text), &obj); err != nil {
+		return nil, errors.Wrap(err, "decoding CIM-XML")
+	}
+	ret := &cimObject{
+		Class:      obj.ClassName,
+		SuperClass: obj.SuperClass,
+	}
+	switch obj.XMLName.Local {
+	case "INSTANCE":
+	case "CLASS":
+		ret.IsClass = true
+		ret.Class = obj.Name
+	default:
+		return nil, fmt.Errorf("unsupported CIM-XML element %s", obj.XMLName.Local)
+	}
+
+	for _, val := range obj.Properties {
+		prop := &cimProperty{
+			Name:           val.Name,
+			Type:           val.Type,
+			ReferenceClass: val.ReferenceClass,
+			EmbeddedObject: val.EmbeddedObject,
+		}
+		switch val.XMLName.Local {
+		case "PROPERTY":
+			prop.Null = val.Value == nil
+			if val.Value != nil {
+				prop.Text = *val.Value
+			}
+		case "PROPERTY.ARRAY":
+			prop.IsArray = true
+			prop.Null = val.ValueArray == nil
+			if val.ValueArray != nil {
+				prop.Texts = val.ValueArray.Values
+			}
+		case "PROPERTY.REFERENCE":
+			prop.IsReference = true
+			prop.Type = "reference"
+			prop.Null = val.Reference == nil
+			if val.Reference != nil {
+				prop.Text = val.Reference.String()
+			}
+		default:
+			continue
+		}
+		if prop.EmbeddedObject != "" {
+			prop.Type = "object"
+		}
+		if prop.Type == "reference" {
+			prop.IsReference = true
+		}
+		if vt, ok := types[prop.Name]; ok {
+			prop.VT = ole.VT(vt)
+		} else {
+			prop.VT = defaultVT(prop.Type, prop.IsArray)
+		}
+		ret.Properties = append(ret.Properties, prop)
+	}
+	return ret, nil
+}
+
+func writeXMLText(buf *bytes.Buffer, s string) {
+	xml.EscapeText(buf, []byte(s))
+}
+
+func formatCIMValue(val interface{}) string {
+	switch v := val.(type) {
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// encode returns the CIM-XML representation of this object
+func (c *cimObject) encode() string {
+	buf := &bytes.Buffer{}
+	if c.IsClass {
+		buf.WriteString(`<CLASS NAME="`)
+		writeXMLText(buf, c.Class)
+		buf.WriteString(`"`)
+		if c.SuperClass != "" {
+			buf.WriteString(` SUPERCLASS="`)
+			writeXMLText(buf, c.SuperClass)
+			buf.WriteString(`"`)
+		}
+		buf.WriteString(`>`)
+	} else {
+		buf.WriteString(`<INSTANCE CLASSNAME="`)
+		writeXMLText(buf, c.Class)
+		buf.WriteString(`">`)
+	}
+
+	for _, prop := range c.Properties {
+		if prop.IsReference && !prop.IsArray {
+			encodeReferenceProperty(buf, prop)
+			continue
+		}
+		element := "PROPERTY"
+		if prop.IsArray {
+			element = "PROPERTY.ARRAY"
+		}
+		buf.WriteString("<" + element + ` NAME="`)
+		writeXMLText(buf, prop.Name)
+		buf.WriteString(`" TYPE="`)
+		cimType := prop.Type
+		if cimType == "object" {
+			cimType = "string"
+		}
+		writeXMLText(buf, cimType)
+		buf.WriteString(`"`)
+		if prop.EmbeddedObject != "" {
+			buf.WriteString(` EmbeddedObject="`)
+			writeXMLText(buf, prop.EmbeddedObject)
+			buf.WriteString(`"`)
+		}
+		buf.WriteString(`>`)
+
+		switch {
+		case prop.Null:
+		case prop.IsArray:
+			buf.WriteString("<VALUE.ARRAY>")
+			for _, item := range prop.Texts {
+				buf.WriteString("<VALUE>")
+				writeXMLText(buf, item)
+				buf.WriteString("</VALUE>")
+			}
+			buf.WriteString("</VALUE.ARRAY>")
+		default:
+			buf.WriteString("<VALUE>")
+			writeXMLText(buf, prop.Text)
+			buf.WriteString("</VALUE>")
+		}
+		buf.WriteString("</" + element + ">")
+	}
+
+	if c.IsClass {
+		buf.WriteString("</CLASS>")
+	} else {
+		buf.WriteString("</INSTANCE>")
+	}
+	return buf.String()
+}
+
+// encodeReferenceProperty writes prop as a PROPERTY.REFERENCE element
+func encodeReferenceProperty(buf *bytes.Buffer, prop *cimProperty) {
+	buf.WriteString(`<PROPERTY.REFERENCE NAME="`)
+	writeXMLText(buf, prop.Name)
+	buf.WriteString(`"`)
+	if prop.ReferenceClass != "" {
+		buf.WriteString(` REFERENCECLASS="`)
+		writeXMLText(buf, prop.ReferenceClass)
+		buf.WriteString(`"`)
+	}
+	buf.WriteString(`>`)
+	if !prop.Null {
+		encodeReference(buf, prop.Text)
+	}
+	buf.WriteString(`</PROPERTY.REFERENCE>`)
+}
+
+// encodeReference writes the object path pth as a VALUE.REFERENCE element.
+// Paths with a server are written as INSTANCEPATH, paths with only a
+// namespace as LOCALINSTANCEPATH and relative paths as INSTANCENAME.
+func encodeReference(buf *bytes.Buffer, pth string) {
+	server, namespace, relPath := splitObjectPath(pth)
+	buf.WriteString(`<VALUE.REFERENCE>`)
+	switch {
+	case server != "":
+		buf.WriteString(`<INSTANCEPATH><NAMESPACEPATH><HOST>`)
+		writeXMLText(buf, server)
+		buf.WriteString(`</HOST>`)
+		encodeLocalNamespacePath(buf, namespace)
+		buf.WriteString(`</NAMESPACEPATH>`)
+		encodeInstanceName(buf, relPath)
+		buf.WriteString(`</INSTANCEPATH>`)
+	case namespace != "":
+		buf.WriteString(`<LOCALINSTANCEPATH>`)
+		encodeLocalNamespacePath(buf, namespace)
+		encodeInstanceName(buf, relPath)
+		buf.WriteString(`</LOCALINSTANCEPATH>`)
+	default:
+		encodeInstanceName(buf, relPath)
+	}
+	buf.WriteString(`</VALUE.REFERENCE>`)
+}
+
+func encodeLocalNamespacePath(buf *bytes.Buffer, namespace string) {
+	buf.WriteString(`<LOCALNAMESPACEPATH>`)
+	for _, val := range strings.Split(namespace, `\`) {
+		if val == "" {
+			continue
+		}
+		buf.WriteString(`<NAMESPACE NAME="`)
+		writeXMLText(buf, val)
+		buf.WriteString(`"/>`)
+	}
+	buf.WriteString(`</LOCALNAMESPACEPATH>`)
+}
+
+func encodeInstanceName(buf *bytes.Buffer, relPath string) {
+	class, keys := splitRelativePath(relPath)
+	buf.WriteString(`<INSTANCENAME CLASSNAME="`)
+	writeXMLText(buf, class)
+	buf.WriteString(`">`)
+	for _, key := range keys {
+		buf.WriteString(`<KEYBINDING NAME="`)
+		writeXMLText(buf, key.Name)
+		buf.WriteString(`"><KEYVALUE VALUETYPE="`)
+		writeXMLText(buf, key.KeyValue.ValueType)
+		buf.WriteString(`">`)
+		writeXMLText(buf, key.KeyValue.Value)
+		buf.WriteString(`</KEYVALUE></KEYBINDING>`)
+	}
+	buf.WriteString(`</INSTANCENAME>`)
+}
+
+// splitObjectPath splits an object path into its server, namespace and
+// relative path. The separating colon is only looked for before the
+// first quote, as key values may hold colons of their own.
+func splitObjectPath(pth string) (server, namespace, relPath string) {
+	head := pth
+	if idx := strings.Index(head, `"`); idx >= 0 {
+		head = head[:idx]
+	}
+	idx := strings.Index(head, ":")
+	if idx < 0 {
+		return "", "", pth
+	}
+	location, relPath := pth[:idx], pth[idx+1:]
+	if !strings.HasPrefix(location, `\\`) {
+		return "", location, relPath
+	}
+	parts := strings.SplitN(location[2:], `\`, 2)
+	server = parts[0]
+	if len(parts) > 1 {
+		namespace = parts[1]
+	}
+	return server, namespace, relPath
+}
+
+// splitRelativePath splits a relative object path into its class and key
+// bindings. Quoted values are unescaped and typed as strings, TRUE and
+// FALSE as booleans and anything else as numeric. Singleton paths, as
+// well as paths that cannot be parsed, yield no key bindings.
+func splitRelativePath(relPath string) (string, []xmlKeyBinding) {
+	idx := strings.IndexAny(relPath, ".=")
+	if idx < 0 {
+		return relPath, nil
+	}
+	class := relPath[:idx]
+	if relPath[idx] == '=' {
+		// Singleton (Class=@) or a single unnamed key
+		if relPath[idx+1:] == "@" {
+			return class, nil
+		}
+		return class, parseKeyBindings("=" + relPath[idx+1:])
+	}
+	return class, parseKeyBindings(relPath[idx+1:])
+}
+
+func parseKeyBindings(text string) []xmlKeyBinding {
+	var ret []xmlKeyBinding
+	for len(text) > 0 {
+		eq := strings.Index(text, "=")
+		if eq < 0 {
+			break
+		}
+		name := text[:eq]
+		text = text[eq+1:]
+		value := &xmlKeyValue{ValueType: "numeric"}
+		if strings.HasPrefix(text, `"`) {
+			value.ValueType = "string"
+			var val strings.Builder
+			i := 1
+			for ; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+				}
+				val.WriteByte(text[i])
+			}
+			value.Value = val.String()
+			if i < len(text) {
+				i++
+			}
+			text = text[i:]
+		} else {
+			end := strings.Index(text, ",")
+			if end < 0 {
+				end = len(text)
+			}
+			value.Value = text[:end]
+			text = text[end:]
+			if strings.EqualFold(value.Value, "TRUE") || strings.EqualFold(value.Value, "FALSE") {
+				value.ValueType = "boolean"
+			}
+		}
+		ret = append(ret, xmlKeyBinding{Name: name, KeyValue: value})
+		text = strings.TrimPrefix(text, ",")
+	}
+	return ret
+}
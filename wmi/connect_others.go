@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package wmi
+
+// NewConnection returns a new *WMI connection, given the parameters.
+// WMI is only available on Windows. On other platforms, ErrNotSupported
+// is returned, unless a Replayer is active.
+func NewConnection(params ...interface{}) (*WMI, error) {
+	if r := replayer(); r != nil {
+		return r.connect(params)
+	}
+	return nil, ErrNotSupported
+}
+
+func initializeCOM() error {
+	return ErrNotSupported
+}
@@ -0,0 +1,79 @@
+//go:build windows
+// +build windows
+
+package wmi
+
+import (
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	"github.com/pkg/errors"
+)
+
+// NewConnection returns a new *WMI connection, given the parameters.
+// While a Replayer is active, the connection is served by its fixture.
+func NewConnection(params ...interface{}) (*WMI, error) {
+	if r := replayer(); r != nil {
+		return r.connect(params)
+	}
+	w, err := newConnection(params)
+	recordConnect(params, err)
+	return w, err
+}
+
+// initializeCOM joins the calling thread to the multithreaded apartment.
+// Each successful call must be balanced by a call to ole.CoUninitialize,
+// which WMI.Close makes for connections.
+func initializeCOM() error {
+	err := ole.CoInitializeEx(0, ole.COINIT_MULTITHREADED)
+	if err != nil {
+		oleerr, ok := err.(*ole.OleError)
+		if !ok {
+			return err
+		}
+		// CoInitialize already called
+		// https://msdn.microsoft.com/en-us/library/windows/desktop/ms695279%28v=vs.85%29.aspx
+		if oleerr.Code() != ole.S_OK && oleerr.Code() != 0x00000001 {
+			return err
+		}
+	}
+	return nil
+}
+
+func newConnection(params []interface{}) (*WMI, error) {
+	if err := initializeCOM(); err != nil {
+		return nil, err
+	}
+	unknown, err := oleutil.CreateObject("WbemScripting.SWbemLocator")
+	if err != nil {
+		ole.CoUninitialize()
+		return nil, err
+	}
+	qInterface, err := unknown.QueryInterface(ole.IID_IDispatch)
+	if err != nil {
+		unknown.Release()
+		ole.CoUninitialize()
+		return nil, err
+	}
+
+	rawSvc, err := oleutil.CallMethod(qInterface, "ConnectServer", params...)
+	if err != nil {
+		qInterface.Release()
+		unknown.Release()
+		ole.CoUninitialize()
+		return nil, errors.Wrap(err, "ConnectServer")
+	}
+	server, namespace := connectionTarget(params)
+	w := &WMI{
+		conn: &connState{
+			unknown:  unknown,
+			locator:  qInterface,
+			services: rawSvc.ToIDispatch(),
+			params:   params,
+		},
+		params: params,
+
+		Server:    server,
+		Namespace: namespace,
+	}
+	return w, nil
+}
@@ -6,3 +6,42 @@ const (
 	JobStatusRunning  = 4
 	JobStateCompleted = 7
 )
+
+// JobRequestTerminate is the state requested from a job through
+// RequestStateChange to cancel it
+const JobRequestTerminate uint16 = 4
+
+// Well known WMI namespaces
+const (
+	DefaultNamespace          = `root\cimv2`
+	VirtualizationV2Namespace = `root\virtualization\v2`
+	StandardCimV2Namespace    = `root\StandardCimv2`
+	StorageNamespace          = `root\Microsoft\Windows\Storage`
+)
+
+// WBEM status codes returned by the scripting API. See:
+// https://docs.microsoft.com/en-us/windows/win32/wmisdk/wmi-error-constants
+const (
+	WBEMFailed           uint32 = 0x80041001
+	WBEMNotFound         uint32 = 0x80041002
+	WBEMAccessDenied     uint32 = 0x80041003
+	WBEMInvalidNamespace uint32 = 0x8004100E
+	WBEMInvalidClass     uint32 = 0x80041010
+	WBEMAlreadyExists    uint32 = 0x80041019
+	WBEMTransportFailure uint32 = 0x80041015
+	WBEMCallCancelled    uint32 = 0x80041032
+)
+
+// RPC status codes returned when the connection to a WMI server drops
+const (
+	RPCDisconnected      uint32 = 0x80010108
+	RPCServerUnavailable uint32 = 0x800706BA
+	RPCCallFailed        uint32 = 0x800706BE
+)
+
+// SubclassesOf flags. See:
+// https://docs.microsoft.com/en-us/windows/win32/wmisdk/swbemservices-subclassesof
+const (
+	wbemQueryFlagDeep    = 0
+	wbemQueryFlagShallow = 1
+)
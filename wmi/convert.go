@@ -0,0 +1,248 @@
+package wmi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-ole/go-ole"
+	"github.com/pkg/errors"
+)
+
+// System properties added to the maps returned by ToMap
+const (
+	ClassProperty = "__CLASS"
+	PathProperty  = "__PATH"
+)
+
+// ToMap returns the properties of this object, keyed by name. The class
+// is stored under __CLASS and, for objects that have one, the object path
+// under __PATH. Other system properties are left out.
+//
+// Values are converted according to their CIM type: signed integers to
+// int64, unsigned integers to uint64, reals to float64, booleans to bool,
+// and strings, datetimes and references to string. Embedded objects are
+// converted to maps, and arrays to []interface{}. Null properties are nil.
+func (r *Result) ToMap() (map[string]interface{}, error) {
+	obj, err := r.cimObject()
+	if err != nil {
+		return nil, err
+	}
+	ret, err := obj.toMap()
+	if err != nil {
+		return nil, err
+	}
+	if pth, err := r.Path(); err == nil && pth != "" {
+		ret[PathProperty] = pth
+	}
+	return ret, nil
+}
+
+// cimObject returns the decoded CIM-XML representation of this object
+func (r *Result) cimObject() (*cimObject, error) {
+	text, err := r.GetText(1)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetText_")
+	}
+	return decodeCIMXML(text, nil)
+}
+
+func (c *cimObject) toMap() (map[string]interface{}, error) {
+	ret := map[string]interface{}{
+		ClassProperty: c.Class,
+	}
+	for _, prop := range c.Properties {
+		if strings.HasPrefix(prop.Name, "__") {
+			continue
+		}
+		val, err := prop.mapValue()
+		if err != nil {
+			return nil, errors.Wrap(err, prop.Name)
+		}
+		ret[prop.Name] = val
+	}
+	return ret, nil
+}
+
+// mapValue returns the value of this property, as ToMap returns it
+func (p *cimProperty) mapValue() (interface{}, error) {
+	if p.Null {
+		return nil, nil
+	}
+	if !p.IsArray {
+		return cimValue(p.Type, p.Text)
+	}
+	ret := make([]interface{}, len(p.Texts))
+	for idx, text := range p.Texts {
+		val, err := cimValue(p.Type, text)
+		if err != nil {
+			return nil, err
+		}
+		ret[idx] = val
+	}
+	return ret, nil
+}
+
+// cimValue converts the text form of a value of type cimType
+func cimValue(cimType, text string) (interface{}, error) {
+	switch strings.ToLower(cimType) {
+	case "boolean":
+		return strings.EqualFold(text, "true"), nil
+	case "sint8", "sint16", "sint32", "sint64":
+		return strconv.ParseInt(text, 10, 64)
+	case "uint8", "uint16", "uint32", "uint64":
+		return strconv.ParseUint(text, 10, 64)
+	case "real32", "real64":
+		return strconv.ParseFloat(text, 64)
+	case "object":
+		obj, err := decodeCIMXML(text, nil)
+		if err != nil {
+			return nil, err
+		}
+		return obj.toMap()
+	default:
+		return text, nil
+	}
+}
+
+// isObject returns true if this result holds a SWbemObject
+func (r *Result) isObject() bool {
+	if r.fake != nil {
+		return r.fake.kind == ResultObject
+	}
+	if r.dispatch() == nil {
+		return false
+	}
+	p, err := r.getProperty("Path_")
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// MarshalJSON implements json.Marshaler. Objects are encoded as the map
+// returned by ToMap, sets as an array of objects, and other values as
+// the value they hold.
+func (r *Result) MarshalJSON() ([]byte, error) {
+	if r == nil || (r.rawRes == nil && r.fake == nil) {
+		return []byte("null"), nil
+	}
+	if r.Raw().VT != ole.VT_DISPATCH {
+		if r.Raw().VT&ole.VT_ARRAY != 0 {
+			return json.Marshal(r.ToValueArray())
+		}
+		return json.Marshal(r.Value())
+	}
+	if r.isObject() {
+		m, err := r.ToMap()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(m)
+	}
+
+	elements, err := r.Elements()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseAll(elements)
+	ret := make([]map[string]interface{}, len(elements))
+	for idx, val := range elements {
+		m, err := val.ToMap()
+		if err != nil {
+			return nil, errors.Wrapf(err, "element %d", idx)
+		}
+		ret[idx] = m
+	}
+	return json.Marshal(ret)
+}
+
+// InstanceFromMap returns a new, unsaved instance of the class named by
+// the __CLASS value of values, with the other values set on it. Values
+// are converted to the CIM type of their property, so maps returned by
+// ToMap or decoded from JSON can be used. Maps held by properties of
+// type object are turned into embedded instances the same way. Call Put
+// to persist the instance.
+func (w *WMI) InstanceFromMap(values map[string]interface{}) (*Result, error) {
+	class, ok := values[ClassProperty].(string)
+	if !ok || class == "" {
+		return nil, fmt.Errorf("missing %s", ClassProperty)
+	}
+	instance, err := w.SpawnInstance(class)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.UpdateFromMap(instance, values); err != nil {
+		instance.Release()
+		return nil, err
+	}
+	return instance, nil
+}
+
+// UnmarshalInstance returns a new, unsaved instance built from the JSON
+// encoding of an object, as produced by MarshalJSON. See InstanceFromMap.
+func (w *WMI) UnmarshalInstance(data []byte) (*Result, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	values := map[string]interface{}{}
+	if err := dec.Decode(&values); err != nil {
+		return nil, errors.Wrap(err, "decoding instance")
+	}
+	return w.InstanceFromMap(values)
+}
+
+// UpdateFromMap sets the properties of obj to values. System properties,
+// such as __CLASS and __PATH, are ignored. Values are converted as
+// InstanceFromMap converts them.
+func (w *WMI) UpdateFromMap(obj *Result, values map[string]interface{}) error {
+	definition, err := obj.cimObject()
+	if err != nil {
+		return err
+	}
+	for name, val := range values {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		prop := definition.property(name)
+		if prop == nil {
+			return fmt.Errorf("%s has no property %s", definition.Class, name)
+		}
+		if res, ok := val.(*Result); ok {
+			if err := obj.Set(prop.Name, res); err != nil {
+				return errors.Wrapf(err, "setting %s", name)
+			}
+			continue
+		}
+		converted, err := w.propertyValue(prop, val)
+		if err != nil {
+			return errors.Wrapf(err, "converting %s", name)
+		}
+		err = obj.Set(prop.Name, converted)
+		if embedded, ok := converted.(*Result); ok {
+			embedded.Release()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "setting %s", name)
+		}
+	}
+	return nil
+}
+
+// propertyValue converts val to the type the scripting API expects
+// for prop.
+func (w *WMI) propertyValue(prop *cimProperty, val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	if prop.Type == "object" && !prop.IsArray {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an embedded object, got %T", val)
+		}
+		return w.InstanceFromMap(m)
+	}
+	return convertValue(prop.Type, prop.IsArray, val)
+}
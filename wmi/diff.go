@@ -0,0 +1,123 @@
+package wmi
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Change is a property that differs between two objects
+type Change struct {
+	// Property is the name of the property. Properties of embedded
+	// objects are prefixed with the name of the property holding the
+	// object and a dot, as in "Settings.ElementName".
+	Property string
+	// Old and New are the values of the property in the first and the
+	// second object. A property missing from one of the objects is nil.
+	Old interface{}
+	New interface{}
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Property, c.Old, c.New)
+}
+
+// Diff returns the properties that differ between a and b, sorted by
+// name. Values are compared as ToMap returns them. Arrays differ if any
+// of their elements do, and are reported as a whole. Embedded objects of
+// the same class are compared property by property, and reported as a
+// whole if their class differs. System properties are not compared.
+func Diff(a, b *Result) ([]Change, error) {
+	am, err := a.ToMap()
+	if err != nil {
+		return nil, errors.Wrap(err, "converting first object")
+	}
+	bm, err := b.ToMap()
+	if err != nil {
+		return nil, errors.Wrap(err, "converting second object")
+	}
+	return diffMaps("", am, bm), nil
+}
+
+func diffMaps(prefix string, a, b map[string]interface{}) []Change {
+	names := map[string]bool{}
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !strings.HasPrefix(name, "__") {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	ret := []Change{}
+	for _, name := range sorted {
+		av, bv := a[name], b[name]
+		aObj, aok := av.(map[string]interface{})
+		bObj, bok := bv.(map[string]interface{})
+		if aok && bok && aObj[ClassProperty] == bObj[ClassProperty] {
+			ret = append(ret, diffMaps(prefix+name+".", aObj, bObj)...)
+			continue
+		}
+		if !reflect.DeepEqual(av, bv) {
+			ret = append(ret, Change{Property: prefix + name, Old: av, New: bv})
+		}
+	}
+	return ret
+}
+
+// DiffStructs returns the fields that differ between a and b, which must
+// be structs, or pointers to structs, of the same type, such as those
+// filled by PopulateStruct. Fields are compared as Diff compares
+// properties: nested structs field by field, and slices as a whole.
+// Unexported fields and fields tagged `tag:"ignore"` are skipped.
+func DiffStructs(a, b interface{}) ([]Change, error) {
+	av, bv := reflect.Indirect(reflect.ValueOf(a)), reflect.Indirect(reflect.ValueOf(b))
+	if !av.IsValid() || !bv.IsValid() {
+		return nil, fmt.Errorf("cannot compare nil values")
+	}
+	if av.Type() != bv.Type() {
+		return nil, fmt.Errorf("cannot compare %s with %s", av.Type(), bv.Type())
+	}
+	if av.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not a struct", av.Type())
+	}
+	return diffStructs("", av, bv), nil
+}
+
+func diffStructs(prefix string, a, b reflect.Value) []Change {
+	ret := []Change{}
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("tag") == "ignore" {
+			continue
+		}
+		name := prefix + field.Name
+		af, bf := a.Field(i), b.Field(i)
+		if embeddedType(field.Type) != nil && field.Type.Kind() != reflect.Slice {
+			if field.Type.Kind() == reflect.Ptr {
+				if !af.IsNil() && !bf.IsNil() {
+					ret = append(ret, diffStructs(name+".", af.Elem(), bf.Elem())...)
+					continue
+				}
+			} else {
+				ret = append(ret, diffStructs(name+".", af, bf)...)
+				continue
+			}
+		}
+		if !reflect.DeepEqual(af.Interface(), bf.Interface()) {
+			ret = append(ret, Change{Property: name, Old: af.Interface(), New: bf.Interface()})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Property < ret[j].Property })
+	return ret
+}
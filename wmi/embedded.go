@@ -0,0 +1,87 @@
+package wmi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ole/go-ole"
+	"github.com/pkg/errors"
+)
+
+// errDetached is returned when calling methods on embedded objects
+// decoded from text, which are not bound to a connection.
+var errDetached = errors.New("object decoded from text is not bound to a connection")
+
+// Embedded returns the embedded object held by the property name, or nil
+// if the property is null. Embedded instances that WMI hands out as CIM-XML
+// text, such as the errors of Msvm_ConcreteJob.GetErrorEx, are decoded.
+// Their properties can be read, but no methods can be called on them.
+func (r *Result) Embedded(name string) (*Result, error) {
+	prop, err := r.GetProperty(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetProperty(%s)", name)
+	}
+	switch prop.Raw().VT {
+	case ole.VT_DISPATCH:
+		return prop, nil
+	case ole.VT_NULL, ole.VT_EMPTY:
+		prop.Release()
+		return nil, nil
+	case ole.VT_BSTR:
+		text, _ := prop.Value().(string)
+		prop.Release()
+		return r.decodeEmbedded(name, text)
+	}
+	prop.Release()
+	return nil, fmt.Errorf("%s does not hold an embedded object", name)
+}
+
+// EmbeddedArray returns the embedded objects held by the array property
+// name, or nil if the property is null. The objects are decoded from the
+// CIM-XML representation of this object, so, as for embedded instances
+// held as text, no methods can be called on them.
+func (r *Result) EmbeddedArray(name string) ([]*Result, error) {
+	obj, err := r.cimObject()
+	if err != nil {
+		return nil, err
+	}
+	prop := obj.property(name)
+	if prop == nil {
+		return nil, fmt.Errorf("%s has no property %s", obj.Class, name)
+	}
+	if prop.Null {
+		return nil, nil
+	}
+	texts := prop.Texts
+	if !prop.IsArray {
+		texts = []string{prop.Text}
+	}
+	ret := make([]*Result, 0, len(texts))
+	for _, text := range texts {
+		item, err := r.decodeEmbedded(name, text)
+		if err != nil {
+			releaseAll(ret)
+			return nil, err
+		}
+		ret = append(ret, item)
+	}
+	return ret, nil
+}
+
+// decodeEmbedded returns the embedded instance encoded in text, as a
+// *Result owned by the same session as r.
+func (r *Result) decodeEmbedded(name, text string) (*Result, error) {
+	if !strings.HasPrefix(strings.TrimSpace(text), "<") {
+		return nil, fmt.Errorf("%s does not hold an embedded object", name)
+	}
+	obj, err := decodeCIMXML(text, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding %s", name)
+	}
+	val := &replayValue{
+		kind:   ResultObject,
+		vt:     ole.VT_DISPATCH,
+		object: obj,
+	}
+	return r.replayChild(val), nil
+}
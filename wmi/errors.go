@@ -1,6 +1,45 @@
 package wmi
 
-import "errors"
+import (
+	"github.com/go-ole/go-ole"
+	"github.com/pkg/errors"
+)
 
 // ErrNotFound is returned when the query yielded no results
 var ErrNotFound = errors.New("Query returned empty set")
+
+// ErrNotSupported is returned by COM entry points on platforms other
+// than Windows
+var ErrNotSupported = errors.New("WMI is only supported on Windows")
+
+// ErrAlreadyExists is returned when creating an instance that already exists
+var ErrAlreadyExists = errors.New("Instance already exists")
+
+// HResult returns the status code of a failed COM call. When the call
+// raised an exception, the SCODE of the exception is returned instead of
+// the generic DISP_E_EXCEPTION, which is where WMI places its WBEM status.
+func HResult(err error) (uint32, bool) {
+	oleErr, ok := errors.Cause(err).(*ole.OleError)
+	if !ok {
+		return 0, false
+	}
+	if excep, ok := oleErr.SubError().(ole.EXCEPINFO); ok && excep.SCODE() != 0 {
+		return excep.SCODE(), true
+	}
+	return uint32(oleErr.Code()), true
+}
+
+// IsHResult returns true if err was caused by a COM call that
+// failed with one of the supplied status codes.
+func IsHResult(err error, codes ...uint32) bool {
+	hr, ok := HResult(err)
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if hr == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,547 @@
+package wmi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-ole/go-ole"
+	"github.com/pkg/errors"
+)
+
+// fixtureVersion is the version of the fixture format written by Recorder
+const fixtureVersion = 1
+
+// Operations recorded in a fixture
+const (
+	// OpConnect is a connection to a namespace
+	OpConnect = "connect"
+	// OpService is a call on a SWbemServices connection
+	OpService = "service"
+	// OpObject is a call on a SWbemObject, including method calls
+	// made through Result.Call
+	OpObject = "object"
+	// OpKeys is a call to WMI.KeyProperties
+	OpKeys = "keys"
+)
+
+// Kinds of recorded results
+const (
+	ResultNull   = "null"
+	ResultValue  = "value"
+	ResultObject = "object"
+	ResultSet    = "set"
+	ResultPath   = "path"
+	ResultOpaque = "opaque"
+	ResultKeys   = "keys"
+)
+
+// Fixture holds the WMI traffic captured by a Recorder. It is
+// stored as JSON, with objects serialized as CIM-XML.
+type Fixture struct {
+	Version int            `json:"version"`
+	Entries []FixtureEntry `json:"entries"`
+}
+
+// FixtureEntry is a single recorded call
+type FixtureEntry struct {
+	// Op is one of OpConnect, OpService, OpObject or OpKeys
+	Op string `json:"op"`
+	// Namespace is the namespace of the connection the call was made on
+	Namespace string `json:"namespace,omitempty"`
+	// Target identifies what the call was made on: the server for
+	// OpConnect, the class for OpKeys and, for OpObject, the object
+	// path or the class name of objects without a path.
+	Target string `json:"target,omitempty"`
+	// Method is the SWbem method that was called
+	Method string `json:"method"`
+	// Args holds the canonical form of the call arguments
+	Args []string `json:"args,omitempty"`
+	// In holds the in parameters of methods called through Result.Call
+	In map[string]string `json:"in,omitempty"`
+
+	Result *FixtureResult `json:"result,omitempty"`
+	Error  *FixtureError  `json:"error,omitempty"`
+}
+
+// FixtureResult is the recorded outcome of a successful call
+type FixtureResult struct {
+	Kind    string          `json:"kind"`
+	Value   *FixtureValue   `json:"value,omitempty"`
+	Objects []FixtureObject `json:"objects,omitempty"`
+	Path    *FixturePath    `json:"path,omitempty"`
+	Keys    []string        `json:"keys,omitempty"`
+}
+
+// FixtureValue is a recorded VARIANT holding a scalar or an array
+type FixtureValue struct {
+	VT     uint16   `json:"vt"`
+	Value  string   `json:"value,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+// FixtureObject is a recorded class or instance
+type FixtureObject struct {
+	Path string `json:"path,omitempty"`
+	// XML is the CIM-XML representation returned by GetText_
+	XML string `json:"xml"`
+	// Types holds the VARIANT type WMI used for each non null property
+	Types map[string]uint16 `json:"types,omitempty"`
+}
+
+// FixturePath is a recorded SWbemObjectPath
+type FixturePath struct {
+	Path      string `json:"path"`
+	RelPath   string `json:"relPath"`
+	Class     string `json:"class"`
+	Namespace string `json:"namespace"`
+	Server    string `json:"server"`
+}
+
+// FixtureError is a recorded call failure
+type FixtureError struct {
+	Message string `json:"message"`
+	HResult uint32 `json:"hresult,omitempty"`
+}
+
+// ReadFixture decodes a fixture from r
+func ReadFixture(r io.Reader) (*Fixture, error) {
+	f := &Fixture{}
+	if err := json.NewDecoder(r).Decode(f); err != nil {
+		return nil, errors.Wrap(err, "decoding fixture")
+	}
+	if f.Version != fixtureVersion {
+		return nil, fmt.Errorf("unsupported fixture version %d", f.Version)
+	}
+	return f, nil
+}
+
+// LoadFixture reads the fixture file at path
+func LoadFixture(path string) (*Fixture, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening fixture")
+	}
+	defer fd.Close()
+	return ReadFixture(fd)
+}
+
+// Write encodes this fixture as JSON to w
+func (f *Fixture) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.Wrap(enc.Encode(f), "encoding fixture")
+}
+
+// WriteFile writes this fixture to path
+func (f *Fixture) WriteFile(path string) error {
+	fd, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "creating fixture")
+	}
+	if err := f.Write(fd); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+var (
+	fixtureLock     sync.Mutex
+	activeRecorder  *Recorder
+	activeReplayer  *Replayer
+	setMethodsNames = map[string]bool{
+		"execquery":     true,
+		"subclassesof":  true,
+		"instancesof":   true,
+		"associatorsof": true,
+		"referencesto":  true,
+		"associators_":  true,
+		"references_":   true,
+		"instances_":    true,
+		"subclasses_":   true,
+	}
+)
+
+// Recorder captures the WMI traffic of this process into a Fixture.
+// Queries, object retrieval, method calls made through Result.Call and
+// the job polling done by WaitForJob are all recorded. Methods called
+// with *ole.VARIANT out parameters, refreshers and asynchronous queries
+// are not recorded in a way that can be replayed.
+type Recorder struct {
+	lock    sync.Mutex
+	entries []FixtureEntry
+}
+
+// StartRecording starts recording all WMI calls made by this process
+// and returns the active *Recorder. Recording cannot be combined with
+// replay.
+func StartRecording() (*Recorder, error) {
+	fixtureLock.Lock()
+	defer fixtureLock.Unlock()
+	if activeReplayer != nil {
+		return nil, fmt.Errorf("replay is active")
+	}
+	if activeRecorder != nil {
+		return nil, fmt.Errorf("recording is already active")
+	}
+	activeRecorder = &Recorder{}
+	return activeRecorder, nil
+}
+
+// Stop stops recording. Calls made afterwards are no longer captured.
+func (r *Recorder) Stop() {
+	fixtureLock.Lock()
+	defer fixtureLock.Unlock()
+	if activeRecorder == r {
+		activeRecorder = nil
+	}
+}
+
+// Fixture returns the calls recorded so far
+func (r *Recorder) Fixture() *Fixture {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entries := make([]FixtureEntry, len(r.entries))
+	copy(entries, r.entries)
+	return &Fixture{
+		Version: fixtureVersion,
+		Entries: entries,
+	}
+}
+
+func (r *Recorder) add(entry FixtureEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries = append(r.entries, entry)
+}
+
+// record adds the outcome of a call to this recording
+func (r *Recorder) record(entry FixtureEntry, res *Result, err error) {
+	if err != nil {
+		entry.Error = fixtureError(err)
+	} else {
+		entry.Result = snapshot(entry.Method, res)
+	}
+	r.add(entry)
+}
+
+// recordConnect records a connection attempt, if recording is active
+func recordConnect(params []interface{}, err error) {
+	rec := recorder()
+	if rec == nil {
+		return
+	}
+	server, namespace := connectionTarget(params)
+	entry := FixtureEntry{
+		Op:        OpConnect,
+		Namespace: namespace,
+		Target:    server,
+		Method:    "ConnectServer",
+	}
+	if err != nil {
+		entry.Error = fixtureError(err)
+	}
+	rec.add(entry)
+}
+
+func recorder() *Recorder {
+	fixtureLock.Lock()
+	defer fixtureLock.Unlock()
+	return activeRecorder
+}
+
+// Replayer serves the calls recorded in a Fixture. While a Replayer is
+// active, NewConnection returns connections backed by the fixture, which
+// do not need COM and work on any platform. Calls are matched by their
+// namespace, target, method and arguments and, for method calls, by their
+// in parameters. Identical calls are served
+// in recording order, and the last recorded answer is repeated once
+// they are exhausted.
+type Replayer struct {
+	lock   sync.Mutex
+	queues map[string][]*FixtureEntry
+}
+
+// StartReplay makes NewConnection serve connections backed by fixture,
+// until the returned *Replayer is stopped.
+func StartReplay(fixture *Fixture) (*Replayer, error) {
+	fixtureLock.Lock()
+	defer fixtureLock.Unlock()
+	if activeRecorder != nil {
+		return nil, fmt.Errorf("recording is active")
+	}
+	if activeReplayer != nil {
+		return nil, fmt.Errorf("replay is already active")
+	}
+	r := &Replayer{
+		queues: map[string][]*FixtureEntry{},
+	}
+	for idx := range fixture.Entries {
+		entry := &fixture.Entries[idx]
+		key := entryKey(entry.Op, entry.Namespace, entry.Target, entry.Method, entry.Args, entry.In)
+		r.queues[key] = append(r.queues[key], entry)
+	}
+	activeReplayer = r
+	return r, nil
+}
+
+// Stop ends the replay. Connections opened during the replay keep
+// serving their fixture.
+func (r *Replayer) Stop() {
+	fixtureLock.Lock()
+	defer fixtureLock.Unlock()
+	if activeReplayer == r {
+		activeReplayer = nil
+	}
+}
+
+func replayer() *Replayer {
+	fixtureLock.Lock()
+	defer fixtureLock.Unlock()
+	return activeReplayer
+}
+
+// next returns the recorded answer for the call identified by key
+func (r *Replayer) next(key string) (*FixtureEntry, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	queue := r.queues[key]
+	if len(queue) == 0 {
+		return nil, fmt.Errorf("no recorded call matches %s", key)
+	}
+	entry := queue[0]
+	if len(queue) > 1 {
+		r.queues[key] = queue[1:]
+	}
+	return entry, nil
+}
+
+// entryKey returns the key under which a call is matched. The in
+// parameters of method calls are part of the key, so a call made with
+// other values than the recorded ones does not match.
+func entryKey(op, namespace, target, method string, args []string, in map[string]string) string {
+	key := fmt.Sprintf("%s|%s|%s|%s(%s)",
+		op, strings.ToLower(namespace), target, strings.ToLower(method), strings.Join(args, ","))
+	if len(in) == 0 {
+		return key
+	}
+	params := make([]string, 0, len(in))
+	for name, val := range in {
+		params = append(params, fmt.Sprintf("%s=%s", strings.ToLower(name), val))
+	}
+	sort.Strings(params)
+	return key + "{" + strings.Join(params, ";") + "}"
+}
+
+// canonicalArg returns the form of a call argument stored in a fixture
+func canonicalArg(arg interface{}) string {
+	switch val := arg.(type) {
+	case nil:
+		return "nil"
+	case *ole.IDispatch:
+		return "<object>"
+	case *ole.VARIANT:
+		return "<variant>"
+	case string:
+		return strconv.Quote(val)
+	default:
+		return fmt.Sprintf("%T(%v)", val, val)
+	}
+}
+
+func canonicalArgs(args []interface{}) []string {
+	ret := make([]string, len(args))
+	for idx, val := range args {
+		ret[idx] = canonicalArg(val)
+	}
+	return ret
+}
+
+// canonicalIn returns the form of the in parameters of a method call
+// stored in a fixture
+func canonicalIn(in map[string]interface{}) map[string]string {
+	if len(in) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(in))
+	for name, val := range in {
+		ret[name] = canonicalInValue(val)
+	}
+	return ret
+}
+
+// canonicalInValue returns the form of an in parameter stored in a
+// fixture. Embedded instances are stored as re-encoded by this package,
+// so the text WMI produced when recording matches the text produced
+// from the fixture when replaying.
+func canonicalInValue(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "nil"
+	case *Result:
+		return fmt.Sprintf("<object %s>", v.identity())
+	case string:
+		if strings.HasPrefix(strings.TrimSpace(v), "<") {
+			if obj, err := decodeCIMXML(v, nil); err == nil {
+				return obj.encode()
+			}
+		}
+		return v
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice {
+		return fmt.Sprintf("%v", val)
+	}
+	items := make([]string, rv.Len())
+	for i := range items {
+		items[i] = canonicalInValue(rv.Index(i).Interface())
+	}
+	return "[" + strings.Join(items, " ") + "]"
+}
+
+// fixtureError converts err to its recorded form
+func fixtureError(err error) *FixtureError {
+	ret := &FixtureError{Message: err.Error()}
+	if hr, ok := HResult(err); ok {
+		ret.HResult = hr
+	}
+	return ret
+}
+
+// err rebuilds the recorded error. HResult and IsHResult work on
+// the returned error as they did on the recorded one.
+func (f *FixtureError) err() error {
+	if f.HResult == 0 {
+		return errors.New(f.Message)
+	}
+	return ole.NewErrorWithDescription(uintptr(f.HResult), f.Message)
+}
+
+// snapshotValue records a VARIANT that does not hold an object
+func snapshotValue(v *ole.VARIANT) *FixtureResult {
+	if v == nil || v.VT == ole.VT_NULL || v.VT == ole.VT_EMPTY {
+		return &FixtureResult{Kind: ResultNull}
+	}
+	ret := &FixtureValue{VT: uint16(v.VT)}
+	if arr := v.ToArray(); arr != nil {
+		if vt, err := arr.GetType(); err == nil {
+			ret.VT = vt | uint16(ole.VT_ARRAY)
+		}
+		values := arr.ToValueArray()
+		ret.Values = make([]string, len(values))
+		for idx, val := range values {
+			ret.Values[idx] = fmt.Sprintf("%v", val)
+		}
+	} else {
+		ret.Value = fmt.Sprintf("%v", v.Value())
+	}
+	return &FixtureResult{Kind: ResultValue, Value: ret}
+}
+
+// snapshotObject records a SWbemObject
+func snapshotObject(r *Result) (FixtureObject, error) {
+	text, err := r.GetText(1)
+	if err != nil {
+		return FixtureObject{}, errors.Wrap(err, "GetText_")
+	}
+	ret := FixtureObject{
+		XML:   text,
+		Types: map[string]uint16{},
+	}
+	if pth, err := r.Path(); err == nil {
+		ret.Path = pth
+	}
+	props, err := r.properties()
+	if err != nil {
+		return FixtureObject{}, err
+	}
+	defer releaseAll(props)
+	for _, prop := range props {
+		name, err := prop.GetProperty("Name")
+		if err != nil {
+			return FixtureObject{}, errors.Wrap(err, "Name")
+		}
+		nameStr, _ := name.Value().(string)
+		name.Release()
+		val, err := prop.GetProperty("Value")
+		if err != nil {
+			return FixtureObject{}, errors.Wrap(err, "Value")
+		}
+		vt := val.Raw().VT
+		val.Release()
+		if vt == ole.VT_NULL || vt == ole.VT_EMPTY {
+			continue
+		}
+		ret.Types[nameStr] = uint16(vt)
+	}
+	return ret, nil
+}
+
+// snapshotPath records a SWbemObjectPath
+func snapshotPath(r *Result) (*FixturePath, error) {
+	ret := &FixturePath{}
+	fields := map[string]*string{
+		"Path":      &ret.Path,
+		"RelPath":   &ret.RelPath,
+		"Class":     &ret.Class,
+		"Namespace": &ret.Namespace,
+		"Server":    &ret.Server,
+	}
+	for name, field := range fields {
+		val, err := r.GetProperty(name)
+		if err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+		*field, _ = val.Value().(string)
+		val.Release()
+	}
+	return ret, nil
+}
+
+// snapshot records the result of method. Objects that cannot be
+// serialized are recorded as opaque, and fail when used in a replay.
+func snapshot(method string, r *Result) *FixtureResult {
+	if r == nil || r.rawRes == nil {
+		return &FixtureResult{Kind: ResultNull}
+	}
+	if r.rawRes.VT != ole.VT_DISPATCH {
+		return snapshotValue(r.rawRes)
+	}
+
+	switch {
+	case setMethodsNames[strings.ToLower(method)]:
+		elements, err := r.Elements()
+		if err != nil {
+			return &FixtureResult{Kind: ResultOpaque}
+		}
+		defer releaseAll(elements)
+		ret := &FixtureResult{Kind: ResultSet, Objects: []FixtureObject{}}
+		for _, val := range elements {
+			obj, err := snapshotObject(val)
+			if err != nil {
+				return &FixtureResult{Kind: ResultOpaque}
+			}
+			ret.Objects = append(ret.Objects, obj)
+		}
+		return ret
+	case strings.EqualFold(method, "Put_"):
+		pth, err := snapshotPath(r)
+		if err != nil {
+			return &FixtureResult{Kind: ResultOpaque}
+		}
+		return &FixtureResult{Kind: ResultPath, Path: pth}
+	}
+
+	obj, err := snapshotObject(r)
+	if err != nil {
+		return &FixtureResult{Kind: ResultOpaque}
+	}
+	return &FixtureResult{Kind: ResultObject, Objects: []FixtureObject{obj}}
+}
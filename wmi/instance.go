@@ -0,0 +1,272 @@
+package wmi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	"github.com/pkg/errors"
+)
+
+// PutFlag controls whether Put creates or updates an instance. See:
+// https://docs.microsoft.com/en-us/windows/win32/wmisdk/swbemobject-put-
+type PutFlag int
+
+// Put_ flags
+const (
+	// PutCreateOrUpdate creates the instance if it does not exist,
+	// or updates it if it does.
+	PutCreateOrUpdate PutFlag = 0
+	// PutUpdateOnly only updates an existing instance. ErrNotFound
+	// is returned if the instance does not exist.
+	PutUpdateOnly PutFlag = 1
+	// PutCreateOnly only creates a new instance. ErrAlreadyExists
+	// is returned if the instance already exists.
+	PutCreateOnly PutFlag = 2
+)
+
+// SpawnInstance returns a new, unsaved instance of class. Set its
+// properties and call Put to persist it.
+func (w *WMI) SpawnInstance(class string) (*Result, error) {
+	classObj, err := w.Get(class)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting class %s", class)
+	}
+	defer classObj.Release()
+	instance, err := classObj.Get("SpawnInstance_")
+	if err != nil {
+		return nil, errors.Wrap(err, "SpawnInstance_")
+	}
+	return instance, nil
+}
+
+// Put writes this instance to WMI and returns its path. Use flags to
+// restrict the write to creating or to updating an instance.
+func (r *Result) Put(flags PutFlag) (string, error) {
+	objPath, err := r.Get("Put_", int(flags))
+	if err != nil {
+		switch {
+		case flags == PutCreateOnly && IsHResult(err, WBEMAlreadyExists):
+			return "", ErrAlreadyExists
+		case flags == PutUpdateOnly && IsHResult(err, WBEMNotFound):
+			return "", ErrNotFound
+		}
+		return "", errors.Wrap(err, "Put_")
+	}
+	defer objPath.Release()
+	pth, err := objPath.GetProperty("Path")
+	if err != nil {
+		return "", errors.Wrap(err, "Path")
+	}
+	defer pth.Release()
+	val, ok := pth.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("Put_ returned an invalid path")
+	}
+	return val, nil
+}
+
+// Delete removes this instance from WMI
+func (r *Result) Delete() error {
+	ret, err := r.Get("Delete_")
+	if err != nil {
+		if IsHResult(err, WBEMNotFound) {
+			return ErrNotFound
+		}
+		return errors.Wrap(err, "Delete_")
+	}
+	ret.Release()
+	return nil
+}
+
+// Refresh updates the properties of this instance with
+// their current values in WMI.
+func (r *Result) Refresh() error {
+	ret, err := r.Get("Refresh_")
+	if err != nil {
+		if IsHResult(err, WBEMNotFound) {
+			return ErrNotFound
+		}
+		return errors.Wrap(err, "Refresh_")
+	}
+	ret.Release()
+	return nil
+}
+
+// properties returns the SWbemProperty objects of this object
+func (r *Result) properties() ([]*Result, error) {
+	props, err := r.GetProperty("Properties_")
+	if err != nil {
+		return nil, errors.Wrap(err, "Properties_")
+	}
+	defer props.Release()
+	disp := props.dispatch()
+	if disp == nil {
+		return nil, fmt.Errorf("Object is not callable")
+	}
+	ret := []*Result{}
+	err = oleutil.ForEach(disp, func(v *ole.VARIANT) error {
+		item := *v
+		ret = append(ret, r.child(&item))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "enumerating Properties_")
+	}
+	return ret, nil
+}
+
+// hasQualifier returns true if the SWbemProperty in prop
+// is decorated with qualifier.
+func hasQualifier(prop *Result, qualifier string) (bool, error) {
+	qualifiers, err := prop.GetProperty("Qualifiers_")
+	if err != nil {
+		return false, errors.Wrap(err, "Qualifiers_")
+	}
+	defer qualifiers.Release()
+	item, err := qualifiers.invoke("Item", qualifier)
+	if err != nil {
+		if IsHResult(err, WBEMNotFound) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "Qualifiers_.Item(%s)", qualifier)
+	}
+	item.Release()
+	return true, nil
+}
+
+// KeyProperties returns the names of the Key qualified properties of class
+func (w *WMI) KeyProperties(class string) ([]string, error) {
+	if w.replay != nil {
+		return w.replay.keyProperties(w.Namespace, class)
+	}
+	ret, err := w.keyProperties(class)
+	if rec := recorder(); rec != nil {
+		entry := FixtureEntry{
+			Op:        OpKeys,
+			Namespace: w.Namespace,
+			Target:    class,
+			Method:    "KeyProperties",
+		}
+		if err != nil {
+			entry.Error = fixtureError(err)
+		} else {
+			entry.Result = &FixtureResult{Kind: ResultKeys, Keys: ret}
+		}
+		rec.add(entry)
+	}
+	return ret, err
+}
+
+func (w *WMI) keyProperties(class string) ([]string, error) {
+	services, err := w.conn.servicesObject()
+	if err != nil {
+		return nil, err
+	}
+	defer services.Release()
+	rawClass, err := oleutil.CallMethod(services, "Get", class)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting class %s", class)
+	}
+	classObj := w.newResult(rawClass)
+	defer classObj.Release()
+	props, err := classObj.properties()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseAll(props)
+	ret := []string{}
+	for _, prop := range props {
+		isKey, err := hasQualifier(prop, "key")
+		if err != nil {
+			return nil, err
+		}
+		if !isKey {
+			continue
+		}
+		name, err := prop.GetProperty("Name")
+		if err != nil {
+			return nil, errors.Wrap(err, "Name")
+		}
+		ret = append(ret, name.Value().(string))
+		name.Release()
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// escapePathValue formats val for use as a key value in an object path
+func escapePathValue(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case string:
+		escaped := strings.Replace(v, `\`, `\\`, -1)
+		escaped = strings.Replace(escaped, `"`, `\"`, -1)
+		return fmt.Sprintf(`"%s"`, escaped), nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", v), nil
+	default:
+		return "", fmt.Errorf("Invalid key value type %T", val)
+	}
+}
+
+// ObjectPath returns the relative object path of the instance of class
+// identified by keys. All Key qualified properties of the class must be
+// present in keys.
+func (w *WMI) ObjectPath(class string, keys map[string]interface{}) (string, error) {
+	keyNames, err := w.KeyProperties(class)
+	if err != nil {
+		return "", errors.Wrap(err, "KeyProperties")
+	}
+	if len(keyNames) == 0 {
+		if len(keys) > 0 {
+			return "", fmt.Errorf("%s is a singleton and has no keys", class)
+		}
+		return class + "=@", nil
+	}
+
+	lookup := make(map[string]interface{}, len(keys))
+	for name, val := range keys {
+		lookup[strings.ToLower(name)] = val
+	}
+	if len(lookup) != len(keyNames) {
+		return "", fmt.Errorf("%s requires keys %v, got %d", class, keyNames, len(keys))
+	}
+
+	parts := make([]string, len(keyNames))
+	for idx, name := range keyNames {
+		val, ok := lookup[strings.ToLower(name)]
+		if !ok {
+			return "", fmt.Errorf("missing key %s for class %s", name, class)
+		}
+		escaped, err := escapePathValue(val)
+		if err != nil {
+			return "", errors.Wrap(err, name)
+		}
+		parts[idx] = fmt.Sprintf("%s=%s", name, escaped)
+	}
+	return fmt.Sprintf("%s.%s", class, strings.Join(parts, ",")), nil
+}
+
+// GetByKeys returns the instance of class identified by keys, using this
+// connection. ErrNotFound is returned if no such instance exists.
+func (w *WMI) GetByKeys(class string, keys map[string]interface{}) (*Result, error) {
+	pth, err := w.ObjectPath(class, keys)
+	if err != nil {
+		return nil, err
+	}
+	result, err := w.Get(pth)
+	if err != nil {
+		if IsHResult(err, WBEMNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "getting %s", pth)
+	}
+	return result, nil
+}
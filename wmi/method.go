@@ -0,0 +1,410 @@
+package wmi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-ole/go-ole"
+	"github.com/pkg/errors"
+)
+
+// ReturnCode is the value returned by a WMI method
+type ReturnCode uint32
+
+// Method return codes used by CIM and Hyper-V classes. See:
+// https://docs.microsoft.com/en-us/windows/win32/hyperv_v2/msvm-virtualsystemmanagementservice
+const (
+	ReturnCompleted         ReturnCode = 0
+	ReturnJobStarted        ReturnCode = JobStatusStarted
+	ReturnFailed            ReturnCode = 32768
+	ReturnAccessDenied      ReturnCode = 32769
+	ReturnNotSupported      ReturnCode = 32770
+	ReturnStatusUnknown     ReturnCode = 32771
+	ReturnTimeout           ReturnCode = 32772
+	ReturnInvalidParameter  ReturnCode = 32773
+	ReturnSystemInUse       ReturnCode = 32774
+	ReturnInvalidState      ReturnCode = 32775
+	ReturnIncorrectDataType ReturnCode = 32776
+	ReturnSystemUnavailable ReturnCode = 32777
+	ReturnOutOfMemory       ReturnCode = 32778
+	ReturnFileNotFound      ReturnCode = 32779
+)
+
+var returnCodeNames = map[ReturnCode]string{
+	ReturnCompleted:         "Completed with No Error",
+	ReturnJobStarted:        "Method Parameters Checked - Job Started",
+	ReturnFailed:            "Failed",
+	ReturnAccessDenied:      "Access Denied",
+	ReturnNotSupported:      "Not Supported",
+	ReturnStatusUnknown:     "Status is unknown",
+	ReturnTimeout:           "Timeout",
+	ReturnInvalidParameter:  "Invalid parameter",
+	ReturnSystemInUse:       "System is in use",
+	ReturnInvalidState:      "Invalid state for this operation",
+	ReturnIncorrectDataType: "Incorrect data type",
+	ReturnSystemUnavailable: "System is not available",
+	ReturnOutOfMemory:       "Out of memory",
+	ReturnFileNotFound:      "File not found",
+}
+
+func (r ReturnCode) String() string {
+	if name, ok := returnCodeNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown return code %d", uint32(r))
+}
+
+// MethodError is returned when a WMI method completes with
+// a non zero return value
+type MethodError struct {
+	Method string
+	Code   ReturnCode
+}
+
+func (m *MethodError) Error() string {
+	return fmt.Sprintf("%s failed: %s (%d)", m.Method, m.Code, uint32(m.Code))
+}
+
+// Outputs holds the out parameters of a method called through Result.Call
+type Outputs struct {
+	method string
+	res    *Result
+	// namespace and classes are the cache entries the call affected,
+	// invalidated again once the job it started completes.
+	namespace string
+	classes   []string
+}
+
+// Result returns the raw out parameters object. It is nil if the
+// method has no out parameters.
+func (o Outputs) Result() *Result {
+	return o.res
+}
+
+// Value returns the raw value of the out parameter name
+func (o Outputs) Value(name string) (interface{}, error) {
+	if o.res == nil {
+		return nil, fmt.Errorf("%s has no out parameters", o.method)
+	}
+	prop, err := o.res.GetProperty(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetProperty(%s)", name)
+	}
+	defer prop.Release()
+	return prop.Value(), nil
+}
+
+// ReturnValue returns the decoded ReturnValue of the method
+func (o Outputs) ReturnValue() (ReturnCode, error) {
+	val, err := o.Int("ReturnValue")
+	if err != nil {
+		return 0, err
+	}
+	return ReturnCode(val), nil
+}
+
+// String returns the out parameter name as a string
+func (o Outputs) String(name string) (string, error) {
+	val, err := o.Value(name)
+	if err != nil {
+		return "", err
+	}
+	if val == nil {
+		return "", nil
+	}
+	asString, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is not a string (%T)", name, val)
+	}
+	return asString, nil
+}
+
+// Strings returns the out parameter name as a []string
+func (o Outputs) Strings(name string) ([]string, error) {
+	if o.res == nil {
+		return nil, fmt.Errorf("%s has no out parameters", o.method)
+	}
+	prop, err := o.res.GetProperty(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetProperty(%s)", name)
+	}
+	defer prop.Release()
+	values := prop.ToValueArray()
+	ret := make([]string, len(values))
+	for idx, val := range values {
+		asString, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a string array (%T)", name, val)
+		}
+		ret[idx] = asString
+	}
+	return ret, nil
+}
+
+// Bytes returns the out parameter name as a []byte. Use this for
+// out parameters of type uint8[].
+func (o Outputs) Bytes(name string) ([]byte, error) {
+	if o.res == nil {
+		return nil, fmt.Errorf("%s has no out parameters", o.method)
+	}
+	prop, err := o.res.GetProperty(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetProperty(%s)", name)
+	}
+	defer prop.Release()
+	values := prop.ToValueArray()
+	ret := make([]byte, len(values))
+	for idx, val := range values {
+		asByte, ok := val.(uint8)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a byte array (%T)", name, val)
+		}
+		ret[idx] = asByte
+	}
+	return ret, nil
+}
+
+// Int returns the out parameter name as an int64. 64 bit integers,
+// which WMI returns as strings, are converted as well.
+func (o Outputs) Int(name string) (int64, error) {
+	val, err := o.Value(name)
+	if err != nil {
+		return 0, err
+	}
+	ret, err := toInt64(val)
+	if err != nil {
+		return 0, errors.Wrap(err, name)
+	}
+	return ret, nil
+}
+
+// Bool returns the out parameter name as a bool
+func (o Outputs) Bool(name string) (bool, error) {
+	val, err := o.Value(name)
+	if err != nil {
+		return false, err
+	}
+	asBool, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s is not a bool (%T)", name, val)
+	}
+	return asBool, nil
+}
+
+// Object returns the out parameter name as a *Result. Use this for
+// out parameters holding embedded objects.
+func (o Outputs) Object(name string) (*Result, error) {
+	if o.res == nil {
+		return nil, fmt.Errorf("%s has no out parameters", o.method)
+	}
+	prop, err := o.res.GetProperty(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetProperty(%s)", name)
+	}
+	if prop.Raw().VT != ole.VT_DISPATCH {
+		prop.Release()
+		return nil, fmt.Errorf("%s is not an object", name)
+	}
+	return prop, nil
+}
+
+// Release frees the out parameters object
+func (o Outputs) Release() {
+	o.res.Release()
+}
+
+// Wait checks the ReturnValue of the method. If a job was started, Wait
+// blocks until the job referenced by the Job out parameter completes.
+// A *MethodError is returned for any other non zero return value.
+func (o Outputs) Wait() error {
+	return o.WaitContext(context.Background(), nil)
+}
+
+// WaitContext is like Wait. If progress is not nil, it is called with the
+// completion percentage of the job each time it changes. If ctx is done
+// before the job completes, the job is asked to terminate.
+func (o Outputs) WaitContext(ctx context.Context, progress func(percent int)) error {
+	code, err := o.ReturnValue()
+	if err != nil {
+		return errors.Wrap(err, "ReturnValue")
+	}
+	switch code {
+	case ReturnCompleted:
+		return nil
+	case ReturnJobStarted:
+		jobPath, err := o.String("Job")
+		if err != nil {
+			return errors.Wrap(err, "Job")
+		}
+		err = waitForJob(ctx, jobPath, progress)
+		if cache := queryCache(); cache != nil && o.classes != nil {
+			cache.Invalidate(o.namespace, o.classes...)
+		}
+		if err != nil {
+			return errors.Wrap(err, "waiting for job")
+		}
+		return nil
+	default:
+		return &MethodError{Method: o.method, Code: code}
+	}
+}
+
+// Call executes method on the WMI object held in *Result. The in parameters
+// are set by name on a new instance of the method InParameters object.
+// The flags and context in opts are passed on to the provider.
+func (r *Result) Call(method string, in map[string]interface{}, opts ...Options) (Outputs, error) {
+	obs := r.observe(Event{Kind: EventMethodCall, Method: method})
+	out, err := r.call(method, in, opts)
+	obs.setReturnCode(out)
+	obs.end(err)
+	return out, err
+}
+
+// call executes method, retrying transient failures if the retry policy
+// in effect allows it.
+func (r *Result) call(method string, in map[string]interface{}, opts []Options) (Outputs, error) {
+	o := mergeOptions(opts)
+	policy := retryPolicyFor(r.conn.retryPolicy(), o.Retry, true)
+	if policy == nil {
+		return r.callOnce(method, in, o)
+	}
+	var ret Outputs
+	err := policy.run(func() error {
+		var err error
+		ret, err = r.callOnce(method, in, o)
+		if err != nil || policy.Classes&RetryInvalidState == 0 {
+			return err
+		}
+		if code, ok := ret.returnCode(); ok && code == ReturnInvalidState {
+			ret.Release()
+			ret = Outputs{}
+			return &MethodError{Method: method, Code: code}
+		}
+		return nil
+	}, r.rebind)
+	return ret, err
+}
+
+// returnCode returns the ReturnValue of the method, without
+// notifying the observer.
+func (o Outputs) returnCode() (ReturnCode, bool) {
+	if o.res == nil {
+		return 0, false
+	}
+	prop, err := o.res.getProperty("ReturnValue")
+	if err != nil {
+		return 0, false
+	}
+	defer prop.Release()
+	code, err := toInt64(prop.Value())
+	if err != nil {
+		return 0, false
+	}
+	return ReturnCode(code), true
+}
+
+func (r *Result) callOnce(method string, in map[string]interface{}, opts Options) (Outputs, error) {
+	var inParamsDisp *ole.IDispatch
+	if r.fake == nil {
+		inParams, err := r.inParameters(method, in)
+		if err != nil {
+			return Outputs{}, err
+		}
+		if inParams != nil {
+			defer inParams.Release()
+			inParamsDisp = inParams.dispatch()
+		}
+	}
+
+	out, err := r.execMethod(method, inParamsDisp, in, opts)
+	if err != nil {
+		return Outputs{}, errors.Wrapf(err, "ExecMethod_(%s)", method)
+	}
+	ret := Outputs{method: method}
+	if queryCache() != nil {
+		ret.classes = r.objectCallClasses("ExecMethod_", in, []interface{}{method, inParamsDisp}, out)
+		ret.namespace = r.namespace
+	}
+	if out.Raw().VT == ole.VT_DISPATCH {
+		ret.res = out
+	} else {
+		out.Release()
+	}
+	return ret, nil
+}
+
+// inParameters returns a new instance of the InParameters object of
+// method, with in set on it. It returns nil if method takes no in
+// parameters.
+func (r *Result) inParameters(method string, in map[string]interface{}) (*Result, error) {
+	methods, err := r.GetProperty("Methods_")
+	if err != nil {
+		return nil, errors.Wrap(err, "Methods_")
+	}
+	defer methods.Release()
+	definition, err := methods.invoke("Item", method)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting method %s", method)
+	}
+	defer definition.Release()
+	inDefinition, err := definition.GetProperty("InParameters")
+	if err != nil {
+		return nil, errors.Wrap(err, "InParameters")
+	}
+	defer inDefinition.Release()
+
+	if inDefinition.Raw().VT != ole.VT_DISPATCH {
+		if len(in) > 0 {
+			return nil, fmt.Errorf("%s takes no in parameters", method)
+		}
+		return nil, nil
+	}
+	inParams, err := inDefinition.invoke("SpawnInstance_")
+	if err != nil {
+		return nil, errors.Wrap(err, "SpawnInstance_")
+	}
+	for name, val := range in {
+		if err := inParams.Set(name, val); err != nil {
+			inParams.Release()
+			return nil, errors.Wrapf(err, "setting in parameter %s", name)
+		}
+	}
+	return inParams, nil
+}
+
+// execMethod calls ExecMethod_ on the object held in *Result. When
+// replaying, the in parameters are not sent anywhere; in is only
+// recorded, for reference.
+func (r *Result) execMethod(method string, inParams *ole.IDispatch, in map[string]interface{}, opts Options) (*Result, error) {
+	return r.callObject("ExecMethod_", &opts, defaultGetExecMethodFlags, in, method, inParams)
+}
+
+func toInt64(val interface{}) (int64, error) {
+	switch v := val.(type) {
+	case int8:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint64:
+		return int64(v), nil
+	case int:
+		return int64(v), nil
+	case uint:
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	default:
+		return 0, fmt.Errorf("not an integer (%T)", val)
+	}
+}
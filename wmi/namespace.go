@@ -0,0 +1,178 @@
+package wmi
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ClassFilter narrows down the classes returned by ListClasses
+type ClassFilter struct {
+	// Superclass limits the result to classes derived from this class.
+	// If empty, all classes in the namespace are returned.
+	Superclass string
+	// Shallow limits the result to immediate subclasses of Superclass.
+	Shallow bool
+	// Prefix limits the result to classes whose name starts with this
+	// value (case insensitive). For example: "Msvm_".
+	Prefix string
+}
+
+// Capabilities holds the WMI subsystems that are available on a host
+type Capabilities struct {
+	// VirtualizationV2 is true if the Hyper-V root\virtualization\v2
+	// namespace and its management service are present.
+	VirtualizationV2 bool
+	// StandardCimV2 is true if the root\StandardCimv2 networking
+	// namespace is present.
+	StandardCimV2 bool
+	// Storage is true if the root\Microsoft\Windows\Storage
+	// namespace is present.
+	Storage bool
+}
+
+// connectNamespace returns a new connection to namespace, using the same
+// server and credentials as this connection.
+func (w *WMI) connectNamespace(namespace string) (*WMI, error) {
+	params := []interface{}{w.Server, namespace}
+	if len(w.params) > 2 {
+		params = append(params, w.params[2:]...)
+	}
+	return NewConnection(params...)
+}
+
+// ListNamespaces returns the namespaces nested under the namespace of this
+// connection, as full namespace paths. If recursive is true, the whole
+// namespace tree is walked, not only the immediate children.
+func (w *WMI) ListNamespaces(recursive bool) ([]string, error) {
+	result, err := w.Gwmi("__NAMESPACE", []string{"Name"}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Gwmi __NAMESPACE")
+	}
+	defer result.Release()
+	elements, err := result.Elements()
+	if err != nil {
+		return nil, errors.Wrap(err, "Elements")
+	}
+	defer releaseAll(elements)
+
+	ret := []string{}
+	for _, val := range elements {
+		name, err := val.GetProperty("Name")
+		if err != nil {
+			return nil, errors.Wrap(err, "GetProperty(Name)")
+		}
+		nameStr, ok := name.Value().(string)
+		name.Release()
+		if !ok || nameStr == "" {
+			continue
+		}
+		namespace := w.Namespace + `\` + nameStr
+		ret = append(ret, namespace)
+		if !recursive {
+			continue
+		}
+
+		child, err := w.connectNamespace(namespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "connecting to %s", namespace)
+		}
+		nested, err := child.ListNamespaces(true)
+		child.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing %s", namespace)
+		}
+		ret = append(ret, nested...)
+	}
+	return ret, nil
+}
+
+// ListClasses returns the names of the classes defined in the namespace
+// of this connection, narrowed down by filter.
+func (w *WMI) ListClasses(filter ClassFilter) ([]string, error) {
+	flags := wbemQueryFlagDeep
+	if filter.Shallow {
+		flags = wbemQueryFlagShallow
+	}
+	var superclass interface{}
+	if filter.Superclass != "" {
+		superclass = filter.Superclass
+	}
+	result, err := w.callService("SubclassesOf", nil, 0, superclass, flags)
+	if err != nil {
+		return nil, errors.Wrap(err, "SubclassesOf")
+	}
+	defer result.Release()
+	elements, err := result.Elements()
+	if err != nil {
+		return nil, errors.Wrap(err, "Elements")
+	}
+	defer releaseAll(elements)
+
+	prefix := strings.ToLower(filter.Prefix)
+	ret := []string{}
+	for _, val := range elements {
+		class, err := val.Class()
+		if err != nil {
+			return nil, errors.Wrap(err, "Class")
+		}
+		if !strings.HasPrefix(strings.ToLower(class), prefix) {
+			continue
+		}
+		ret = append(ret, class)
+	}
+	return ret, nil
+}
+
+// HasClass returns true if class is defined in the namespace
+// of this connection.
+func (w *WMI) HasClass(class string) (bool, error) {
+	classObj, err := w.Get(class)
+	if err != nil {
+		if IsHResult(err, WBEMNotFound, WBEMInvalidClass) {
+			return false, nil
+		}
+		return false, err
+	}
+	classObj.Release()
+	return true, nil
+}
+
+// probeNamespace returns true if namespace exists on the server of this
+// connection and, if class is not empty, defines class.
+func (w *WMI) probeNamespace(namespace, class string) (bool, error) {
+	conn, err := w.connectNamespace(namespace)
+	if err != nil {
+		if IsHResult(err, WBEMInvalidNamespace) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer conn.Close()
+	if class == "" {
+		return true, nil
+	}
+	return conn.HasClass(class)
+}
+
+// ProbeCapabilities reports which WMI subsystems are available on the
+// server of this connection. The namespaces are probed with the
+// credentials this connection was opened with.
+func (w *WMI) ProbeCapabilities() (Capabilities, error) {
+	var err error
+	caps := Capabilities{}
+	caps.VirtualizationV2, err = w.probeNamespace(
+		VirtualizationV2Namespace, "Msvm_VirtualSystemManagementService")
+	if err != nil {
+		return Capabilities{}, errors.Wrap(err, "probing virtualization")
+	}
+	caps.StandardCimV2, err = w.probeNamespace(StandardCimV2Namespace, "MSFT_NetAdapter")
+	if err != nil {
+		return Capabilities{}, errors.Wrap(err, "probing networking")
+	}
+	caps.Storage, err = w.probeNamespace(StorageNamespace, "MSFT_Disk")
+	if err != nil {
+		return Capabilities{}, errors.Wrap(err, "probing storage")
+	}
+	return caps, nil
+}
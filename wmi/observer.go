@@ -0,0 +1,309 @@
+package wmi
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventKind identifies the kind of call reported to an Observer
+type EventKind string
+
+// Calls reported to an Observer
+const (
+	EventQuery       EventKind = "query"
+	EventGet         EventKind = "get"
+	EventGetProperty EventKind = "get_property"
+	EventSetProperty EventKind = "set_property"
+	EventMethodCall  EventKind = "method_call"
+	EventJobWait     EventKind = "job_wait"
+)
+
+// Event describes a WMI call. Fields that do not apply to a
+// call are left empty.
+type Event struct {
+	Kind      EventKind
+	Namespace string
+	Class     string
+	// Path is the object path of the object retrieved, called or
+	// waited on, when known.
+	Path     string
+	Method   string
+	Property string
+	WQL      string
+
+	// The fields below are only set once the call completes.
+
+	Duration time.Duration
+	// ReturnCode is the value returned by a method. It is only
+	// valid if HasReturnCode is true.
+	ReturnCode    ReturnCode
+	HasReturnCode bool
+	// Cached is true for queries served from the query cache
+	Cached bool
+	Err    error
+}
+
+// Observer is notified around every query, object retrieval, property
+// get and set, method call and job wait. Start is called before the call
+// is made, and the function it returns is called once the call completes,
+// with Duration, ReturnCode and Err set. The returned function may be nil.
+// Observers are called synchronously, and must be safe for concurrent use.
+type Observer interface {
+	Start(e Event) func(Event)
+}
+
+var (
+	observerLock sync.RWMutex
+	observer     Observer
+)
+
+// SetObserver sets the observer notified of WMI calls made by this
+// process. Use nil to remove it. Use MultiObserver to set more than one.
+func SetObserver(o Observer) {
+	observerLock.Lock()
+	defer observerLock.Unlock()
+	observer = o
+}
+
+func currentObserver() Observer {
+	observerLock.RLock()
+	defer observerLock.RUnlock()
+	return observer
+}
+
+type multiObserver []Observer
+
+func (m multiObserver) Start(e Event) func(Event) {
+	done := make([]func(Event), 0, len(m))
+	for _, val := range m {
+		if f := val.Start(e); f != nil {
+			done = append(done, f)
+		}
+	}
+	return func(e Event) {
+		for i := len(done) - 1; i >= 0; i-- {
+			done[i](e)
+		}
+	}
+}
+
+// MultiObserver returns an Observer that notifies all of observers
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+// observation is an in flight call reported to the current observer.
+// A nil *observation is valid, and is used when no observer is set.
+type observation struct {
+	event Event
+	start time.Time
+	done  func(Event)
+}
+
+// observe reports the start of a call. It returns nil if no
+// observer is set.
+func observe(e Event) *observation {
+	o := currentObserver()
+	if o == nil {
+		return nil
+	}
+	return &observation{
+		event: e,
+		start: time.Now(),
+		done:  o.Start(e),
+	}
+}
+
+// observe reports the start of a call made on this object
+func (r *Result) observe(e Event) *observation {
+	if currentObserver() == nil {
+		return nil
+	}
+	r.describe()
+	e.Namespace = r.namespace
+	e.Class = r.class
+	if e.Path == "" {
+		e.Path = r.path
+	}
+	return observe(e)
+}
+
+// describe looks up the namespace, class and path of this object once.
+// They are left empty for results that do not hold a SWbemObject. It is
+// safe to call from several goroutines.
+func (r *Result) describe() {
+	r.describeOnce.Do(r.lookupDescription)
+}
+
+func (r *Result) lookupDescription() {
+	p, err := r.getProperty("Path_")
+	if err != nil {
+		return
+	}
+	defer p.Release()
+	fields := map[string]*string{
+		"Namespace": &r.namespace,
+		"Class":     &r.class,
+		"Path":      &r.path,
+	}
+	for name, field := range fields {
+		val, err := p.getProperty(name)
+		if err != nil {
+			continue
+		}
+		*field, _ = val.Value().(string)
+		val.Release()
+	}
+}
+
+// setReturnCode records the ReturnValue of out
+func (o *observation) setReturnCode(out Outputs) {
+	if o == nil {
+		return
+	}
+	o.event.ReturnCode, o.event.HasReturnCode = out.returnCode()
+}
+
+// setCached records whether the call was served from the query cache
+func (o *observation) setCached(cached bool) {
+	if o == nil {
+		return
+	}
+	o.event.Cached = cached
+}
+
+// end reports the completion of the call
+func (o *observation) end(err error) {
+	if o == nil || o.done == nil {
+		return
+	}
+	o.event.Duration = time.Since(o.start)
+	o.event.Err = err
+	o.done(o.event)
+}
+
+// queryClass returns the class a WQL query selects from
+func queryClass(wql string) string {
+	fields := strings.Fields(wql)
+	for idx, val := range fields {
+		if strings.EqualFold(val, "FROM") && idx+1 < len(fields) {
+			return fields[idx+1]
+		}
+	}
+	return ""
+}
+
+// pathClass returns the class referenced by an object path
+func pathClass(objectPath string) string {
+	if idx := strings.Index(objectPath, ":"); idx >= 0 && strings.HasPrefix(objectPath, `\\`) {
+		objectPath = objectPath[idx+1:]
+	}
+	if idx := strings.IndexAny(objectPath, ".="); idx >= 0 {
+		objectPath = objectPath[:idx]
+	}
+	return objectPath
+}
+
+// Logger is a structured logger taking a message followed by alternating
+// keys and values. It is satisfied by logr.Logger and *slog.Logger, among
+// others.
+type Logger interface {
+	Info(msg string, keysAndValues ...interface{})
+}
+
+type logObserver struct {
+	logger Logger
+}
+
+func (l logObserver) Start(e Event) func(Event) {
+	return func(e Event) {
+		kv := []interface{}{"kind", string(e.Kind)}
+		fields := []struct {
+			name  string
+			value string
+		}{
+			{"namespace", e.Namespace},
+			{"class", e.Class},
+			{"path", e.Path},
+			{"method", e.Method},
+			{"property", e.Property},
+			{"wql", e.WQL},
+		}
+		for _, val := range fields {
+			if val.value != "" {
+				kv = append(kv, val.name, val.value)
+			}
+		}
+		kv = append(kv, "duration", e.Duration)
+		if e.HasReturnCode {
+			kv = append(kv, "returnCode", uint32(e.ReturnCode))
+		}
+		if e.Cached {
+			kv = append(kv, "cached", true)
+		}
+		if e.Err != nil {
+			kv = append(kv, "error", e.Err.Error())
+		}
+		l.logger.Info("wmi call", kv...)
+	}
+}
+
+// NewLogObserver returns an Observer that logs every completed call to
+// logger, along with its duration, return code and error.
+func NewLogObserver(logger Logger) Observer {
+	return logObserver{logger: logger}
+}
+
+// Span is the subset of an OpenTelemetry style span used by the
+// observer returned by NewTracingObserver.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// Tracer starts spans for the observer returned by NewTracingObserver.
+// Wrapping an OpenTelemetry trace.Tracer takes only a few lines.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+type tracingObserver struct {
+	tracer Tracer
+}
+
+func (t tracingObserver) Start(e Event) func(Event) {
+	span := t.tracer.StartSpan("wmi." + string(e.Kind))
+	attrs := map[string]string{
+		"wmi.namespace": e.Namespace,
+		"wmi.class":     e.Class,
+		"wmi.path":      e.Path,
+		"wmi.method":    e.Method,
+		"wmi.property":  e.Property,
+		"wmi.wql":       e.WQL,
+	}
+	for key, val := range attrs {
+		if val != "" {
+			span.SetAttribute(key, val)
+		}
+	}
+	return func(e Event) {
+		if e.HasReturnCode {
+			span.SetAttribute("wmi.return_code", int64(e.ReturnCode))
+		}
+		if e.Cached {
+			span.SetAttribute("wmi.cached", true)
+		}
+		if e.Err != nil {
+			span.RecordError(e.Err)
+		}
+		span.End()
+	}
+}
+
+// NewTracingObserver returns an Observer that wraps every call
+// in a span started by tracer.
+func NewTracingObserver(tracer Tracer) Observer {
+	return tracingObserver{tracer: tracer}
+}
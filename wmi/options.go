@@ -0,0 +1,257 @@
+package wmi
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	"github.com/pkg/errors"
+)
+
+// ErrTimeout is returned when a call does not complete within
+// the Timeout set in its Options
+var ErrTimeout = errors.New("WMI call timed out")
+
+// Flags accepted by SWbemServices calls. See:
+// https://docs.microsoft.com/en-us/windows/win32/wmisdk/swbemservices-execquery
+const (
+	FlagForwardOnly           = 0x20
+	FlagReturnImmediately     = 0x10
+	FlagUseAmendedQualifiers  = 0x20000
+	FlagDirectRead            = 0x200
+	defaultExecQueryFlags     = FlagReturnImmediately
+	defaultGetExecMethodFlags = 0
+)
+
+// PolicyStore selects the store that StandardCimv2 networking
+// classes read from and write to.
+type PolicyStore string
+
+// Policy stores accepted by StandardCimv2 classes
+var (
+	ActiveStore     PolicyStore = "ActiveStore"
+	PersistentStore PolicyStore = "PersistentStore"
+)
+
+// Context is a set of named values handed to the WMI provider along with
+// a call. It is sent as a SWbemNamedValueSet. Values must be of a type
+// that can be converted to a VARIANT: strings, booleans, integers, floats
+// and slices of those.
+type Context map[string]interface{}
+
+// With returns a copy of this context with name set to val
+func (c Context) With(name string, val interface{}) Context {
+	ret := make(Context, len(c)+1)
+	for k, v := range c {
+		ret[k] = v
+	}
+	ret[name] = val
+	return ret
+}
+
+// ProviderArchitecture returns a context that requests the provider for the
+// given architecture (32 or 64 bit). This allows a 32 bit process to reach
+// 64 bit providers.
+func ProviderArchitecture(bits int32) Context {
+	return Context{
+		"__ProviderArchitecture": bits,
+		"__RequiredArchitecture": true,
+	}
+}
+
+// PolicyStoreContext returns a context that selects the policy store
+// used by StandardCimv2 classes.
+func PolicyStoreContext(store PolicyStore) Context {
+	return Context{
+		"PolicyStore": string(store),
+	}
+}
+
+// namedValueSet builds a SWbemNamedValueSet from this context. The caller
+// must release the returned object.
+func (c Context) namedValueSet() (*ole.IDispatch, error) {
+	unknown, err := oleutil.CreateObject("WbemScripting.SWbemNamedValueSet")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating SWbemNamedValueSet")
+	}
+	defer unknown.Release()
+	set, err := unknown.QueryInterface(ole.IID_IDispatch)
+	if err != nil {
+		return nil, errors.Wrap(err, "QueryInterface")
+	}
+	for name, val := range c {
+		if _, err := oleutil.CallMethod(set, "Add", name, val); err != nil {
+			set.Release()
+			return nil, errors.Wrapf(err, "adding context value %s (%T)", name, val)
+		}
+	}
+	return set, nil
+}
+
+// Options holds optional parameters for queries, object retrieval
+// and method calls.
+type Options struct {
+	// Context is passed to the provider along with the call.
+	Context Context
+	// Flags are the SWbem flags for the call. If zero, the default
+	// flags of the called SWbem method are used.
+	Flags int
+	// Timeout is the maximum time to wait for the call to return. If
+	// the timeout expires, ErrTimeout is returned. The scripting API
+	// cannot cancel synchronous calls, so the provider is not told to
+	// stop: the call is left to complete on its own thread, and its
+	// result is released once it returns.
+	Timeout time.Duration
+	// Retry overrides the retry policy of the connection for this call.
+	// Passing a policy with a method call opts it into retries.
+	Retry *RetryPolicy
+	// NoCache bypasses the query cache. The result of the query is
+	// not cached either. Options setting only NoCache do not otherwise
+	// change how the query is made.
+	NoCache bool
+}
+
+// cacheOnly returns true if these options only control the query cache
+func (o Options) cacheOnly() bool {
+	return o.Context == nil && o.Flags == 0 && o.Timeout == 0 && o.Retry == nil
+}
+
+// mergeOptions folds opts into a single Options value. Later values
+// override earlier ones and contexts are merged.
+func mergeOptions(opts []Options) Options {
+	ret := Options{}
+	for _, opt := range opts {
+		for name, val := range opt.Context {
+			ret.Context = ret.Context.With(name, val)
+		}
+		if opt.Flags != 0 {
+			ret.Flags = opt.Flags
+		}
+		if opt.Timeout != 0 {
+			ret.Timeout = opt.Timeout
+		}
+		if opt.Retry != nil {
+			ret.Retry = opt.Retry
+		}
+		if opt.NoCache {
+			ret.NoCache = true
+		}
+	}
+	return ret
+}
+
+// callParams returns the flags and the context object to pass to a SWbem
+// method. The returned function releases the context, and must only be
+// called once the SWbem call returns.
+func (o Options) callParams(defaultFlags int) (int, *ole.IDispatch, func(), error) {
+	flags := o.Flags
+	if flags == 0 {
+		flags = defaultFlags
+	}
+	if len(o.Context) == 0 {
+		return flags, nil, func() {}, nil
+	}
+	set, err := o.Context.namedValueSet()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return flags, set, func() { set.Release() }, nil
+}
+
+// call calls method on disp with params, followed by the flags and
+// context of these options, enforcing their timeout.
+func (o Options) call(disp *ole.IDispatch, method string, defaultFlags int, params ...interface{}) (*ole.VARIANT, error) {
+	flags, ctx, release, err := o.callParams(defaultFlags)
+	if err != nil {
+		return nil, err
+	}
+	args := append(append([]interface{}{}, params...), flags, ctx)
+	if o.Timeout <= 0 {
+		defer release()
+		return oleutil.CallMethod(disp, method, args...)
+	}
+	return callWithTimeout(disp, method, args, release, o.Timeout)
+}
+
+// callWithTimeout calls method on disp from a new thread joined to the
+// multithreaded apartment, and waits for up to timeout for it to return.
+// The call holds its own reference to disp, so the caller may release
+// the object once callWithTimeout returns, even if the call is still in
+// flight. done is called once the call returns.
+func callWithTimeout(disp *ole.IDispatch, method string, args []interface{}, done func(), timeout time.Duration) (*ole.VARIANT, error) {
+	type result struct {
+		val *ole.VARIANT
+		err error
+	}
+	var (
+		lock      sync.Mutex
+		abandoned bool
+	)
+	results := make(chan result, 1)
+	disp.AddRef()
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if err := initializeCOM(); err != nil {
+			done()
+			disp.Release()
+			results <- result{nil, errors.Wrap(err, "initializing COM")}
+			return
+		}
+		defer ole.CoUninitialize()
+		defer disp.Release()
+		defer done()
+
+		val, err := oleutil.CallMethod(disp, method, args...)
+		lock.Lock()
+		defer lock.Unlock()
+		if abandoned {
+			if val != nil {
+				val.Clear()
+			}
+			return
+		}
+		results <- result{val, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		return res.val, res.err
+	case <-timer.C:
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	select {
+	case res := <-results:
+		// The call returned while the timer fired
+		return res.val, res.err
+	default:
+	}
+	abandoned = true
+	return nil, errors.Wrapf(ErrTimeout, "after %s", timeout)
+}
+
+// canonical returns the flags and context of these options in the
+// form they are stored in a fixture.
+func (o Options) canonical(defaultFlags int) []string {
+	flags := o.Flags
+	if flags == 0 {
+		flags = defaultFlags
+	}
+	ctx := make([]string, 0, len(o.Context))
+	for name, val := range o.Context {
+		ctx = append(ctx, fmt.Sprintf("%s=%v", name, val))
+	}
+	sort.Strings(ctx)
+	return []string{
+		canonicalArg(flags),
+		fmt.Sprintf("context{%s}", strings.Join(ctx, ";")),
+	}
+}
@@ -1,11 +1,16 @@
 package wmi
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/go-ole/go-ole"
+	"github.com/pkg/errors"
 )
 
 // Location contains the parsed fields of a __PATH
@@ -19,30 +24,87 @@ type Location struct {
 	// Params is a map of parameters to filter
 	Params map[string]string
 
-	// conn *WMI
+	// relPath is the path this Location was parsed from, without
+	// the server and namespace
+	relPath string
 }
 
-var pathRegexp = regexp.MustCompile(`\\\\(?P<server>[a-zA-Z0-9-.]+)\\(?P<namespace>[a-zA-Z0-9\\]+):(?P<class>[a-zA-Z_]+)[.]?(?P<params>.*)?`)
+var pathRegexp = regexp.MustCompile(`\\\\(?P<server>[a-zA-Z0-9-.]+)\\(?P<namespace>[a-zA-Z0-9\\]+):(?P<class>[a-zA-Z0-9_]+)[.]?(?P<params>.*)?`)
 var requiredFields = []string{
 	"server",
 	"namespace",
 	"class",
 }
 
-// GetResult wil return a Result for this Location
-func (w *Location) GetResult() (*Result, error) {
+// GetResult wil return a Result for this Location. A new connection
+// is opened for each call, and closed when the result is released. Use
+// GetResultFrom to reuse an existing one.
+func (w *Location) GetResult(opts ...Options) (*Result, error) {
 	conn, err := NewConnection(w.Server, w.Namespace)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	result, err := conn.GetOne(w.Class, []string{}, w.QueryParams())
+	result, err := w.GetResultFrom(conn, opts...)
 	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	result.owner = conn
+	return result, nil
+}
+
+// GetResultFrom will return a Result for this Location, using conn.
+// The connection must be bound to the server and namespace of this
+// Location. Only the namespace is checked, since the server in paths
+// returned by WMI rarely matches the name the connection was opened with.
+func (w *Location) GetResultFrom(conn *WMI, opts ...Options) (*Result, error) {
+	if !strings.EqualFold(conn.Namespace, w.Namespace) {
+		return nil, fmt.Errorf("connection namespace %s does not match %s", conn.Namespace, w.Namespace)
+	}
+	pth, err := w.relativePath()
+	if err != nil {
+		return nil, err
+	}
+	var result *Result
+	merged := mergeOptions(opts)
+	if merged.cacheOnly() {
+		result, err = conn.Get(pth)
+	} else {
+		result, err = conn.GetWithOptions(pth, merged)
+	}
+	if err != nil {
+		if IsHResult(err, WBEMNotFound) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
 	return result, nil
 }
 
+// relativePath returns the path of this Location, without the server
+// and namespace
+func (w *Location) relativePath() (string, error) {
+	if w.relPath != "" {
+		return w.relPath, nil
+	}
+	if len(w.Params) == 0 {
+		return w.Class + "=@", nil
+	}
+	keys := make([]string, 0, len(w.Params))
+	for key := range w.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for idx, key := range keys {
+		val, err := escapePathValue(w.Params[key])
+		if err != nil {
+			return "", errors.Wrap(err, key)
+		}
+		keys[idx] = fmt.Sprintf("%s=%s", key, val)
+	}
+	return fmt.Sprintf("%s.%s", w.Class, strings.Join(keys, ",")), nil
+}
+
 func validateResult(result map[string]string) error {
 	for _, val := range requiredFields {
 		if _, ok := result[val]; !ok {
@@ -102,12 +164,16 @@ func NewLocation(path string) (*Location, error) {
 		return nil, err
 	}
 
-	return &Location{
+	ret := &Location{
 		Server:    result["server"],
 		Namespace: result["namespace"],
 		Class:     result["class"],
 		Params:    params,
-	}, nil
+	}
+	if idx := strings.Index(path, ":"); idx >= 0 {
+		ret.relPath = path[idx+1:]
+	}
+	return ret, nil
 }
 
 // JobState represents a WMI job that was run. This type exposes a subset
@@ -124,11 +190,16 @@ type JobState struct {
 	JobState         int32
 	JobStatus        string
 	JobType          int32
+	PercentComplete  int32
 }
 
 // PopulateStruct populates the fields of the supplied struct
 // with values received form a Result. Care must be taken when
 // declaring the struct. It must match the types returned by WMI.
+//
+// Fields of type *Location and []*Location are decoded from references
+// and object paths. Fields holding a struct, a pointer to a struct or a
+// slice of either are populated from embedded objects.
 func PopulateStruct(j *Result, s interface{}) (err error) {
 	var name string
 	var fieldType interface{}
@@ -148,75 +219,207 @@ func PopulateStruct(j *Result, s interface{}) (err error) {
 		}
 		name = typeOfElem.Field(i).Name
 		fieldType = field.Interface()
-		res, err := j.GetProperty(name)
-		if err != nil {
-			return fmt.Errorf("Failed to get property %s: %s", name, err)
-		}
-
-		wmiFieldValue := res.Value()
-		if wmiFieldValue == nil {
+		if isEmbeddedField(field.Type()) {
+			if err := populateEmbedded(j, name, field); err != nil {
+				return err
+			}
 			continue
 		}
+		if err := populateField(j, name, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		var fieldValue interface{}
-		switch field.Interface().(type) {
-		case []uint16:
-			if c := res.ToArray(); c != nil {
-				val := c.ToValueArray()
-				asString := make([]uint16, len(val))
-				for k, v := range val {
-					asString[k] = v.(uint16)
-				}
-				fieldValue = asString
+// populateField sets field from the property name of j. The property
+// is released before populateField returns.
+func populateField(j *Result, name string, field reflect.Value) error {
+	res, err := j.GetProperty(name)
+	if err != nil {
+		return fmt.Errorf("Failed to get property %s: %s", name, err)
+	}
+	defer res.Release()
+
+	wmiFieldValue := res.Value()
+	if wmiFieldValue == nil && res.Raw().VT&ole.VT_ARRAY == 0 {
+		return nil
+	}
+
+	var fieldValue interface{}
+	switch field.Interface().(type) {
+	case []uint8, []uint16, []uint32, []uint64, []int8, []int16, []int32, []int64, []string, []bool:
+		val := res.ToValueArray()
+		if val == nil {
+			// Null arrays leave the field at its zero value
+			return nil
+		}
+		arr, err := convertArray(val, field.Type())
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+		fieldValue = arr
+	case *Location:
+		pth, ok := wmiFieldValue.(string)
+		if !ok {
+			return fmt.Errorf("%s is not a reference (%T)", name, wmiFieldValue)
+		}
+		loc, err := NewLocation(pth)
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+		fieldValue = loc
+	case []*Location:
+		val := res.ToValueArray()
+		if val == nil {
+			return nil
+		}
+		locations := make([]*Location, len(val))
+		for k, v := range val {
+			pth, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%s[%d] is not a reference (%T)", name, k, v)
 			}
-		case []string:
-			if c := res.ToArray(); c != nil {
-				val := c.ToValueArray()
-				asString := make([]string, len(val))
-				for k, v := range val {
-					asString[k] = v.(string)
-				}
-				fieldValue = asString
+			loc, err := NewLocation(pth)
+			if err != nil {
+				return errors.Wrap(err, name)
 			}
-		case []uint32:
-			if c := res.ToArray(); c != nil {
-				val := c.ToValueArray()
-				asString := make([]uint32, len(val))
-				for k, v := range val {
-					asString[k] = v.(uint32)
-				}
-				fieldValue = asString
+			locations[k] = loc
+		}
+		fieldValue = locations
+	default:
+		fieldValue = wmiFieldValue
+	}
+
+	v := reflect.ValueOf(fieldValue)
+	if v.Kind() != field.Kind() {
+		return fmt.Errorf("Invalid type returned by query for field %s (%v): %v", name, v.Kind(), field.Kind())
+	}
+	if field.CanSet() {
+		field.Set(v)
+	}
+	return nil
+}
+
+// convertArray converts the elements of a WMI array to a slice of type t.
+// WMI does not always return array elements in the VARIANT type matching
+// the CIM type of the property, so integers are converted to the element
+// type of t as long as they fit.
+func convertArray(val []interface{}, t reflect.Type) (interface{}, error) {
+	ret := reflect.MakeSlice(t, len(val), len(val))
+	for idx, item := range val {
+		elem := ret.Index(idx)
+		switch elem.Kind() {
+		case reflect.String:
+			v, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("element %d is not a string (%T)", idx, item)
 			}
-		case []int32:
-			if c := res.ToArray(); c != nil {
-				val := c.ToValueArray()
-				asString := make([]int32, len(val))
-				for k, v := range val {
-					asString[k] = v.(int32)
-				}
-				fieldValue = asString
+			elem.SetString(v)
+		case reflect.Bool:
+			v, ok := item.(bool)
+			if !ok {
+				return nil, fmt.Errorf("element %d is not a boolean (%T)", idx, item)
 			}
-		case []int64:
-			if c := res.ToArray(); c != nil {
-				val := c.ToValueArray()
-				asString := make([]int64, len(val))
-				for k, v := range val {
-					asString[k] = v.(int64)
-				}
-				fieldValue = asString
+			elem.SetBool(v)
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := integerValue(item)
+			if err != nil {
+				return nil, errors.Wrapf(err, "element %d", idx)
 			}
+			if !n.IsInt64() || elem.OverflowInt(n.Int64()) {
+				return nil, fmt.Errorf("element %d: %s overflows %s", idx, n, elem.Type())
+			}
+			elem.SetInt(n.Int64())
 		default:
-			fieldValue = wmiFieldValue
+			n, err := integerValue(item)
+			if err != nil {
+				return nil, errors.Wrapf(err, "element %d", idx)
+			}
+			if !n.IsUint64() || elem.OverflowUint(n.Uint64()) {
+				return nil, fmt.Errorf("element %d: %s overflows %s", idx, n, elem.Type())
+			}
+			elem.SetUint(n.Uint64())
 		}
+	}
+	return ret.Interface(), nil
+}
 
-		v := reflect.ValueOf(fieldValue)
-		if v.Kind() != field.Kind() {
-			return fmt.Errorf("Invalid type returned by query for field %s (%v): %v", name, v.Kind(), field.Kind())
+var (
+	locationType = reflect.TypeOf(&Location{})
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// embeddedType returns the struct type populated from an embedded object
+// by a field of type t, or nil if t is not a struct, a pointer to a struct
+// or a slice of either.
+func embeddedType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t == locationType {
+		return nil
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return nil
+	}
+	return t
+}
+
+func isEmbeddedField(t reflect.Type) bool {
+	return embeddedType(t) != nil
+}
+
+// populateEmbedded populates field from the embedded objects held by the
+// property name of j.
+func populateEmbedded(j *Result, name string, field reflect.Value) error {
+	if !field.CanSet() {
+		return nil
+	}
+	t := field.Type()
+	structType := embeddedType(t)
+	newItem := func(obj *Result, itemType reflect.Type) (reflect.Value, error) {
+		val := reflect.New(structType)
+		if err := PopulateStruct(obj, val.Interface()); err != nil {
+			return reflect.Value{}, errors.Wrap(err, name)
+		}
+		if itemType.Kind() == reflect.Ptr {
+			return val, nil
 		}
-		if field.CanSet() {
-			field.Set(v)
+		return val.Elem(), nil
+	}
+
+	if t.Kind() != reflect.Slice {
+		obj, err := j.Embedded(name)
+		if err != nil || obj == nil {
+			return err
+		}
+		defer obj.Release()
+		val, err := newItem(obj, t)
+		if err != nil {
+			return err
 		}
+		field.Set(val)
+		return nil
 	}
+
+	objs, err := j.EmbeddedArray(name)
+	if err != nil || objs == nil {
+		return err
+	}
+	defer releaseAll(objs)
+	ret := reflect.MakeSlice(t, len(objs), len(objs))
+	for idx, obj := range objs {
+		val, err := newItem(obj, t.Elem())
+		if err != nil {
+			return err
+		}
+		ret.Index(idx).Set(val)
+	}
+	field.Set(ret)
 	return nil
 }
 
@@ -234,10 +437,12 @@ func NewJobState(path string) (JobState, error) {
 		return JobState{}, fmt.Errorf("Path is not a valid ConcreteJob. Got: %s", conn.Class)
 	}
 
-	jobData, err := conn.GetResult()
+	// Jobs are polled, so their state must never come from the cache.
+	jobData, err := conn.GetResult(Options{NoCache: true})
 	if err != nil {
 		return JobState{}, err
 	}
+	defer jobData.Release()
 
 	j := JobState{}
 	err = PopulateStruct(jobData, &j)
@@ -247,21 +452,84 @@ func NewJobState(path string) (JobState, error) {
 	return j, nil
 }
 
-// WaitForJob will wait for a WMI job to complete
+// WaitForJob will wait for a WMI job to complete. Jobs change state
+// behind the back of the query cache, so once the job ends, the cached
+// results of its namespace are dropped.
 func WaitForJob(jobPath string) error {
+	return WaitForJobContext(context.Background(), jobPath, nil)
+}
+
+// WaitForJobContext waits for a WMI job to complete, like WaitForJob. If
+// progress is not nil, it is called with the completion percentage of the
+// job each time it changes. If ctx is done first, the job is asked to
+// terminate and the error of ctx is returned.
+func WaitForJobContext(ctx context.Context, jobPath string, progress func(percent int)) error {
+	err := waitForJob(ctx, jobPath, progress)
+	if cache := queryCache(); cache != nil {
+		namespace := ""
+		if loc, locErr := NewLocation(jobPath); locErr == nil {
+			namespace = loc.Namespace
+		}
+		cache.Invalidate(namespace)
+	}
+	return err
+}
+
+func waitForJob(ctx context.Context, jobPath string, progress func(percent int)) (err error) {
+	e := Event{
+		Kind:  EventJobWait,
+		Class: pathClass(jobPath),
+		Path:  jobPath,
+	}
+	if loc, err := NewLocation(jobPath); err == nil {
+		e.Namespace = loc.Namespace
+	}
+	obs := observe(e)
+	defer func() { obs.end(err) }()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	lastPercent := -1
 	for {
 		jobData, err := NewJobState(jobPath)
 		if err != nil {
 			return err
 		}
-		if jobData.JobState == JobStatusRunning {
-			time.Sleep(100 * time.Millisecond)
-			continue
+		if progress != nil && int(jobData.PercentComplete) != lastPercent {
+			lastPercent = int(jobData.PercentComplete)
+			progress(lastPercent)
 		}
-		if jobData.JobState != JobStateCompleted {
+		// States below Completed (New, Starting, Running, Suspended and
+		// Shutting Down) are not final. The ones above it are failures.
+		switch {
+		case jobData.JobState == JobStateCompleted:
+			return nil
+		case jobData.JobState > JobStateCompleted:
 			return fmt.Errorf("Job failed: %s (%d)", jobData.ErrorDescription, jobData.ErrorCode)
 		}
-		break
+		select {
+		case <-ctx.Done():
+			terminateJob(jobPath)
+			return errors.Wrap(ctx.Err(), "job cancelled")
+		case <-ticker.C:
+		}
+	}
+}
+
+// terminateJob asks the job at jobPath to terminate. Errors are ignored,
+// as the job may have just ended.
+func terminateJob(jobPath string) {
+	loc, err := NewLocation(jobPath)
+	if err != nil {
+		return
+	}
+	job, err := loc.GetResult(Options{NoCache: true})
+	if err != nil {
+		return
+	}
+	defer job.Release()
+	if out, err := job.Call("RequestStateChange", map[string]interface{}{
+		"RequestedState": JobRequestTerminate,
+	}); err == nil {
+		out.Release()
 	}
-	return nil
 }
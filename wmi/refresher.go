@@ -0,0 +1,221 @@
+package wmi
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	"github.com/pkg/errors"
+)
+
+// Refresher wraps a SWbemRefresher. Objects and class enumerations are
+// registered once, and their values are updated in place on every call to
+// Refresh, without issuing new queries. Only classes backed by a high
+// performance provider (such as Win32_PerfRawData_* classes) can be added.
+// See: https://docs.microsoft.com/en-us/windows/win32/wmisdk/swbemrefresher
+type Refresher struct {
+	conn      *WMI
+	unknown   *ole.IUnknown
+	refresher *ole.IDispatch
+
+	lock sync.Mutex
+	// items holds the registered items, in the order they were added
+	items []*RefreshableItem
+}
+
+// RefreshableItem is an object or class enumeration registered
+// with a Refresher
+type RefreshableItem struct {
+	index  int32
+	isEnum bool
+	item   *Result
+	object *Result
+}
+
+// Index returns the index of this item in its Refresher
+func (r *RefreshableItem) Index() int32 {
+	return r.index
+}
+
+// IsEnum returns true if this item holds a class enumeration
+func (r *RefreshableItem) IsEnum() bool {
+	return r.isEnum
+}
+
+// Object returns the refreshed object. The same *Result is returned after
+// every call to Refresh, holding the updated values. It is an error to call
+// Object on an enumeration.
+func (r *RefreshableItem) Object() (*Result, error) {
+	if r.isEnum {
+		return nil, fmt.Errorf("item %d is an enumeration", r.index)
+	}
+	return r.object, nil
+}
+
+// Elements returns the instances currently held by an enumeration. The set
+// of instances may change between refreshes, so Elements should be called
+// after every call to Refresh. The returned results should be released once
+// they are no longer needed.
+func (r *RefreshableItem) Elements() ([]*Result, error) {
+	if !r.isEnum {
+		return nil, fmt.Errorf("item %d is not an enumeration", r.index)
+	}
+	objectSet, err := r.item.GetProperty("ObjectSet")
+	if err != nil {
+		return nil, errors.Wrap(err, "ObjectSet")
+	}
+	defer objectSet.Release()
+	return objectSet.Elements()
+}
+
+func (r *RefreshableItem) release() {
+	r.object.Release()
+	r.item.Release()
+}
+
+// NewRefresher returns a new *Refresher bound to this connection
+func (w *WMI) NewRefresher() (*Refresher, error) {
+	if w.replay != nil {
+		return nil, errors.Wrap(errNotReplayable, "NewRefresher")
+	}
+	unknown, err := oleutil.CreateObject("WbemScripting.SWbemRefresher")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating SWbemRefresher")
+	}
+	refresher, err := unknown.QueryInterface(ole.IID_IDispatch)
+	if err != nil {
+		unknown.Release()
+		return nil, errors.Wrap(err, "QueryInterface")
+	}
+	if _, err := oleutil.PutProperty(refresher, "AutoReconnect", true); err != nil {
+		refresher.Release()
+		unknown.Release()
+		return nil, errors.Wrap(err, "AutoReconnect")
+	}
+	return &Refresher{
+		conn:      w,
+		unknown:   unknown,
+		refresher: refresher,
+	}, nil
+}
+
+func (r *Refresher) add(method, name string, isEnum bool) (*RefreshableItem, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.refresher == nil {
+		return nil, fmt.Errorf("refresher is closed")
+	}
+	services, err := r.conn.conn.servicesObject()
+	if err != nil {
+		return nil, err
+	}
+	rawItem, err := oleutil.CallMethod(r.refresher, method, services, name)
+	services.Release()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s(%s)", method, name)
+	}
+	item := r.conn.newResult(rawItem)
+	idx, err := item.GetProperty("Index")
+	if err != nil {
+		item.Release()
+		return nil, errors.Wrap(err, "Index")
+	}
+	defer idx.Release()
+	index, ok := idx.Value().(int32)
+	if !ok {
+		item.Release()
+		return nil, fmt.Errorf("invalid refreshable item index")
+	}
+
+	ret := &RefreshableItem{
+		index:  index,
+		isEnum: isEnum,
+		item:   item,
+	}
+	if !isEnum {
+		ret.object, err = item.GetProperty("Object")
+		if err != nil {
+			item.Release()
+			return nil, errors.Wrap(err, "Object")
+		}
+	}
+	r.items = append(r.items, ret)
+	return ret, nil
+}
+
+// AddObject registers the instance identified by path with this refresher
+func (r *Refresher) AddObject(path string) (*RefreshableItem, error) {
+	return r.add("Add", path, false)
+}
+
+// AddEnum registers all instances of class with this refresher
+func (r *Refresher) AddEnum(class string) (*RefreshableItem, error) {
+	return r.add("AddEnum", class, true)
+}
+
+// Remove unregisters item from this refresher
+func (r *Refresher) Remove(item *RefreshableItem) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.refresher == nil {
+		return fmt.Errorf("refresher is closed")
+	}
+	if _, err := oleutil.CallMethod(r.refresher, "Remove", item.index); err != nil {
+		return errors.Wrap(err, "Remove")
+	}
+	item.release()
+	for idx, val := range r.items {
+		if val == item {
+			r.items = append(r.items[:idx], r.items[idx+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Items returns the items registered with this refresher, in the
+// order they were added
+func (r *Refresher) Items() []*RefreshableItem {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ret := make([]*RefreshableItem, len(r.items))
+	copy(ret, r.items)
+	return ret
+}
+
+// Refresh updates all registered items with their current values
+func (r *Refresher) Refresh() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.refresher == nil {
+		return fmt.Errorf("refresher is closed")
+	}
+	if _, err := oleutil.CallMethod(r.refresher, "Refresh"); err != nil {
+		return errors.Wrap(err, "Refresh")
+	}
+	return nil
+}
+
+// Close removes all items and releases the refresher
+func (r *Refresher) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.refresher == nil {
+		return
+	}
+	oleutil.CallMethod(r.refresher, "DeleteAll")
+	for _, val := range r.items {
+		val.release()
+	}
+	r.refresher.Release()
+	r.unknown.Release()
+	r.refresher = nil
+	r.unknown = nil
+	r.items = nil
+}
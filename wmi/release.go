@@ -0,0 +1,203 @@
+package wmi
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-ole/go-ole"
+)
+
+var (
+	trackLock     sync.Mutex
+	trackEnabled  bool
+	trackedResult = map[*Result]string{}
+)
+
+// Leak describes a *Result that was acquired and never released
+type Leak struct {
+	// Stack is the stack trace of the call that acquired the result
+	Stack string
+}
+
+// EnableLeakTracking toggles tracking of outstanding results. While enabled,
+// every *Result records the stack trace of the call that acquired it, until
+// it is released. This is meant for debugging and tests. Results acquired
+// while tracking is disabled are never tracked.
+func EnableLeakTracking(enabled bool) {
+	trackLock.Lock()
+	defer trackLock.Unlock()
+	trackEnabled = enabled
+	if !enabled {
+		trackedResult = map[*Result]string{}
+	}
+}
+
+// OutstandingResults returns the tracked results that have
+// not yet been released.
+func OutstandingResults() []Leak {
+	trackLock.Lock()
+	defer trackLock.Unlock()
+	ret := make([]Leak, 0, len(trackedResult))
+	for _, stack := range trackedResult {
+		ret = append(ret, Leak{Stack: stack})
+	}
+	return ret
+}
+
+// CheckLeaks returns an error describing every tracked result that has
+// not yet been released, or nil if there are none.
+func CheckLeaks() error {
+	leaks := OutstandingResults()
+	if len(leaks) == 0 {
+		return nil
+	}
+	stacks := make([]string, len(leaks))
+	for idx, val := range leaks {
+		stacks[idx] = val.Stack
+	}
+	return fmt.Errorf("%d results were not released:\n%s", len(leaks), strings.Join(stacks, "\n"))
+}
+
+func track(r *Result) {
+	trackLock.Lock()
+	defer trackLock.Unlock()
+	if !trackEnabled {
+		return
+	}
+	trackedResult[r] = string(debug.Stack())
+}
+
+func untrack(r *Result) {
+	trackLock.Lock()
+	defer trackLock.Unlock()
+	delete(trackedResult, r)
+}
+
+// newResult wraps v in a *Result owned by session, which may be nil
+func newResult(session *Session, v *ole.VARIANT) *Result {
+	r := &Result{
+		rawRes:  v,
+		session: session,
+	}
+	track(r)
+	if session != nil {
+		session.add(r)
+	}
+	return r
+}
+
+// child wraps v in a *Result owned by the same session as r
+func (r *Result) child(v *ole.VARIANT) *Result {
+	ret := newResult(r.session, v)
+	ret.conn = r.conn
+	return ret
+}
+
+// newResult wraps v in a *Result owned by the session of this connection
+func (w *WMI) newResult(v *ole.VARIANT) *Result {
+	ret := newResult(w.session, v)
+	ret.conn = w.conn
+	return ret
+}
+
+// Release frees the COM resources held by this result. The result must
+// not be used afterwards. Releasing a result more than once is a no-op.
+func (r *Result) Release() {
+	if r == nil || (r.rawRes == nil && r.fake == nil) {
+		return
+	}
+	if r.rawRes != nil {
+		r.rawRes.Clear()
+	}
+	r.rawRes = nil
+	r.fake = nil
+	untrack(r)
+	if r.session != nil {
+		r.session.remove(r)
+	}
+	if r.owner != nil {
+		r.owner.Close()
+		r.owner = nil
+	}
+}
+
+// releaseAll releases every result in results
+func releaseAll(results []*Result) {
+	for _, val := range results {
+		val.Release()
+	}
+}
+
+// Session tracks all results acquired through it, and releases them when
+// closed. A Session embeds the *WMI it was created from, so queries and
+// method calls can be made directly on it. Results derived from results
+// acquired within a session, such as properties and elements, belong to
+// the same session. Results released before the session is closed are
+// dropped from it, so a long lived session only holds on to the results
+// still in use.
+type Session struct {
+	*WMI
+
+	lock sync.Mutex
+	// results maps the outstanding results to their order of acquisition
+	results map[*Result]uint64
+	seq     uint64
+}
+
+// NewSession returns a new *Session using this connection. Closing the
+// session does not close the connection.
+func (w *WMI) NewSession() *Session {
+	s := &Session{
+		results: map[*Result]uint64{},
+	}
+	conn := *w
+	conn.session = s
+	s.WMI = &conn
+	return s
+}
+
+// WithSession runs f within a new session, which is closed when f returns
+func (w *WMI) WithSession(f func(s *Session) error) error {
+	s := w.NewSession()
+	defer s.Close()
+	return f(s)
+}
+
+func (s *Session) add(r *Result) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.results == nil {
+		s.results = map[*Result]uint64{}
+	}
+	s.seq++
+	s.results[r] = s.seq
+}
+
+func (s *Session) remove(r *Result) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.results, r)
+}
+
+// Close releases every result acquired within this session, in reverse
+// order of acquisition. The underlying connection stays open.
+func (s *Session) Close() {
+	s.lock.Lock()
+	results := make([]*Result, 0, len(s.results))
+	for r := range s.results {
+		results = append(results, r)
+	}
+	seq := s.results
+	s.results = map[*Result]uint64{}
+	s.lock.Unlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return seq[results[i]] > seq[results[j]]
+	})
+	for _, r := range results {
+		r.Release()
+	}
+}
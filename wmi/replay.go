@@ -0,0 +1,350 @@
+package wmi
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-ole/go-ole"
+	"github.com/pkg/errors"
+)
+
+// errNotReplayable is returned by features that replay connections
+// cannot serve from a fixture.
+var errNotReplayable = errors.New("not supported by replay connections")
+
+// replayValue is the value held by a *Result served from a fixture, or
+// by an embedded object decoded from text, in which case replayer is nil.
+type replayValue struct {
+	replayer *Replayer
+	kind     string
+	vt       ole.VT
+
+	value   interface{}
+	values  []interface{}
+	object  *cimObject
+	objects []*cimObject
+	path    *FixturePath
+}
+
+// connect returns a connection served by this replayer. The connection
+// attempt itself must have been recorded.
+func (r *Replayer) connect(params []interface{}) (*WMI, error) {
+	server, namespace := connectionTarget(params)
+	entry, err := r.next(entryKey(OpConnect, namespace, server, "ConnectServer", nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	if entry.Error != nil {
+		return nil, errors.Wrap(entry.Error.err(), "ConnectServer")
+	}
+	return &WMI{
+		conn:      &connState{},
+		replay:    r,
+		params:    params,
+		Server:    server,
+		Namespace: namespace,
+	}, nil
+}
+
+// serve returns the recorded answer to a call as a *Result owned
+// by session and conn
+func (r *Replayer) serve(session *Session, conn *connState, key string) (*Result, *FixtureEntry, error) {
+	entry, err := r.next(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry.Error != nil {
+		return nil, entry, entry.Error.err()
+	}
+	if entry.Result == nil {
+		return nil, entry, fmt.Errorf("no result recorded for %s", key)
+	}
+	val, err := r.newValue(entry.Result)
+	if err != nil {
+		return nil, entry, err
+	}
+	return newReplayResult(session, conn, val), entry, nil
+}
+
+func newReplayResult(session *Session, conn *connState, val *replayValue) *Result {
+	ret := newResult(session, nil)
+	ret.conn = conn
+	ret.fake = val
+	return ret
+}
+
+// decodeObject rebuilds a recorded object
+func decodeObject(obj FixtureObject) (*cimObject, error) {
+	ret, err := decodeCIMXML(obj.XML, obj.Types)
+	if err != nil {
+		return nil, err
+	}
+	ret.Path = obj.Path
+	return ret, nil
+}
+
+// newValue rebuilds a recorded result
+func (r *Replayer) newValue(res *FixtureResult) (*replayValue, error) {
+	ret := &replayValue{
+		replayer: r,
+		kind:     res.Kind,
+		vt:       ole.VT_DISPATCH,
+	}
+	switch res.Kind {
+	case ResultNull:
+		ret.vt = ole.VT_NULL
+	case ResultValue:
+		if res.Value == nil {
+			return nil, fmt.Errorf("missing recorded value")
+		}
+		ret.vt = ole.VT(res.Value.VT)
+		if ret.vt&ole.VT_ARRAY == 0 {
+			val, err := parseVariantText(ret.vt, res.Value.Value)
+			if err != nil {
+				return nil, err
+			}
+			ret.value = val
+			break
+		}
+		ret.values = make([]interface{}, len(res.Value.Values))
+		for idx, text := range res.Value.Values {
+			val, err := parseVariantText(ret.vt, text)
+			if err != nil {
+				return nil, err
+			}
+			ret.values[idx] = val
+		}
+	case ResultObject:
+		if len(res.Objects) != 1 {
+			return nil, fmt.Errorf("expected 1 recorded object, got %d", len(res.Objects))
+		}
+		obj, err := decodeObject(res.Objects[0])
+		if err != nil {
+			return nil, err
+		}
+		ret.object = obj
+	case ResultSet:
+		for _, val := range res.Objects {
+			obj, err := decodeObject(val)
+			if err != nil {
+				return nil, err
+			}
+			ret.objects = append(ret.objects, obj)
+		}
+	case ResultPath:
+		if res.Path == nil {
+			return nil, fmt.Errorf("missing recorded path")
+		}
+		ret.path = res.Path
+	case ResultOpaque:
+	default:
+		return nil, fmt.Errorf("unsupported recorded result kind %q", res.Kind)
+	}
+	return ret, nil
+}
+
+func (v *replayValue) scalar(vt ole.VT, val interface{}) *replayValue {
+	return &replayValue{replayer: v.replayer, kind: ResultValue, vt: vt, value: val}
+}
+
+// identity returns the target under which calls on this object were
+// recorded. See Result.identity.
+func (v *replayValue) identity() string {
+	if v.object == nil {
+		return ""
+	}
+	if v.object.Path != "" {
+		return v.object.Path
+	}
+	return v.object.Class
+}
+
+func (v *replayValue) objectPath() *FixturePath {
+	ret := &FixturePath{
+		Path:    v.object.Path,
+		RelPath: v.object.Path,
+		Class:   v.object.Class,
+	}
+	if strings.HasPrefix(ret.Path, `\\`) {
+		if idx := strings.Index(ret.Path, ":"); idx >= 0 {
+			ret.RelPath = ret.Path[idx+1:]
+			location := strings.SplitN(ret.Path[2:idx], `\`, 2)
+			ret.Server = location[0]
+			if len(location) > 1 {
+				ret.Namespace = location[1]
+			}
+		}
+	}
+	return ret
+}
+
+func (v *replayValue) count() (int, error) {
+	if v.kind != ResultSet {
+		return 0, fmt.Errorf("Object is not a set")
+	}
+	return len(v.objects), nil
+}
+
+func (v *replayValue) itemAtIndex(i int) (*replayValue, error) {
+	if v.kind != ResultSet {
+		return nil, fmt.Errorf("Object is not a set")
+	}
+	if i < 0 || i >= len(v.objects) {
+		return nil, fmt.Errorf("index %d out of range", i)
+	}
+	return &replayValue{
+		replayer: v.replayer,
+		kind:     ResultObject,
+		vt:       ole.VT_DISPATCH,
+		object:   v.objects[i],
+	}, nil
+}
+
+func (v *replayValue) property(name string) (*replayValue, error) {
+	switch v.kind {
+	case ResultSet:
+		if strings.EqualFold(name, "Count") {
+			return v.scalar(ole.VT_I4, int32(len(v.objects))), nil
+		}
+	case ResultPath:
+		if val, ok := v.pathProperty(v.path, name); ok {
+			return val, nil
+		}
+	case ResultObject:
+		if strings.EqualFold(name, "Path_") {
+			return &replayValue{
+				replayer: v.replayer,
+				kind:     ResultPath,
+				vt:       ole.VT_DISPATCH,
+				path:     v.objectPath(),
+			}, nil
+		}
+		prop := v.object.property(name)
+		if prop == nil {
+			break
+		}
+		if prop.Null {
+			return v.scalar(ole.VT_NULL, nil), nil
+		}
+		if prop.VT == ole.VT_DISPATCH || prop.VT == ole.VT_UNKNOWN {
+			obj, err := decodeCIMXML(prop.Text, nil)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decoding %s", name)
+			}
+			return &replayValue{
+				replayer: v.replayer,
+				kind:     ResultObject,
+				vt:       ole.VT_DISPATCH,
+				object:   obj,
+			}, nil
+		}
+		val, err := prop.goValue()
+		if err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+		ret := v.scalar(prop.VT, val)
+		if values, ok := val.([]interface{}); ok {
+			ret.value = nil
+			ret.values = values
+		}
+		return ret, nil
+	}
+	return nil, errors.Wrapf(errNotReplayable, "property %s", name)
+}
+
+func (v *replayValue) pathProperty(pth *FixturePath, name string) (*replayValue, bool) {
+	fields := map[string]string{
+		"path":      pth.Path,
+		"relpath":   pth.RelPath,
+		"class":     pth.Class,
+		"namespace": pth.Namespace,
+		"server":    pth.Server,
+	}
+	val, ok := fields[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+	return v.scalar(ole.VT_BSTR, val), true
+}
+
+// set updates the property name of this object, as SWbemObject would
+func (v *replayValue) set(name string, params []interface{}) error {
+	if v.kind != ResultObject || len(params) != 1 {
+		return errors.Wrapf(errNotReplayable, "setting %s", name)
+	}
+	prop := v.object.property(name)
+	if prop == nil {
+		return fmt.Errorf("%s has no property %s", v.object.Class, name)
+	}
+	val := params[0]
+	prop.Null = val == nil
+	prop.Text = ""
+	prop.Texts = nil
+	if val == nil {
+		return nil
+	}
+	if res, ok := val.(*Result); ok && res.fake != nil && res.fake.object != nil {
+		prop.Text = res.fake.object.encode()
+		return nil
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice {
+		prop.Text = formatCIMValue(val)
+		return nil
+	}
+	prop.Texts = make([]string, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		prop.Texts[i] = formatCIMValue(rv.Index(i).Interface())
+	}
+	return nil
+}
+
+func (v *replayValue) text() (string, error) {
+	if v.kind != ResultObject {
+		return "", errors.Wrap(errNotReplayable, "GetText_")
+	}
+	return v.object.encode(), nil
+}
+
+// call serves a call made on this object through Result.Get or Result.Call.
+// in holds the in parameters of calls made through Result.Call.
+func (v *replayValue) call(r *Result, method string, args []string, in map[string]interface{}) (*Result, error) {
+	if v.replayer == nil {
+		return nil, errors.Wrap(errDetached, method)
+	}
+	key := entryKey(OpObject, "", v.identity(), method, args, canonicalIn(in))
+	if !strings.EqualFold(method, "Refresh_") {
+		ret, _, err := v.replayer.serve(r.session, r.conn, key)
+		return ret, err
+	}
+
+	// Refresh_ records the refreshed object, which replaces ours.
+	ret, entry, err := v.replayer.serve(r.session, r.conn, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Result.Kind == ResultObject && ret.fake.object != nil {
+		v.object = ret.fake.object
+		ret.fake = v.scalar(ole.VT_EMPTY, nil)
+	}
+	return ret, nil
+}
+
+// keyProperties serves WMI.KeyProperties
+func (r *Replayer) keyProperties(namespace, class string) ([]string, error) {
+	entry, err := r.next(entryKey(OpKeys, namespace, class, "KeyProperties", nil, nil))
+	if err != nil {
+		return nil, err
+	}
+	if entry.Error != nil {
+		return nil, entry.Error.err()
+	}
+	if entry.Result == nil || entry.Result.Kind != ResultKeys {
+		return nil, fmt.Errorf("no keys recorded for %s", class)
+	}
+	ret := append([]string{}, entry.Result.Keys...)
+	sort.Strings(ret)
+	return ret, nil
+}
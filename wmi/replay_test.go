@@ -0,0 +1,174 @@
+package wmi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const vmPath = `\\\\HOST\\root\\virtualization\\v2:Msvm_ComputerSystem.CreationClassName=\"Msvm_ComputerSystem\",Name=\"0D1A\"`
+
+const replayFixture = `{
+  "version": 1,
+  "entries": [
+    {
+      "op": "connect",
+      "namespace": "root\\virtualization\\v2",
+      "target": ".",
+      "method": "ConnectServer"
+    },
+    {
+      "op": "service",
+      "namespace": "root\\virtualization\\v2",
+      "method": "ExecQuery",
+      "args": ["\"SELECT * FROM Msvm_ComputerSystem WHERE Name = '0D1A'\""],
+      "result": {
+        "kind": "set",
+        "objects": [
+          {
+            "path": "` + vmPath + `",
+            "xml": "<INSTANCE CLASSNAME=\"Msvm_ComputerSystem\"><PROPERTY NAME=\"Name\" TYPE=\"string\"><VALUE>0D1A</VALUE></PROPERTY><PROPERTY NAME=\"ElementName\" TYPE=\"string\"><VALUE>test-vm</VALUE></PROPERTY><PROPERTY NAME=\"EnabledState\" TYPE=\"uint16\"><VALUE>3</VALUE></PROPERTY><PROPERTY.ARRAY NAME=\"OperationalStatus\" TYPE=\"uint16\"><VALUE.ARRAY><VALUE>2</VALUE><VALUE>32768</VALUE></VALUE.ARRAY></PROPERTY.ARRAY><PROPERTY.ARRAY NAME=\"StatusDescriptions\" TYPE=\"string\"></PROPERTY.ARRAY></INSTANCE>",
+            "types": {"Name": 8, "ElementName": 8, "EnabledState": 3, "OperationalStatus": 8195}
+          }
+        ]
+      }
+    },
+    {
+      "op": "object",
+      "target": "` + vmPath + `",
+      "method": "ExecMethod_",
+      "args": ["\"RequestStateChange\"", "<object>", "int(0)", "context{}"],
+      "in": {"RequestedState": "2"},
+      "result": {
+        "kind": "object",
+        "objects": [
+          {
+            "xml": "<INSTANCE CLASSNAME=\"__PARAMETERS\"><PROPERTY NAME=\"ReturnValue\" TYPE=\"uint32\"><VALUE>0</VALUE></PROPERTY></INSTANCE>",
+            "types": {"ReturnValue": 3}
+          }
+        ]
+      }
+    }
+  ]
+}`
+
+type replayVM struct {
+	Name               string
+	ElementName        string
+	EnabledState       int32
+	OperationalStatus  []uint16
+	StatusDescriptions []string
+}
+
+func startTestReplay(t *testing.T) *Replayer {
+	fixture, err := ReadFixture(strings.NewReader(replayFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := StartReplay(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+func TestReplayQueryAndCall(t *testing.T) {
+	rp := startTestReplay(t)
+	defer rp.Stop()
+
+	conn, err := NewConnection(".", `root\virtualization\v2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	res, err := conn.ExecQuery("SELECT * FROM Msvm_ComputerSystem WHERE Name = '0D1A'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Release()
+	items, err := res.Elements()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected 1 object, got %d", len(items))
+	}
+	vm := items[0]
+
+	var got replayVM
+	if err := PopulateStruct(vm, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := replayVM{
+		Name:              "0D1A",
+		ElementName:       "test-vm",
+		EnabledState:      3,
+		OperationalStatus: []uint16{2, 32768},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := vm.Call("RequestStateChange", map[string]interface{}{"RequestedState": 3}); err == nil {
+		t.Fatal("call with other in parameters matched the recorded call")
+	}
+	out, err := vm.Call("RequestStateChange", map[string]interface{}{"RequestedState": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Release()
+	if err := out.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCIMXMLReferenceRoundTrip(t *testing.T) {
+	paths := []string{
+		`\\HOST\root\virtualization\v2:Msvm_ComputerSystem.CreationClassName="Msvm_ComputerSystem",Name="0D1A"`,
+		`root\virtualization\v2:Msvm_VirtualSystemSettingData.InstanceID="Microsoft:0D1A"`,
+		`Msvm_ResourcePool.InstanceID="Microsoft:Definition\\Path \"quoted\"",Primordial=TRUE,PoolID=7`,
+		`Msvm_VirtualSystemManagementService=@`,
+	}
+	for _, pth := range paths {
+		obj := &cimObject{
+			Class: "Msvm_SettingsDefineState",
+			Properties: []*cimProperty{
+				{
+					Name:           "ManagedElement",
+					Type:           "reference",
+					ReferenceClass: "CIM_ManagedElement",
+					IsReference:    true,
+					Text:           pth,
+				},
+				{
+					Name:        "SettingData",
+					Type:        "reference",
+					IsReference: true,
+					Null:        true,
+				},
+			},
+		}
+		text := obj.encode()
+		if !strings.Contains(text, "<PROPERTY.REFERENCE") {
+			t.Fatalf("reference not encoded as PROPERTY.REFERENCE: %s", text)
+		}
+		decoded, err := decodeCIMXML(text, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		prop := decoded.property("ManagedElement")
+		if prop == nil || !prop.IsReference || prop.ReferenceClass != "CIM_ManagedElement" {
+			t.Fatalf("ManagedElement not decoded as a reference: %+v", prop)
+		}
+		if prop.Text != pth {
+			t.Fatalf("got path %s, want %s", prop.Text, pth)
+		}
+		if null := decoded.property("SettingData"); null == nil || !null.Null {
+			t.Fatalf("SettingData not decoded as null: %+v", null)
+		}
+		if again := decoded.encode(); again != text {
+			t.Fatalf("encoding is not stable:\n%s\n%s", text, again)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package wmi
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/go-ole/go-ole/oleutil"
+	"github.com/pkg/errors"
+)
+
+// RetryClass is a class of transient errors that a RetryPolicy may retry
+type RetryClass int
+
+// Classes of transient errors
+const (
+	// RetryCallCancelled covers WBEM_E_CALL_CANCELLED, which providers
+	// return when they shed load.
+	RetryCallCancelled RetryClass = 1 << iota
+	// RetryDisconnected covers dropped RPC connections. The connection
+	// is rebuilt before the call is retried.
+	RetryDisconnected
+	// RetryInvalidState covers methods returning 32775 (Invalid State),
+	// which Hyper-V returns while an object is changing state.
+	RetryInvalidState
+
+	// RetryAll covers all classes of transient errors
+	RetryAll = RetryCallCancelled | RetryDisconnected | RetryInvalidState
+)
+
+// readMethods are the SWbemServices methods that do not change state,
+// and are retried without the caller opting in.
+var readMethods = map[string]bool{
+	"get":           true,
+	"execquery":     true,
+	"subclassesof":  true,
+	"instancesof":   true,
+	"associatorsof": true,
+	"referencesto":  true,
+}
+
+// defaultMaxAttempts bounds the attempts of policies that set
+// neither MaxDuration nor MaxAttempts
+const defaultMaxAttempts = 10
+
+// RetryPolicy controls how calls failing with transient errors are
+// retried. Queries and object retrieval are retried by the policy of
+// their connection. Method calls change state, so they are only retried
+// when RetryMutations is set, or when a policy is passed in the Options
+// of the call.
+type RetryPolicy struct {
+	// Classes holds the classes of errors to retry
+	Classes RetryClass
+	// InitialBackoff is the wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between two attempts
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after every attempt
+	Multiplier float64
+	// Jitter is the fraction of every wait, between 0 and 1, that is
+	// randomized, so clients do not retry in lockstep.
+	Jitter float64
+	// MaxDuration is the total time after which retrying stops
+	MaxDuration time.Duration
+	// MaxAttempts is the number of attempts after which retrying
+	// stops. If both MaxDuration and MaxAttempts are zero, calls are
+	// attempted at most 10 times.
+	MaxAttempts int
+	// RetryMutations enables retries of method calls
+	RetryMutations bool
+}
+
+// DefaultRetryPolicy returns a policy retrying all transient errors of
+// read operations for up to 30 seconds.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Classes:        RetryAll,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxDuration:    30 * time.Second,
+	}
+}
+
+// classifyError returns the class of transient errors err belongs
+// to, or 0 if it is not transient.
+func classifyError(err error) RetryClass {
+	if IsHResult(err, WBEMCallCancelled) {
+		return RetryCallCancelled
+	}
+	if IsHResult(err, RPCDisconnected, RPCServerUnavailable, RPCCallFailed, WBEMTransportFailure) {
+		return RetryDisconnected
+	}
+	if methodErr, ok := errors.Cause(err).(*MethodError); ok && methodErr.Code == ReturnInvalidState {
+		return RetryInvalidState
+	}
+	return 0
+}
+
+// IsTransient returns true if err is one of the transient
+// errors a RetryPolicy can retry.
+func IsTransient(err error) bool {
+	return classifyError(err) != 0
+}
+
+// backoff returns the wait before retry number attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	wait := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt))
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		wait -= wait * p.Jitter * rand.Float64()
+	}
+	return time.Duration(wait)
+}
+
+// run calls f until it succeeds, fails with an error this policy does not
+// retry, MaxDuration elapses or MaxAttempts is reached. After a dropped
+// connection, reconnect is called before the next attempt.
+func (p RetryPolicy) run(f func() error, reconnect func() error) error {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		class := classifyError(err)
+		if class == 0 || p.Classes&class == 0 {
+			return err
+		}
+		wait := p.backoff(attempt)
+		maxAttempts := p.MaxAttempts
+		if maxAttempts <= 0 && p.MaxDuration <= 0 {
+			maxAttempts = defaultMaxAttempts
+		}
+		if (maxAttempts > 0 && attempt+1 >= maxAttempts) ||
+			(p.MaxDuration > 0 && time.Since(start)+wait > p.MaxDuration) {
+			return errors.Wrapf(err, "giving up after %d attempts", attempt+1)
+		}
+		time.Sleep(wait)
+		if class == RetryDisconnected && reconnect != nil {
+			// If reconnecting fails, the next attempt fails on the
+			// dropped connection and is retried in turn.
+			reconnect()
+		}
+	}
+}
+
+// retryPolicyFor returns the policy that applies to a call, or nil if the
+// call is not retried. A policy passed with the call always applies. The
+// connection policy applies to calls that change state only if it has
+// RetryMutations set.
+func retryPolicyFor(conn, call *RetryPolicy, mutating bool) *RetryPolicy {
+	if call != nil {
+		return call
+	}
+	if conn == nil || (mutating && !conn.RetryMutations) {
+		return nil
+	}
+	return conn
+}
+
+// SetRetryPolicy sets the retry policy of this connection. It applies to
+// the sessions of this connection and to all results acquired through it.
+// Use nil to disable retries.
+func (w *WMI) SetRetryPolicy(p *RetryPolicy) {
+	w.conn.lock.Lock()
+	defer w.conn.lock.Unlock()
+	w.conn.retry = p
+}
+
+// reconnect replaces the SWbemServices object of this connection with a
+// new one. Results acquired before the reconnect remain bound to the
+// dropped connection until they are rebound.
+func (w *WMI) reconnect() error {
+	if w.replay != nil {
+		return nil
+	}
+	return w.conn.reconnect()
+}
+
+func (c *connState) reconnect() error {
+	c.lock.RLock()
+	locator := c.locator
+	if locator != nil {
+		locator.AddRef()
+	}
+	c.lock.RUnlock()
+	if locator == nil {
+		return errors.New("connection is closed")
+	}
+	defer locator.Release()
+
+	rawSvc, err := oleutil.CallMethod(locator, "ConnectServer", c.params...)
+	if err != nil {
+		return errors.Wrap(err, "ConnectServer")
+	}
+	c.lock.Lock()
+	if c.locator == nil {
+		c.lock.Unlock()
+		rawSvc.Clear()
+		return errors.New("connection is closed")
+	}
+	old := c.services
+	c.services = rawSvc.ToIDispatch()
+	c.lock.Unlock()
+	if old != nil {
+		old.Release()
+	}
+	return nil
+}
+
+// rebind reconnects the connection of this result, and replaces the
+// object it holds with the same object fetched by path over the new
+// connection. Objects without a path, such as query results and method
+// out parameters, cannot be rebound.
+func (r *Result) rebind() error {
+	if r.fake != nil || r.conn == nil {
+		return nil
+	}
+	if err := r.conn.reconnect(); err != nil {
+		return err
+	}
+	r.describe()
+	if r.path == "" {
+		return errors.New("object has no path and cannot be fetched again")
+	}
+	services, err := r.conn.servicesObject()
+	if err != nil {
+		return err
+	}
+	defer services.Release()
+	rawRes, err := oleutil.CallMethod(services, "Get", r.path)
+	if err != nil {
+		return errors.Wrapf(err, "getting %s", r.path)
+	}
+	old := r.rawRes
+	r.rawRes = rawRes
+	if old != nil {
+		old.Clear()
+	}
+	return nil
+}
+
+// isReadMethod returns true if the SWbemServices method does not change state
+func isReadMethod(method string) bool {
+	return readMethods[strings.ToLower(method)]
+}
+
+// isReadObjectMethod returns true if the SWbemObject method does not
+// change state
+func isReadObjectMethod(method string) bool {
+	return objectReadMethods[strings.ToLower(method)]
+}
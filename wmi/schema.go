@@ -0,0 +1,491 @@
+package wmi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	"github.com/pkg/errors"
+)
+
+// ErrNotWritable is returned by Set in strict mode when the property
+// is not qualified as Write.
+var ErrNotWritable = errors.New("property is not writable")
+
+// cimTypeNames maps the values of WbemCimtypeEnum to CIM type names. See:
+// https://docs.microsoft.com/en-us/windows/win32/api/wbemdisp/ne-wbemdisp-wbemcimtypeenum
+var cimTypeNames = map[int64]string{
+	2:   "sint16",
+	3:   "sint32",
+	4:   "real32",
+	5:   "real64",
+	8:   "string",
+	11:  "boolean",
+	13:  "object",
+	16:  "sint8",
+	17:  "uint8",
+	18:  "uint16",
+	19:  "uint32",
+	20:  "sint64",
+	21:  "uint64",
+	101: "datetime",
+	102: "reference",
+	103: "char16",
+}
+
+// propertySchema is the definition of a property, as used by strict mode
+type propertySchema struct {
+	Type     string
+	IsArray  bool
+	Writable bool
+}
+
+// SetStrictWrites toggles strict mode for this connection, its sessions
+// and all results acquired through them. In strict mode, Set checks values
+// against the CIM type of the property and converts compatible Go types to
+// the type WMI expects, such as integers to the decimal strings used for
+// uint64 and sint64. Incompatible values are rejected, as are writes to
+// properties of existing instances that are not qualified as Write.
+// Instances of CIM_SettingData subclasses are exempt from the Write check,
+// as they are modified by passing them to methods, not with Put_.
+func (w *WMI) SetStrictWrites(enabled bool) {
+	w.conn.lock.Lock()
+	defer w.conn.lock.Unlock()
+	w.conn.strict = enabled
+}
+
+// strictWrites returns true if strict mode is enabled. It is
+// safe to call on a nil *connState.
+func (c *connState) strictWrites() bool {
+	if c == nil {
+		return false
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.strict
+}
+
+// classSchema returns the definitions of the properties of class, keyed
+// by lower case name. Definitions are cached for the life of the connection.
+func (c *connState) classSchema(namespace, class string) (map[string]propertySchema, error) {
+	key := strings.ToLower(namespace + ":" + class)
+	c.lock.RLock()
+	schema, ok := c.schemas[key]
+	c.lock.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	services, err := c.servicesObject()
+	if err != nil {
+		return nil, err
+	}
+	defer services.Release()
+	rawClass, err := oleutil.CallMethod(services, "Get", class)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting class %s", class)
+	}
+	classObj := newResult(nil, rawClass)
+	classObj.conn = c
+	defer classObj.Release()
+	settingData, err := isSettingData(classObj)
+	if err != nil {
+		return nil, err
+	}
+	props, err := classObj.properties()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseAll(props)
+	schema = make(map[string]propertySchema, len(props))
+	for _, prop := range props {
+		name, def, err := readPropertySchema(prop)
+		if err != nil {
+			return nil, err
+		}
+		if !settingData {
+			def.Writable, err = hasQualifier(prop, "write")
+			if err != nil {
+				return nil, err
+			}
+		}
+		schema[strings.ToLower(name)] = def
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.schemas == nil {
+		c.schemas = map[string]map[string]propertySchema{}
+	}
+	c.schemas[key] = schema
+	return schema, nil
+}
+
+// isSettingData returns true if class derives from CIM_SettingData.
+// Setting data, such as the RASD classes of Hyper-V, is edited locally
+// and handed to methods like ModifyResourceSettings as embedded instances,
+// never written with Put_, so the Write qualifier does not apply to it.
+func isSettingData(class *Result) (bool, error) {
+	derivation, err := class.getProperty("Derivation_")
+	if err != nil {
+		return false, errors.Wrap(err, "Derivation_")
+	}
+	defer derivation.Release()
+	for _, val := range derivation.ToValueArray() {
+		if name, ok := val.(string); ok && strings.EqualFold(name, "CIM_SettingData") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readPropertySchema returns the name and type of the SWbemProperty in prop
+func readPropertySchema(prop *Result) (string, propertySchema, error) {
+	values := map[string]interface{}{}
+	for _, field := range []string{"Name", "CIMType", "IsArray"} {
+		val, err := prop.getProperty(field)
+		if err != nil {
+			return "", propertySchema{}, errors.Wrap(err, field)
+		}
+		values[field] = val.Value()
+		val.Release()
+	}
+	name, _ := values["Name"].(string)
+	cimType, err := toInt64(values["CIMType"])
+	if err != nil {
+		return "", propertySchema{}, errors.Wrapf(err, "CIMType of %s", name)
+	}
+	isArray, _ := values["IsArray"].(bool)
+	return name, propertySchema{
+		Type:     cimTypeNames[cimType],
+		IsArray:  isArray,
+		Writable: true,
+	}, nil
+}
+
+// propertySchema returns the definition of the property name of this
+// object. The Write qualifier is only checked on existing instances. New
+// instances and method parameters are being filled in, so all their
+// properties are writable.
+func (r *Result) propertySchema(name string) (propertySchema, error) {
+	if r.fake != nil {
+		if r.fake.object == nil {
+			return propertySchema{}, fmt.Errorf("Object has no properties")
+		}
+		prop := r.fake.object.property(name)
+		if prop == nil {
+			return propertySchema{}, fmt.Errorf("%s has no property %s", r.fake.object.Class, name)
+		}
+		return propertySchema{Type: prop.Type, IsArray: prop.IsArray, Writable: true}, nil
+	}
+
+	r.describe()
+	if r.path != "" && r.class != "" {
+		schema, err := r.conn.classSchema(r.namespace, r.class)
+		if err != nil {
+			return propertySchema{}, err
+		}
+		def, ok := schema[strings.ToLower(name)]
+		if !ok {
+			return propertySchema{}, fmt.Errorf("%s has no property %s", r.class, name)
+		}
+		return def, nil
+	}
+
+	props, err := r.getProperty("Properties_")
+	if err != nil {
+		return propertySchema{}, errors.Wrap(err, "Properties_")
+	}
+	defer props.Release()
+	prop, err := props.invoke("Item", name)
+	if err != nil {
+		if IsHResult(err, WBEMNotFound) {
+			return propertySchema{}, fmt.Errorf("%s has no property %s", r.class, name)
+		}
+		return propertySchema{}, errors.Wrapf(err, "Properties_.Item(%s)", name)
+	}
+	defer prop.Release()
+	_, def, err := readPropertySchema(prop)
+	return def, err
+}
+
+// strictValue checks val against the definition of the property name
+// and converts it to the type WMI expects.
+func (r *Result) strictValue(name string, val interface{}) (interface{}, error) {
+	def, err := r.propertySchema(name)
+	if err != nil {
+		return nil, err
+	}
+	if !def.Writable {
+		return nil, errors.Wrapf(ErrNotWritable, "%s.%s", r.class, name)
+	}
+	if val == nil {
+		return nil, nil
+	}
+	if def.Type == "object" {
+		if _, ok := val.(*Result); !ok {
+			return nil, fmt.Errorf("%s expects an embedded object, got %T", name, val)
+		}
+		return val, nil
+	}
+	ret, err := convertValue(def.Type, def.IsArray, val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid value for %s", name)
+	}
+	return ret, nil
+}
+
+// convertValue converts val to the Go type the scripting API expects for
+// a property of type cimType. Compatible Go types are converted, and
+// incompatible ones rejected.
+func convertValue(cimType string, isArray bool, val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	cimType = strings.ToLower(cimType)
+	if !isArray {
+		return convertScalar(cimType, val)
+	}
+
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("expected an array of %s, got %T", cimType, val)
+	}
+	items := make([]interface{}, rv.Len())
+	unsigned := false
+	for i := range items {
+		item, err := convertScalar(cimType, rv.Index(i).Interface())
+		if err != nil {
+			return nil, errors.Wrapf(err, "element %d", i)
+		}
+		if _, ok := item.(uint32); ok {
+			unsigned = true
+		}
+		items[i] = item
+	}
+	switch defaultVT(cimType, false) {
+	case ole.VT_BSTR:
+		ret := make([]string, len(items))
+		for i, item := range items {
+			ret[i] = item.(string)
+		}
+		return ret, nil
+	case ole.VT_UI1:
+		ret := make([]byte, len(items))
+		for i, item := range items {
+			ret[i] = item.(uint8)
+		}
+		return ret, nil
+	case ole.VT_I2:
+		ret := make([]int16, len(items))
+		for i, item := range items {
+			ret[i] = item.(int16)
+		}
+		return ret, nil
+	case ole.VT_I4:
+		if unsigned {
+			// uint32 values above math.MaxInt32 do not fit a VT_I4
+			ret := make([]uint32, len(items))
+			for i, item := range items {
+				switch v := item.(type) {
+				case int32:
+					ret[i] = uint32(v)
+				case uint32:
+					ret[i] = v
+				}
+			}
+			return ret, nil
+		}
+		ret := make([]int32, len(items))
+		for i, item := range items {
+			ret[i] = item.(int32)
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("arrays of %s are not supported", cimType)
+}
+
+// integerRanges holds the bounds of the CIM integer types
+var integerRanges = map[string][2]*big.Int{}
+
+func init() {
+	for _, bits := range []uint{8, 16, 32, 64} {
+		one := big.NewInt(1)
+		maxSigned := new(big.Int).Sub(new(big.Int).Lsh(one, bits-1), one)
+		minSigned := new(big.Int).Neg(new(big.Int).Lsh(one, bits-1))
+		maxUnsigned := new(big.Int).Sub(new(big.Int).Lsh(one, bits), one)
+		integerRanges[fmt.Sprintf("sint%d", bits)] = [2]*big.Int{minSigned, maxSigned}
+		integerRanges[fmt.Sprintf("uint%d", bits)] = [2]*big.Int{big.NewInt(0), maxUnsigned}
+	}
+	integerRanges["char16"] = integerRanges["uint16"]
+}
+
+func convertScalar(cimType string, val interface{}) (interface{}, error) {
+	switch cimType {
+	case "boolean":
+		if v, ok := val.(bool); ok {
+			return v, nil
+		}
+	case "string":
+		switch v := val.(type) {
+		case string:
+			return v, nil
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			// Numbers held in strings, such as RASD addresses
+			return fmt.Sprintf("%d", v), nil
+		}
+	case "reference":
+		if v, ok := val.(string); ok {
+			return v, nil
+		}
+	case "datetime":
+		switch v := val.(type) {
+		case string:
+			return v, nil
+		case time.Time:
+			return cimDatetime(v), nil
+		}
+	case "real32", "real64":
+		f, ok := floatValue(val)
+		if !ok {
+			break
+		}
+		if cimType == "real32" {
+			if math.Abs(f) > math.MaxFloat32 {
+				return nil, fmt.Errorf("%v overflows real32", f)
+			}
+			return float32(f), nil
+		}
+		return f, nil
+	case "char16":
+		if v, ok := val.(string); ok {
+			r, size := utf8.DecodeRuneInString(v)
+			if size != len(v) || size == 0 || r > math.MaxUint16 {
+				return nil, fmt.Errorf("%q is not a single char16", v)
+			}
+			return int16(r), nil
+		}
+		return convertInteger(cimType, val)
+	case "object":
+		return nil, fmt.Errorf("expected an embedded object, got %T", val)
+	default:
+		if _, ok := integerRanges[cimType]; ok {
+			return convertInteger(cimType, val)
+		}
+		return nil, fmt.Errorf("unsupported CIM type %q", cimType)
+	}
+	return nil, fmt.Errorf("expected a %s value, got %T", cimType, val)
+}
+
+// convertInteger converts val to the type the scripting API uses for the
+// integer type cimType, after checking it is in range.
+func convertInteger(cimType string, val interface{}) (interface{}, error) {
+	n, err := integerValue(val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "expected a %s value", cimType)
+	}
+	bounds := integerRanges[cimType]
+	if n.Cmp(bounds[0]) < 0 || n.Cmp(bounds[1]) > 0 {
+		return nil, fmt.Errorf("%s overflows %s", n, cimType)
+	}
+	switch cimType {
+	case "uint8":
+		return uint8(n.Uint64()), nil
+	case "sint8", "sint16", "char16":
+		return int16(n.Int64()), nil
+	case "uint16", "sint32":
+		return int32(n.Int64()), nil
+	case "uint32":
+		if n.Int64() > math.MaxInt32 {
+			return uint32(n.Uint64()), nil
+		}
+		return int32(n.Int64()), nil
+	}
+	// 64 bit integers are passed as strings
+	return n.String(), nil
+}
+
+// integerValue returns val as an integer. It accepts Go integers, whole
+// floats, and numbers held in strings or json.Number.
+func integerValue(val interface{}) (*big.Int, error) {
+	switch v := val.(type) {
+	case int, int8, int16, int32, int64:
+		return big.NewInt(reflect.ValueOf(v).Int()), nil
+	case uint, uint8, uint16, uint32, uint64:
+		return new(big.Int).SetUint64(reflect.ValueOf(v).Uint()), nil
+	case float32, float64:
+		f := reflect.ValueOf(v).Float()
+		if f != math.Trunc(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%v is not an integer", f)
+		}
+		n, _ := big.NewFloat(f).Int(nil)
+		return n, nil
+	case json.Number:
+		return integerValue(v.String())
+	case string:
+		n, ok := new(big.Int).SetString(strings.TrimSpace(v), 10)
+		if !ok {
+			return nil, fmt.Errorf("%q is not an integer", v)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("got %T", val)
+}
+
+// floatValue returns val as a float64 if it holds a number
+func floatValue(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float32, float64:
+		return reflect.ValueOf(v).Float(), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	n, err := integerValue(val)
+	if err != nil {
+		return 0, false
+	}
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return f, true
+}
+
+// cimDatetime formats t as a CIM datetime, such as 20200101120000.000000+060
+func cimDatetime(t time.Time) string {
+	_, offset := t.Zone()
+	sign := '+'
+	minutes := offset / 60
+	if minutes < 0 {
+		sign = '-'
+		minutes = -minutes
+	}
+	return fmt.Sprintf("%s.%06d%c%03d", t.Format("20060102150405"), t.Nanosecond()/1000, sign, minutes)
+}
+
+// ParseDatetime parses a CIM datetime, such as 20200101120000.000000+060,
+// as returned for properties of type datetime.
+func ParseDatetime(value string) (time.Time, error) {
+	if len(value) != 25 || value[14] != '.' || (value[21] != '+' && value[21] != '-') {
+		return time.Time{}, fmt.Errorf("invalid CIM datetime %q", value)
+	}
+	t, err := time.Parse("20060102150405.000000", value[:21])
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid CIM datetime %q", value)
+	}
+	minutes, err := strconv.Atoi(value[22:])
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid CIM datetime %q", value)
+	}
+	offset := minutes * 60
+	if value[21] == '-' {
+		offset = -offset
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.FixedZone("", offset)), nil
+}
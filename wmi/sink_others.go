@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package wmi
+
+import (
+	"github.com/go-ole/go-ole"
+)
+
+type asyncSink struct{}
+
+func newAsyncSink(onObject func(*ole.VARIANT), onCompleted func(error)) (*asyncSink, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *asyncSink) object() *ole.IDispatch {
+	return nil
+}
+
+func (s *asyncSink) cancel() {}
+
+func (s *asyncSink) close() {}
@@ -0,0 +1,228 @@
+//go:build windows
+// +build windows
+
+package wmi
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	"github.com/pkg/errors"
+)
+
+// iidSWbemSinkEvents is the outgoing dispinterface of SWbemSink
+var iidSWbemSinkEvents = ole.NewGUID("{75718CA0-F029-11D1-A1AC-00C04FB6C223}")
+
+// ISWbemSinkEvents dispatch IDs
+const (
+	dispidOnObjectReady = 1
+	dispidOnCompleted   = 2
+)
+
+var (
+	sinkVtblOnce sync.Once
+	sinkVtbl     *sinkEventsVtbl
+
+	// liveSinks keeps the event handlers handed to COM reachable
+	// until they are unadvised.
+	liveSinks     = map[*sinkEvents]struct{}{}
+	liveSinksLock sync.Mutex
+)
+
+type sinkEventsVtbl struct {
+	QueryInterface   uintptr
+	AddRef           uintptr
+	Release          uintptr
+	GetTypeInfoCount uintptr
+	GetTypeInfo      uintptr
+	GetIDsOfNames    uintptr
+	Invoke           uintptr
+}
+
+// dispParams mirrors the layout of DISPPARAMS
+type dispParams struct {
+	rgvarg            unsafe.Pointer
+	rgdispidNamedArgs unsafe.Pointer
+	cArgs             uint32
+	cNamedArgs        uint32
+}
+
+// arg returns the argument at idx, in declaration order. Arguments
+// are stored in reverse order in DISPPARAMS.
+func (d *dispParams) arg(idx int) *ole.VARIANT {
+	if idx >= int(d.cArgs) {
+		return nil
+	}
+	n := uintptr(int(d.cArgs) - 1 - idx)
+	v := (*ole.VARIANT)(unsafe.Pointer(uintptr(d.rgvarg) + n*unsafe.Sizeof(ole.VARIANT{})))
+	if v.VT == ole.VT_BYREF|ole.VT_VARIANT {
+		v = *(**ole.VARIANT)(unsafe.Pointer(&v.Val))
+	}
+	return v
+}
+
+// sinkEvents is an IDispatch implementation of ISWbemSinkEvents
+type sinkEvents struct {
+	vtbl *sinkEventsVtbl
+	ref  int32
+
+	onObject    func(*ole.VARIANT)
+	onCompleted func(error)
+}
+
+func sinkVtable() *sinkEventsVtbl {
+	sinkVtblOnce.Do(func() {
+		sinkVtbl = &sinkEventsVtbl{
+			QueryInterface:   syscall.NewCallback(sinkQueryInterface),
+			AddRef:           syscall.NewCallback(sinkAddRef),
+			Release:          syscall.NewCallback(sinkRelease),
+			GetTypeInfoCount: syscall.NewCallback(sinkGetTypeInfoCount),
+			GetTypeInfo:      syscall.NewCallback(sinkNotImplemented),
+			GetIDsOfNames:    syscall.NewCallback(sinkNotImplemented),
+			Invoke:           syscall.NewCallback(sinkInvoke),
+		}
+	})
+	return sinkVtbl
+}
+
+func sinkQueryInterface(this *sinkEvents, iid *ole.GUID, punk *unsafe.Pointer) uintptr {
+	if ole.IsEqualGUID(iid, ole.IID_IUnknown) ||
+		ole.IsEqualGUID(iid, ole.IID_IDispatch) ||
+		ole.IsEqualGUID(iid, iidSWbemSinkEvents) {
+		atomic.AddInt32(&this.ref, 1)
+		*punk = unsafe.Pointer(this)
+		return ole.S_OK
+	}
+	*punk = nil
+	return ole.E_NOINTERFACE
+}
+
+func sinkAddRef(this *sinkEvents) uintptr {
+	return uintptr(atomic.AddInt32(&this.ref, 1))
+}
+
+func sinkRelease(this *sinkEvents) uintptr {
+	return uintptr(atomic.AddInt32(&this.ref, -1))
+}
+
+func sinkGetTypeInfoCount(this *sinkEvents, count *uint32) uintptr {
+	if count != nil {
+		*count = 0
+	}
+	return ole.S_OK
+}
+
+func sinkNotImplemented(this *sinkEvents) uintptr {
+	return ole.E_NOTIMPL
+}
+
+func sinkInvoke(this *sinkEvents, dispid uintptr, riid, lcid, flags uintptr, params *dispParams, result, excepInfo, argErr uintptr) uintptr {
+	switch int32(dispid) {
+	case dispidOnObjectReady:
+		obj := params.arg(0)
+		if obj == nil || obj.VT != ole.VT_DISPATCH {
+			return ole.S_OK
+		}
+		obj.ToIDispatch().AddRef()
+		v := ole.NewVariant(ole.VT_DISPATCH, obj.Val)
+		this.onObject(&v)
+	case dispidOnCompleted:
+		status := params.arg(0)
+		var err error
+		if status != nil && int32(status.Val) != 0 {
+			err = ole.NewError(uintptr(uint32(status.Val)))
+		}
+		this.onCompleted(err)
+	}
+	return ole.S_OK
+}
+
+// asyncSink is a SWbemSink with our event handlers connected to it
+type asyncSink struct {
+	unknown *ole.IUnknown
+	sink    *ole.IDispatch
+	point   *ole.IConnectionPoint
+	cookie  uint32
+	events  *sinkEvents
+}
+
+func newAsyncSink(onObject func(*ole.VARIANT), onCompleted func(error)) (*asyncSink, error) {
+	unknown, err := oleutil.CreateObject("WbemScripting.SWbemSink")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating SWbemSink")
+	}
+	sink, err := unknown.QueryInterface(ole.IID_IDispatch)
+	if err != nil {
+		unknown.Release()
+		return nil, errors.Wrap(err, "QueryInterface")
+	}
+	s := &asyncSink{
+		unknown: unknown,
+		sink:    sink,
+	}
+
+	containerDisp, err := sink.QueryInterface(ole.IID_IConnectionPointContainer)
+	if err != nil {
+		s.close()
+		return nil, errors.Wrap(err, "QueryInterface(IConnectionPointContainer)")
+	}
+	container := (*ole.IConnectionPointContainer)(unsafe.Pointer(containerDisp))
+	defer container.Release()
+
+	if err := container.FindConnectionPoint(iidSWbemSinkEvents, &s.point); err != nil {
+		s.close()
+		return nil, errors.Wrap(err, "FindConnectionPoint")
+	}
+
+	s.events = &sinkEvents{
+		vtbl:        sinkVtable(),
+		onObject:    onObject,
+		onCompleted: onCompleted,
+	}
+	liveSinksLock.Lock()
+	liveSinks[s.events] = struct{}{}
+	liveSinksLock.Unlock()
+
+	s.cookie, err = s.point.Advise((*ole.IUnknown)(unsafe.Pointer(s.events)))
+	if err != nil {
+		s.close()
+		return nil, errors.Wrap(err, "Advise")
+	}
+	return s, nil
+}
+
+func (s *asyncSink) object() *ole.IDispatch {
+	return s.sink
+}
+
+func (s *asyncSink) cancel() {
+	oleutil.CallMethod(s.sink, "Cancel")
+}
+
+func (s *asyncSink) close() {
+	if s.point != nil {
+		if s.cookie != 0 {
+			s.point.Unadvise(s.cookie)
+		}
+		s.point.Release()
+		s.point = nil
+	}
+	if s.events != nil {
+		liveSinksLock.Lock()
+		delete(liveSinks, s.events)
+		liveSinksLock.Unlock()
+		s.events = nil
+	}
+	if s.sink != nil {
+		s.sink.Release()
+		s.sink = nil
+	}
+	if s.unknown != nil {
+		s.unknown.Release()
+		s.unknown = nil
+	}
+}
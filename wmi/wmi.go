@@ -23,29 +23,95 @@ var (
 	mutex           = sync.RWMutex{}
 )
 
+// connState holds the COM objects and settings of a connection. It is
+// shared by the connection, its sessions and the results acquired through
+// them, so a reconnect or a new retry policy is seen by all of them.
+type connState struct {
+	lock     sync.RWMutex
+	unknown  *ole.IUnknown
+	locator  *ole.IDispatch
+	services *ole.IDispatch
+	// params are the ConnectServer parameters used to reconnect
+	params []interface{}
+	retry  *RetryPolicy
+	strict bool
+	// schemas caches the property definitions used by strict mode
+	schemas map[string]map[string]propertySchema
+}
+
+// servicesObject returns the SWbemServices object of this connection.
+// The caller must release it.
+func (c *connState) servicesObject() (*ole.IDispatch, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.services == nil {
+		return nil, fmt.Errorf("connection is closed")
+	}
+	c.services.AddRef()
+	return c.services, nil
+}
+
+// retryPolicy returns the retry policy of this connection. It is
+// safe to call on a nil *connState.
+func (c *connState) retryPolicy() *RetryPolicy {
+	if c == nil {
+		return nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.retry
+}
+
+func (c *connState) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.services != nil {
+		c.services.Release()
+	}
+	if c.locator != nil {
+		c.locator.Release()
+	}
+	if c.unknown != nil {
+		c.unknown.Release()
+	}
+	c.services = nil
+	c.locator = nil
+	c.unknown = nil
+}
+
 // WMI represents a WMI connection object
 type WMI struct {
-	rawSvc     *ole.VARIANT
-	unknown    *ole.IUnknown
-	wmi        *ole.IDispatch
-	qInterface *ole.IDispatch
+	conn *connState
 
 	Namespace string
 	Server    string
 
-	params []interface{}
+	params  []interface{}
+	session *Session
+	replay  *Replayer
 }
 
-// NewResult wraps an ole.VARINT in a *Result
+// NewResult wraps an ole.VARINT in a *Result. The *Result takes ownership
+// of v, which is cleared when the result is released.
 func NewResult(v *ole.VARIANT) *Result {
-	return &Result{
-		rawRes: v,
-	}
+	return newResult(nil, v)
 }
 
 // Result holds the raw WMI result of a query
 type Result struct {
-	rawRes *ole.VARIANT
+	rawRes  *ole.VARIANT
+	fake    *replayValue
+	session *Session
+	conn    *connState
+	// owner is a connection opened for this result alone. It is
+	// closed when the result is released.
+	owner *WMI
+
+	// namespace, class and path are looked up by describe
+	describeOnce sync.Once
+	namespace    string
+	class        string
+	path         string
 
 	err error
 }
@@ -138,15 +204,35 @@ func (r *Result) Error() error {
 	return r.err
 }
 
-// Raw returns the raw WMI result
+// Raw returns the raw WMI result. For results served by a Replayer, only
+// the VT of the returned VARIANT is set.
 func (r *Result) Raw() *ole.VARIANT {
+	if r.fake != nil {
+		return &ole.VARIANT{VT: r.fake.vt}
+	}
 	return r.rawRes
 }
 
+// dispatch returns the IDispatch held by this result, or nil if the
+// result does not hold an object or was released.
+func (r *Result) dispatch() *ole.IDispatch {
+	if r == nil || r.rawRes == nil {
+		return nil
+	}
+	return r.rawRes.ToIDispatch()
+}
+
 // ItemAtIndex returns the result of the ItemIndex WMI call on a
 // raw WMI result object
 func (r *Result) ItemAtIndex(i int) (*Result, error) {
-	res := r.rawRes.ToIDispatch()
+	if r.fake != nil {
+		item, err := r.fake.itemAtIndex(i)
+		if err != nil {
+			return nil, errors.Wrap(err, "ItemIndex")
+		}
+		return r.replayChild(item), nil
+	}
+	res := r.dispatch()
 	if res == nil {
 		return nil, fmt.Errorf("Object is not callable")
 	}
@@ -157,9 +243,7 @@ func (r *Result) ItemAtIndex(i int) (*Result, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "ItemIndex")
 	}
-	wmiRes := &Result{
-		rawRes: itemRaw,
-	}
+	wmiRes := r.child(itemRaw)
 	return wmiRes, nil
 }
 
@@ -183,7 +267,31 @@ func (r *Result) Elements() ([]*Result, error) {
 
 // GetProperty will return a *Result holding a given property
 func (r *Result) GetProperty(property string) (*Result, error) {
-	res := r.rawRes.ToIDispatch()
+	obs := r.observe(Event{Kind: EventGetProperty, Property: property})
+	var ret *Result
+	var err error
+	if policy := retryPolicyFor(r.conn.retryPolicy(), nil, false); policy != nil {
+		err = policy.run(func() error {
+			var err error
+			ret, err = r.getProperty(property)
+			return err
+		}, r.rebind)
+	} else {
+		ret, err = r.getProperty(property)
+	}
+	obs.end(err)
+	return ret, err
+}
+
+func (r *Result) getProperty(property string) (*Result, error) {
+	if r.fake != nil {
+		val, err := r.fake.property(property)
+		if err != nil {
+			return nil, err
+		}
+		return r.replayChild(val), nil
+	}
+	res := r.dispatch()
 	if res == nil {
 		return nil, fmt.Errorf("Object is not callable")
 	}
@@ -194,15 +302,34 @@ func (r *Result) GetProperty(property string) (*Result, error) {
 	if err != nil {
 		return nil, err
 	}
-	wmiRes := &Result{
-		rawRes: rawVal,
-	}
+	wmiRes := r.child(rawVal)
 	return wmiRes, nil
 }
 
-// Get will execute a method on the WMI object held in *Result, with the given params
+// Get will execute a method on the WMI object held in *Result, with the given params.
+// Methods that only read, such as associators_ and Refresh_, are retried
+// according to the retry policy of the connection.
 func (r *Result) Get(method string, params ...interface{}) (*Result, error) {
-	res := r.rawRes.ToIDispatch()
+	policy := retryPolicyFor(r.conn.retryPolicy(), nil, !isReadObjectMethod(method))
+	if policy == nil {
+		return r.callObject(method, nil, 0, nil, params...)
+	}
+	var ret *Result
+	err := policy.run(func() error {
+		var err error
+		ret, err = r.callObject(method, nil, 0, nil, params...)
+		return err
+	}, r.rebind)
+	return ret, err
+}
+
+// invoke executes method on the WMI object held in *Result, without
+// recording the call. It is meant for plumbing around recorded calls.
+func (r *Result) invoke(method string, params ...interface{}) (*Result, error) {
+	if r.fake != nil {
+		return nil, errors.Wrap(errNotReplayable, method)
+	}
+	res := r.dispatch()
 	if res == nil {
 		return nil, fmt.Errorf("Object is not callable")
 	}
@@ -213,22 +340,118 @@ func (r *Result) Get(method string, params ...interface{}) (*Result, error) {
 	if err != nil {
 		return nil, err
 	}
-	wmiRes := &Result{
-		rawRes: rawSvc,
-	}
+	wmiRes := r.child(rawSvc)
 	return wmiRes, nil
 }
 
+// callObject executes method on the WMI object held in *Result. If opts
+// is not nil, the flags and context it holds are appended to params. The
+// call is recorded or replayed when a Recorder or Replayer is active, in
+// which case in holds the in parameters of a call made through Call.
+//
+// Associations are served from the query cache, when one is set, and
+// other calls invalidate the cached results they may affect.
+func (r *Result) callObject(method string, opts *Options, defaultFlags int, in map[string]interface{}, params ...interface{}) (*Result, error) {
+	args := canonicalArgs(params)
+	if opts != nil {
+		args = append(args, opts.canonical(defaultFlags)...)
+	}
+	if queryCache() == nil {
+		return r.callObjectOnce(method, opts, defaultFlags, in, args, params)
+	}
+	r.describe()
+	if classes, ok := associationClasses(method, r.class, params); ok {
+		key := append([]string{method, r.identity()}, args...)
+		ret, _, err := cachedQuery(r.session, r.conn, "", r.namespace, opts, classes, key, func() (*Result, error) {
+			return r.callObjectOnce(method, opts, defaultFlags, in, args, params)
+		})
+		return ret, err
+	}
+	ret, err := r.callObjectOnce(method, opts, defaultFlags, in, args, params)
+	if err == nil {
+		r.invalidateObjectCall(method, in, params, ret)
+	}
+	return ret, err
+}
+
+func (r *Result) callObjectOnce(method string, opts *Options, defaultFlags int, in map[string]interface{}, args []string, params []interface{}) (*Result, error) {
+	if r.fake != nil {
+		return r.fake.call(r, method, args, in)
+	}
+	res := r.dispatch()
+	if res == nil {
+		return nil, fmt.Errorf("Object is not callable")
+	}
+	res.AddRef()
+	defer res.Release()
+
+	rec := recorder()
+	var target string
+	if rec != nil {
+		target = r.identity()
+	}
+	var rawRes *ole.VARIANT
+	var err error
+	if opts == nil {
+		rawRes, err = oleutil.CallMethod(res, method, params...)
+	} else {
+		rawRes, err = opts.call(res, method, defaultFlags, params...)
+	}
+	var ret *Result
+	if err == nil {
+		ret = r.child(rawRes)
+	}
+	if rec != nil {
+		entry := FixtureEntry{
+			Op:     OpObject,
+			Target: target,
+			Method: method,
+			Args:   args,
+			In:     canonicalIn(in),
+		}
+		if err == nil && strings.EqualFold(method, "Refresh_") {
+			// Record the refreshed object, so a replay can update it.
+			entry.Result = snapshot("", r)
+			rec.add(entry)
+		} else {
+			rec.record(entry, ret, err)
+		}
+	}
+	return ret, err
+}
+
+// identity returns the target under which calls on this object are
+// recorded: its path or, for objects without a path, its class.
+func (r *Result) identity() string {
+	if r.fake != nil {
+		return r.fake.identity()
+	}
+	if pth, err := r.Path(); err == nil && pth != "" {
+		return pth
+	}
+	if class, err := r.Class(); err == nil {
+		return class
+	}
+	return ""
+}
+
+// replayChild wraps val in a *Result owned by the same session as r
+func (r *Result) replayChild(val *replayValue) *Result {
+	return newReplayResult(r.session, r.conn, val)
+}
+
 // Path returns the Path element of this WMI object
 func (r *Result) Path() (string, error) {
-	p, err := r.GetProperty("path_")
+	p, err := r.getProperty("path_")
 	if err != nil {
 		return "", err
 	}
-	path, err := p.GetProperty("Path")
+	defer p.Release()
+	path, err := p.getProperty("Path")
 	if err != nil {
 		return "", err
 	}
+	defer path.Release()
 	val := path.Value()
 	if val == nil {
 		return "", fmt.Errorf("Failed to get Path_")
@@ -236,21 +459,74 @@ func (r *Result) Path() (string, error) {
 	return val.(string), nil
 }
 
+// Class returns the name of the class of this WMI object
+func (r *Result) Class() (string, error) {
+	p, err := r.getProperty("path_")
+	if err != nil {
+		return "", err
+	}
+	defer p.Release()
+	class, err := p.getProperty("Class")
+	if err != nil {
+		return "", err
+	}
+	defer class.Release()
+	val, ok := class.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("Failed to get Path_.Class")
+	}
+	return val, nil
+}
+
 // Set will set the parameters of a property
 func (r *Result) Set(property string, params ...interface{}) error {
-	res := r.rawRes.ToIDispatch()
+	obs := r.observe(Event{Kind: EventSetProperty, Property: property})
+	err := r.set(property, params...)
+	obs.end(err)
+	return err
+}
+
+func (r *Result) set(property string, params ...interface{}) error {
+	if len(params) == 1 && r.conn.strictWrites() {
+		val, err := r.strictValue(property, params[0])
+		if err != nil {
+			return err
+		}
+		params = []interface{}{val}
+	}
+	if r.fake != nil {
+		return r.fake.set(property, params)
+	}
+	res := r.dispatch()
 	if res == nil {
 		return fmt.Errorf("Object is not callable")
 	}
 	res.AddRef()
 	defer res.Release()
-	_, err := oleutil.PutProperty(res, property, params...)
-	return err
+	// Objects are handed to SWbem as their IDispatch. The caller's
+	// slice is left untouched.
+	args := make([]interface{}, len(params))
+	for idx, val := range params {
+		if obj, ok := val.(*Result); ok {
+			args[idx] = obj.dispatch()
+			continue
+		}
+		args[idx] = val
+	}
+	ret, err := oleutil.PutProperty(res, property, args...)
+	if err != nil {
+		return err
+	}
+	ret.Clear()
+	return nil
 }
 
 // GetText returns an XML representation of an object or instance
 func (r *Result) GetText(i int) (string, error) {
-	res := r.rawRes.ToIDispatch()
+	if r.fake != nil {
+		return r.fake.text()
+	}
+	res := r.dispatch()
 	if res == nil {
 		return "", fmt.Errorf("Object is not callable")
 	}
@@ -260,12 +536,16 @@ func (r *Result) GetText(i int) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer t.Clear()
 	return t.ToString(), nil
 }
 
 // Value returns the value of a result as an interface. It is the job
 // of the caller to cast it to it's proper type
 func (r *Result) Value() interface{} {
+	if r != nil && r.fake != nil {
+		return r.fake.value
+	}
 	if r == nil || r.rawRes == nil {
 		return ""
 	}
@@ -281,9 +561,25 @@ func (r *Result) ToArray() *ole.SafeArrayConversion {
 	return r.rawRes.ToArray()
 }
 
+// ToValueArray returns the elements of an array result, or nil
+// if the result does not hold an array.
+func (r *Result) ToValueArray() []interface{} {
+	if r != nil && r.fake != nil {
+		return r.fake.values
+	}
+	arr := r.ToArray()
+	if arr == nil {
+		return nil
+	}
+	return arr.ToValueArray()
+}
+
 // Count returns the total number of results returned by the query.
 func (r *Result) Count() (int, error) {
-	res := r.rawRes.ToIDispatch()
+	if r.fake != nil {
+		return r.fake.count()
+	}
+	res := r.dispatch()
 	if res == nil {
 		return 0, nil
 	}
@@ -294,51 +590,36 @@ func (r *Result) Count() (int, error) {
 	return int(countVar.Val), nil
 }
 
-// NewWMIObject returns a new *Result from a path
+// NewWMIObject returns a new *Result from a path. The result holds the
+// connection opened to get it, which is closed when the result is
+// released.
 func NewWMIObject(path string) (*Result, error) {
-	return nil, nil
-}
-
-// NewConnection returns a new *WMI connection, given the parameters
-func NewConnection(params ...interface{}) (*WMI, error) {
-	err := ole.CoInitializeEx(0, ole.COINIT_MULTITHREADED)
+	loc, err := NewLocation(path)
 	if err != nil {
-		oleerr := err.(*ole.OleError)
-		// CoInitialize already called
-		// https://msdn.microsoft.com/en-us/library/windows/desktop/ms695279%28v=vs.85%29.aspx
-		if oleerr.Code() != ole.S_OK && oleerr.Code() != 0x00000001 {
-			return nil, err
-		}
+		return nil, errors.Wrap(err, "NewLocation")
 	}
-	unknown, err := oleutil.CreateObject("WbemScripting.SWbemLocator")
+	conn, err := NewConnection(loc.Server, loc.Namespace)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "NewConnection")
 	}
-	qInterface, err := unknown.QueryInterface(ole.IID_IDispatch)
+	result, err := conn.Get(path)
 	if err != nil {
+		conn.Close()
+		if IsHResult(err, WBEMNotFound) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
-
-	rawSvc, err := oleutil.CallMethod(qInterface, "ConnectServer", params...)
-	if err != nil {
-		return nil, fmt.Errorf("Error: %v", err)
-	}
-	wmi := rawSvc.ToIDispatch()
-	w := &WMI{
-		rawSvc:     rawSvc,
-		unknown:    unknown,
-		qInterface: qInterface,
-		wmi:        wmi,
-		params:     params,
-	}
-	return w, nil
+	result.owner = conn
+	return result, nil
 }
 
 // Close will close the WMI connection and release all resources.
 func (w *WMI) Close() {
-	w.wmi.Release()
-	w.qInterface.Release()
-	w.unknown.Release()
+	if w.replay != nil {
+		return
+	}
+	w.conn.close()
 	ole.CoUninitialize()
 }
 
@@ -357,32 +638,175 @@ func (w *WMI) getQueryParams(qParams []Query) (string, error) {
 	return ret, nil
 }
 
-// Get returns a new *Result, given the params
-func (w *WMI) Get(params ...interface{}) (*Result, error) {
-	rawSvc, err := oleutil.CallMethod(w.wmi, "Get", params...)
+// connectionTarget returns the server and namespace addressed
+// by the parameters of ConnectServer.
+func connectionTarget(params []interface{}) (string, string) {
+	server, namespace := ".", DefaultNamespace
+	if len(params) > 0 {
+		if val, ok := params[0].(string); ok && val != "" {
+			server = val
+		}
+	}
+	if len(params) > 1 {
+		if val, ok := params[1].(string); ok && val != "" {
+			namespace = val
+		}
+	}
+	return server, namespace
+}
+
+// callService calls method on the SWbemServices object of this connection.
+// If opts is not nil, the flags and context it holds are appended to params.
+// Transient failures are retried according to the retry policy in effect.
+// Every attempt is recorded or replayed when a Recorder or Replayer is active.
+func (w *WMI) callService(method string, opts *Options, defaultFlags int, params ...interface{}) (*Result, error) {
+	var callPolicy *RetryPolicy
+	if opts != nil {
+		callPolicy = opts.Retry
+	}
+	policy := retryPolicyFor(w.conn.retryPolicy(), callPolicy, !isReadMethod(method))
+	if policy == nil {
+		return w.callServiceOnce(method, opts, defaultFlags, params...)
+	}
+	var ret *Result
+	err := policy.run(func() error {
+		var err error
+		ret, err = w.callServiceOnce(method, opts, defaultFlags, params...)
+		return err
+	}, w.reconnect)
+	return ret, err
+}
+
+func (w *WMI) callServiceOnce(method string, opts *Options, defaultFlags int, params ...interface{}) (*Result, error) {
+	args := canonicalArgs(params)
+	if opts != nil {
+		args = append(args, opts.canonical(defaultFlags)...)
+	}
+	key := entryKey(OpService, w.Namespace, "", method, args, nil)
+	if w.replay != nil {
+		ret, _, err := w.replay.serve(w.session, w.conn, key)
+		if err == nil {
+			w.invalidateServiceCall(method, params, ret)
+		}
+		return ret, err
+	}
+
+	services, err := w.conn.servicesObject()
 	if err != nil {
 		return nil, err
 	}
-	ret := &Result{
-		rawRes: rawSvc,
+	var rawSvc *ole.VARIANT
+	if opts == nil {
+		rawSvc, err = oleutil.CallMethod(services, method, params...)
+	} else {
+		rawSvc, err = opts.call(services, method, defaultFlags, params...)
+	}
+	services.Release()
+	var ret *Result
+	if err == nil {
+		ret = w.newResult(rawSvc)
+	}
+	if rec := recorder(); rec != nil {
+		entry := FixtureEntry{
+			Op:        OpService,
+			Namespace: w.Namespace,
+			Method:    method,
+			Args:      args,
+		}
+		rec.record(entry, ret, err)
 	}
-	return ret, nil
+	if err == nil {
+		w.invalidateServiceCall(method, params, ret)
+	}
+	return ret, err
+}
+
+// Get returns a new *Result, given the params
+func (w *WMI) Get(params ...interface{}) (*Result, error) {
+	e := Event{Kind: EventGet, Namespace: w.Namespace}
+	if len(params) > 0 {
+		if objectPath, ok := params[0].(string); ok {
+			e.Path = objectPath
+			e.Class = pathClass(objectPath)
+		}
+	}
+	obs := observe(e)
+	ret, err := w.callService("Get", nil, 0, params...)
+	obs.end(err)
+	return ret, err
+}
+
+// GetWithOptions returns the object identified by objectPath, passing
+// the flags and context in opts to the provider.
+func (w *WMI) GetWithOptions(objectPath string, opts Options) (*Result, error) {
+	obs := observe(Event{
+		Kind:      EventGet,
+		Namespace: w.Namespace,
+		Class:     pathClass(objectPath),
+		Path:      objectPath,
+	})
+	ret, err := w.callService("Get", &opts, defaultGetExecMethodFlags, objectPath)
+	obs.end(err)
+	return ret, err
 }
 
 // ExecMethod wraps the WMI ExecMethod call and returns a *Result
 func (w *WMI) ExecMethod(params ...interface{}) (*Result, error) {
-	rawSvc, err := oleutil.CallMethod(w.wmi, "ExecMethod", params...)
+	e := Event{Kind: EventMethodCall, Namespace: w.Namespace}
+	if len(params) > 1 {
+		e.Path, _ = params[0].(string)
+		e.Class = pathClass(e.Path)
+		e.Method, _ = params[1].(string)
+	}
+	obs := observe(e)
+	ret, err := w.callService("ExecMethod", nil, 0, params...)
+	obs.end(err)
+	return ret, err
+}
+
+// ExecMethodWithOptions calls method on the object identified by objectPath
+// with the named in parameters, passing the flags and context in opts to
+// the provider.
+func (w *WMI) ExecMethodWithOptions(objectPath, method string, in map[string]interface{}, opts Options) (Outputs, error) {
+	obj, err := w.GetWithOptions(objectPath, opts)
 	if err != nil {
-		return nil, err
-	}
-	ret := &Result{
-		rawRes: rawSvc,
-	}
-	return ret, nil
+		return Outputs{}, errors.Wrapf(err, "getting %s", objectPath)
+	}
+	return obj.Call(method, in, opts)
+}
+
+// ExecQuery runs a WQL query and returns a *Result holding
+// the resulting SWbemObjectSet.
+func (w *WMI) ExecQuery(wql string, opts ...Options) (*Result, error) {
+	obs := observe(Event{
+		Kind:      EventQuery,
+		Namespace: w.Namespace,
+		Class:     queryClass(wql),
+		WQL:       wql,
+	})
+	merged := mergeOptions(opts)
+	var o *Options
+	params := []interface{}{wql}
+	defaultFlags := 0
+	if len(opts) > 0 && !(merged.NoCache && merged.cacheOnly()) {
+		o = &merged
+		params = append(params, "WQL")
+		defaultFlags = defaultExecQueryFlags
+	}
+	args := canonicalArgs(params)
+	if o != nil {
+		args = append(args, o.canonical(defaultFlags)...)
+	}
+	ret, cached, err := cachedQuery(w.session, w.conn, w.Server, w.Namespace, &merged, []string{queryClass(wql)}, args, func() (*Result, error) {
+		return w.callService("ExecQuery", o, defaultFlags, params...)
+	})
+	obs.setCached(cached)
+	obs.end(err)
+	return ret, err
 }
 
 // Gwmi makes a WMI query and returns a *Result
-func (w *WMI) Gwmi(resource string, fields []string, qParams []Query) (*Result, error) {
+func (w *WMI) Gwmi(resource string, fields []string, qParams []Query, opts ...Options) (*Result, error) {
 	n := "*"
 	if len(fields) > 0 {
 		n = strings.Join(fields, ",")
@@ -393,20 +817,12 @@ func (w *WMI) Gwmi(resource string, fields []string, qParams []Query) (*Result,
 	}
 	// result is a SWBemObjectSet
 	q := fmt.Sprintf("SELECT %s FROM %s %s", n, resource, qStr)
-	// fmt.Println(q)
-	resultRaw, err := oleutil.CallMethod(w.wmi, "ExecQuery", q)
-	if err != nil {
-		return nil, err
-	}
-	wmiRes := &Result{
-		rawRes: resultRaw,
-	}
-	return wmiRes, nil
+	return w.ExecQuery(q, opts...)
 }
 
 // GetOne returns the first result from a query response.
-func (w *WMI) GetOne(resource string, fields []string, qParams []Query) (*Result, error) {
-	res, err := w.Gwmi(resource, fields, qParams)
+func (w *WMI) GetOne(resource string, fields []string, qParams []Query, opts ...Options) (*Result, error) {
+	res, err := w.Gwmi(resource, fields, qParams, opts...)
 	if err != nil {
 		return nil, err
 	}